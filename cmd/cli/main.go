@@ -27,19 +27,33 @@ var (
 )
 
 type Config struct {
-	Server    string      `json:"server"`
-	Token     string      `json:"token"`
-	SNI       string      `json:"sni"`
-	Obfuscate interface{} `json:"obfuscate"`
+	Server            string      `json:"server"`
+	User              string      `json:"user"`
+	Token             string      `json:"token"`
+	ObfsSecret        string      `json:"obfs_secret"`
+	SNI               string      `json:"sni"`
+	ServerFingerprint string      `json:"server_fingerprint"`
+	ServerCA          string      `json:"server_ca"` // Path to a PEM CA bundle
+	ClientCert        string      `json:"client_cert"` // Path to a PEM device certificate (mutual TLS)
+	ClientKey         string      `json:"client_key"`  // Path to its PEM private key
+	Obfuscate         interface{} `json:"obfuscate"`
+	KillSwitch        bool        `json:"kill_switch"`
 }
 
 func main() {
 	connectCmd := flag.NewFlagSet("connect", flag.ExitOnError)
 	server := connectCmd.String("server", "", "Server address (e.g. 1.2.3.4:4242)")
+	user := connectCmd.String("user", "", "User name (optional)")
 	token := connectCmd.String("token", "", "Authentication token")
+	obfsSecret := connectCmd.String("obfs-secret", "", "Reality obfuscation secret (defaults to token)")
 	sni := connectCmd.String("sni", "", "Mimic Target (SNI)")
+	fingerprint := connectCmd.String("fingerprint", "", "Pinned server key fingerprint (sha256:<hex>)")
+	caFile := connectCmd.String("ca", "", "PEM CA bundle the server certificate must chain to")
+	certFile := connectCmd.String("cert", "", "PEM client certificate for servers that require one")
+	keyFile := connectCmd.String("key", "", "PEM private key for -cert")
 	full := connectCmd.Bool("full", true, "Enable full tunnel")
 	obfs := connectCmd.Bool("obfs", true, "Enable protocol obfuscation")
+	killSwitch := connectCmd.Bool("killswitch", false, "Block all non-VPN traffic until disconnect")
 
 	if len(os.Args) < 2 {
 		printUsage()
@@ -49,7 +63,7 @@ func main() {
 	switch os.Args[1] {
 	case "connect":
 		connectCmd.Parse(os.Args[2:])
-		doConnect(*server, *token, *sni, *full, *obfs)
+		doConnect(*server, *user, *token, *obfsSecret, *sni, *fingerprint, *caFile, *certFile, *keyFile, *full, *obfs, *killSwitch)
 	case "disconnect":
 		sendSimpleCommand(ipc.CmdDisconnect)
 	case "status":
@@ -71,10 +85,17 @@ func printUsage() {
 	fmt.Println("  slopn logs              Show helper logs")
 	fmt.Println("\nConnect Flags:")
 	fmt.Println("  -server <addr>  Override server address")
+	fmt.Println("  -user <name>    Override user name")
 	fmt.Println("  -token <token>  Override auth token")
+	fmt.Println("  -obfs-secret <s> Override obfuscation secret")
 	fmt.Println("  -sni <sni>      Override mimic target (SNI)")
+	fmt.Println("  -fingerprint <fp> Pin the server key (printed by the server)")
+	fmt.Println("  -ca <file>      Verify the server against a CA bundle")
+	fmt.Println("  -cert <file>    Client certificate (mutual TLS)")
+	fmt.Println("  -key <file>     Client certificate key")
 	fmt.Println("  -full           Enable full tunnel (default true)")
 	fmt.Println("  -obfs           Enable obfuscation (default true)")
+	fmt.Println("  -killswitch     Block non-VPN traffic until disconnect (Linux)")
 }
 
 func getIPCSecret() string {
@@ -115,7 +136,7 @@ func sendRequest(req ipc.Request) (*ipc.Response, error) {
 	}
 
 	if resp.Status == "error" {
-		return nil, fmt.Errorf(resp.Message)
+		return nil, fmt.Errorf("%s", resp.Message)
 	}
 
 	return &resp, nil
@@ -130,15 +151,21 @@ func sendSimpleCommand(cmd ipc.Command) {
 	fmt.Println(resp.Message)
 }
 
-func doConnect(srv, tok, sni string, full, obfs bool) {
+func doConnect(srv, user, tok, obfsSecret, sni, fingerprint, caFile, certFile, keyFile string, full, obfs, killSwitch bool) {
 	// Fallback to config.json if flags are missing
 	cfg := loadConfig()
 	if srv == "" {
 		srv = cfg.Server
 	}
+	if user == "" {
+		user = cfg.User
+	}
 	if tok == "" {
 		tok = cfg.Token
 	}
+	if obfsSecret == "" {
+		obfsSecret = cfg.ObfsSecret
+	}
 	if sni == "" {
 		sni = cfg.SNI
 		if sni == "" {
@@ -159,19 +186,64 @@ func doConnect(srv, tok, sni string, full, obfs bool) {
 		}
 	}
 
-	if srv == "" || tok == "" {
-		fmt.Println("Error: Server address and token are required (via flags or config.json)")
+	if fingerprint == "" {
+		fingerprint = cfg.ServerFingerprint
+	}
+	if caFile == "" {
+		caFile = cfg.ServerCA
+	}
+	var caPEM []byte
+	if caFile != "" {
+		var err error
+		if caPEM, err = os.ReadFile(caFile); err != nil {
+			fmt.Printf("Error: cannot read server CA: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if fingerprint == "" && caPEM == nil {
+		fmt.Println("Warning: server identity is not verified (set -fingerprint or -ca)")
+	}
+
+	if certFile == "" {
+		certFile, keyFile = cfg.ClientCert, cfg.ClientKey
+	}
+	var certPEM, keyPEM []byte
+	if certFile != "" {
+		var err error
+		if certPEM, err = os.ReadFile(certFile); err != nil {
+			fmt.Printf("Error: cannot read client certificate: %v\n", err)
+			os.Exit(1)
+		}
+		if keyPEM, err = os.ReadFile(keyFile); err != nil {
+			fmt.Printf("Error: cannot read client key: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.KillSwitch {
+		killSwitch = true
+	}
+
+	if srv == "" || (tok == "" && certPEM == nil) {
+		fmt.Println("Error: Server address and a token or client certificate are required (via flags or config.json)")
 		os.Exit(1)
 	}
 
-	fmt.Printf("Connecting to %s (SNI: %s, Full: %v, Obfs: %v)...\n", srv, sni, full, obfs)
+	fmt.Printf("Connecting to %s (SNI: %s, Full: %v, Obfs: %v, Kill switch: %v)...\n", srv, sni, full, obfs, killSwitch)
 	resp, err := sendRequest(ipc.Request{
-		Command:    ipc.CmdConnect,
-		ServerAddr: srv,
-		Token:      tok,
-		SNI:        sni,
-		FullTunnel: full,
-		Obfuscate:  obfs,
+		Command:           ipc.CmdConnect,
+		ServerAddr:        srv,
+		User:              user,
+		Token:             tok,
+		ObfsSecret:        obfsSecret,
+		SNI:               sni,
+		ServerFingerprint: fingerprint,
+		ServerCA:          string(caPEM),
+		ClientCert:        string(certPEM),
+		ClientKey:         string(keyPEM),
+		FullTunnel:        full,
+		Obfuscate:         obfs,
+		KillSwitch:        killSwitch,
 	})
 	if err != nil {
 		fmt.Printf("Connection Failed: %v\n", err)
@@ -5,7 +5,6 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -20,16 +19,25 @@ import (
 	"time"
 
 	"github.com/quic-go/quic-go"
+	"github.com/webdunesurfer/SloPN/pkg/certutil"
 	"github.com/webdunesurfer/SloPN/pkg/iputil"
 	"github.com/webdunesurfer/SloPN/pkg/obfuscator"
 	"github.com/webdunesurfer/SloPN/pkg/protocol"
+	"github.com/webdunesurfer/SloPN/pkg/routes"
 	"github.com/webdunesurfer/SloPN/pkg/tunutil"
 )
 
 type Config struct {
 	ServerAddr    string `json:"server_addr"`
+	User          string `json:"user"`
 	Token         string `json:"token"`
+	ObfsSecret    string `json:"obfs_secret"` // Defaults to Token
+	DeviceID      string `json:"device_id"`   // Optional, for VIP reservations
 	SNI           string `json:"sni"`
+	Fingerprint   string `json:"server_fingerprint"` // Pinned server key, "sha256:<hex>"
+	ServerCA      string `json:"server_ca"`          // Path to a PEM CA bundle
+	ClientCert    string `json:"client_cert"`        // Path to a PEM device certificate (mutual TLS)
+	ClientKey     string `json:"client_key"`         // Path to its PEM private key
 	Verbose       bool   `json:"verbose"`
 	HostRouteOnly bool   `json:"host_route_only"`
 	NoRoute       bool   `json:"no_route"`
@@ -70,10 +78,31 @@ func main() {
 		serverHost, _, _ := net.SplitHostPort(cfg.ServerAddr)
 		cfg.SNI = serverHost
 	}
-	tlsConf := &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         []string{"h3"},
-		ServerName:         cfg.SNI,
+	var caPEM []byte
+	if cfg.ServerCA != "" {
+		if caPEM, err = os.ReadFile(cfg.ServerCA); err != nil {
+			log.Fatalf("Failed to read server CA: %v", err)
+		}
+	}
+	tlsConf, err := certutil.ClientConfig(cfg.SNI, cfg.Fingerprint, caPEM)
+	if err != nil {
+		log.Fatalf("TLS config error: %v", err)
+	}
+	if cfg.Fingerprint == "" && caPEM == nil {
+		fmt.Println("Warning: server identity is not verified (set server_fingerprint or server_ca)")
+	}
+	if cfg.ClientCert != "" {
+		certPEM, err := os.ReadFile(cfg.ClientCert)
+		if err != nil {
+			log.Fatalf("Failed to read client certificate: %v", err)
+		}
+		keyPEM, err := os.ReadFile(cfg.ClientKey)
+		if err != nil {
+			log.Fatalf("Failed to read client key: %v", err)
+		}
+		if err := certutil.AddClientCert(tlsConf, certPEM, keyPEM); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	udpAddr, err := net.ResolveUDPAddr("udp", cfg.ServerAddr)
@@ -81,7 +110,11 @@ func main() {
 		log.Fatal(err)
 	}
 
-	udpConn, err := net.ListenPacket("udp", "0.0.0.0:0")
+	localAddr := "0.0.0.0:0"
+	if udpAddr.IP.To4() == nil {
+		localAddr = "[::]:0"
+	}
+	udpConn, err := net.ListenPacket("udp", localAddr)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -90,7 +123,11 @@ func main() {
 	var finalConn net.PacketConn = udpConn
 	if cfg.Obfuscate {
 		fmt.Printf("Protocol Obfuscation (Reality) enabled. SNI: %s\n", cfg.SNI)
-		finalConn = obfuscator.NewRealityConn(udpConn, cfg.Token, "")
+		secret := cfg.ObfsSecret
+		if secret == "" {
+			secret = cfg.Token
+		}
+		finalConn = obfuscator.NewRealityConn(udpConn, secret, "")
 	}
 
 	conn, err := quic.Dial(context.Background(), finalConn, udpAddr, tlsConf, &quic.Config{
@@ -110,7 +147,7 @@ func main() {
 	defer stream.Close()
 
 	json.NewEncoder(stream).Encode(protocol.LoginRequest{
-		Type: protocol.MessageTypeLoginRequest, Token: cfg.Token,
+		Type: protocol.MessageTypeLoginRequest, User: cfg.User, Token: cfg.Token, DeviceID: cfg.DeviceID,
 		ClientVersion: "0.9.9", OS: runtime.GOOS,
 	})
 
@@ -124,9 +161,14 @@ func main() {
 	fmt.Printf("Connected! Assigned VIP: %s (Server: %s)\n", loginResp.AssignedVIP, loginResp.ServerVIP)
 
 	// 3. Setup TUN
+	mask := loginResp.SubnetMask
+	if mask == "" {
+		mask = tunutil.DefaultMask
+	}
 	tunCfg := tunutil.Config{
 		Addr: loginResp.AssignedVIP, Peer: loginResp.ServerVIP,
-		Mask: "255.255.255.0", MTU: 1100,
+		Mask: mask, MTU: 1100,
+		Addr6: loginResp.AssignedVIP6, Prefix6: loginResp.Prefix6Len,
 		SkipSubnetRoute: cfg.HostRouteOnly,
 		NoRoute:         cfg.NoRoute,
 	}
@@ -136,7 +178,36 @@ func main() {
 	}
 	defer ifce.Close()
 
-	// 4. Implement Full Tunnel Routing
+	// 4. Server-pushed routes override the local tunnel mode
+	if len(loginResp.Routes) > 0 && !cfg.NoRoute {
+		var pushed []string
+		cfg.FullTunnel, pushed = routes.Split(loginResp.Routes)
+		for _, cidr := range pushed {
+			var cmd *exec.Cmd
+			switch runtime.GOOS {
+			case "darwin":
+				cmd = exec.Command("route", "add", "-net", cidr, loginResp.ServerVIP)
+			case "linux":
+				cmd = exec.Command("ip", "route", "replace", cidr, "dev", ifce.Name())
+			default:
+				continue
+			}
+			if err := cmd.Run(); err != nil {
+				fmt.Printf("Failed to add pushed route %s: %v\n", cidr, err)
+				continue
+			}
+			fmt.Printf("Added pushed route %s\n", cidr)
+			defer func(cidr string) {
+				if runtime.GOOS == "darwin" {
+					exec.Command("route", "delete", "-net", cidr).Run()
+				} else {
+					exec.Command("ip", "route", "del", cidr).Run()
+				}
+			}(cidr)
+		}
+	}
+
+	// 5. Implement Full Tunnel Routing
 	var currentGW string
 	var serverHost string
 	if cfg.FullTunnel && runtime.GOOS == "darwin" {
@@ -168,7 +239,7 @@ func main() {
 
 	isLinux := runtime.GOOS == "linux"
 	
-	// 5. Packet Forwarding
+	// 6. Packet Forwarding
 	
 	// QUIC -> TUN
 	go func() {
@@ -0,0 +1,235 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const resolvConfPath = "/etc/resolv.conf"
+
+// dnsStatePath records what setupDNS changed so it can be undone after a crash
+var dnsStatePath = filepath.Join(filepath.Dir(SecretPath), "dns.state")
+
+type dnsState struct {
+	Method    string `json:"method"` // "resolved", "resolvconf" or "file"
+	Interface string `json:"interface"`
+	IfIndex   int    `json:"ifindex,omitempty"`
+	Backup    string `json:"backup,omitempty"`  // Original resolv.conf for the "file" method
+	Symlink   string `json:"symlink,omitempty"` // Original resolv.conf symlink target, if any
+}
+
+// resolved1 D-Bus argument types
+type resolvedDNS struct {
+	Family  int32
+	Address []byte
+}
+
+type resolvedDomain struct {
+	Domain      string
+	RoutingOnly bool
+}
+
+// setupDNS applies the session's DNS settings to the TUN link. It prefers
+// systemd-resolved per-link DNS, then resolvconf, then rewriting resolv.conf.
+// Only systemd-resolved can route split domains; without it a split tunnel
+// keeps the system DNS, and a full tunnel sends every query to the VPN.
+func (h *Helper) setupDNS(ifceName string, full bool) {
+	servers, search, domains := h.dnsConfig()
+
+	// A stale state file means an earlier session was not cleaned up
+	h.restoreDNS()
+
+	st := dnsState{Interface: ifceName}
+	if ifce, err := net.InterfaceByName(ifceName); err == nil {
+		st.IfIndex = ifce.Index
+		if err := setResolvedLink(ifce.Index, servers, search, domains); err == nil {
+			st.Method = "resolved"
+		} else {
+			logHelper(fmt.Sprintf("[DNS] systemd-resolved unavailable: %v", err))
+		}
+	}
+
+	if st.Method == "" && len(domains) > 0 {
+		if !full {
+			logHelper(fmt.Sprintf("[DNS] Split DNS (%s) needs systemd-resolved, keeping system DNS", strings.Join(domains, ",")))
+			return
+		}
+		logHelper("[DNS] Split DNS needs systemd-resolved, sending all queries via the VPN")
+		domains = nil
+	}
+
+	if st.Method == "" {
+		if _, err := exec.LookPath("resolvconf"); err == nil {
+			cmd := exec.Command("resolvconf", "-a", ifceName+".slopn", "-m", "0", "-x")
+			cmd.Stdin = strings.NewReader(resolvConf(servers, search))
+			if out, err := cmd.CombinedOutput(); err == nil {
+				st.Method = "resolvconf"
+			} else {
+				logHelper(fmt.Sprintf("[DNS] resolvconf failed: %v (%s)", err, strings.TrimSpace(string(out))))
+			}
+		}
+	}
+
+	if st.Method == "" {
+		backup, err := os.ReadFile(resolvConfPath)
+		if err != nil {
+			logHelper(fmt.Sprintf("[DNS] Cannot read %s: %v", resolvConfPath, err))
+			return
+		}
+		st.Method = "file"
+		st.Backup = string(backup)
+		if target, err := os.Readlink(resolvConfPath); err == nil {
+			st.Symlink = target
+		}
+		// Persist the backup before touching the file
+		if err := saveDNSState(st); err != nil {
+			logHelper(fmt.Sprintf("[DNS] Cannot save DNS state, leaving resolv.conf alone: %v", err))
+			return
+		}
+		if err := writeResolvConf(resolvConf(servers, search)); err != nil {
+			logHelper(fmt.Sprintf("[DNS] Failed to write %s: %v", resolvConfPath, err))
+		}
+	}
+
+	if err := saveDNSState(st); err != nil {
+		logHelper(fmt.Sprintf("[DNS] WARNING: could not save DNS state: %v", err))
+	}
+	mode := "all domains"
+	if len(domains) > 0 {
+		mode = "split: " + strings.Join(domains, ",")
+	}
+	logHelper(fmt.Sprintf("[DNS] Using %s via %s (%s)", strings.Join(servers, ","), st.Method, mode))
+}
+
+// restoreDNS undoes whatever setupDNS recorded in the state file
+func (h *Helper) restoreDNS() {
+	data, err := os.ReadFile(dnsStatePath)
+	if err != nil {
+		return
+	}
+	var st dnsState
+	if err := json.Unmarshal(data, &st); err != nil {
+		os.Remove(dnsStatePath)
+		return
+	}
+
+	switch st.Method {
+	case "resolved":
+		// The link settings vanish with the interface; revert in case it still exists
+		if err := revertResolvedLink(st.IfIndex); err != nil {
+			h.logVerbose(fmt.Sprintf("[DNS] RevertLink: %v", err))
+		}
+	case "resolvconf":
+		exec.Command("resolvconf", "-d", st.Interface+".slopn", "-f").Run()
+	case "file":
+		if st.Symlink != "" {
+			os.Remove(resolvConfPath)
+			err = os.Symlink(st.Symlink, resolvConfPath)
+		} else {
+			err = writeResolvConf(st.Backup)
+		}
+		if err != nil {
+			logHelper(fmt.Sprintf("[DNS] Failed to restore %s: %v", resolvConfPath, err))
+			return
+		}
+	}
+	os.Remove(dnsStatePath)
+	logHelper(fmt.Sprintf("[DNS] Restored system DNS (%s)", st.Method))
+}
+
+func setResolvedLink(ifIndex int, servers, search, domains []string) error {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	obj := conn.Object("org.freedesktop.resolve1", "/org/freedesktop/resolve1")
+
+	var addrs []resolvedDNS
+	for _, s := range servers {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			continue
+		}
+		if v4 := ip.To4(); v4 != nil {
+			addrs = append(addrs, resolvedDNS{Family: syscall.AF_INET, Address: v4})
+		} else {
+			addrs = append(addrs, resolvedDNS{Family: syscall.AF_INET6, Address: ip.To16()})
+		}
+	}
+
+	var doms []resolvedDomain
+	for _, d := range search {
+		doms = append(doms, resolvedDomain{Domain: d})
+	}
+	for _, d := range domains {
+		doms = append(doms, resolvedDomain{Domain: d, RoutingOnly: true})
+	}
+	if len(domains) == 0 {
+		// "~." routes every query to this link
+		doms = append(doms, resolvedDomain{Domain: ".", RoutingOnly: true})
+	}
+
+	idx := int32(ifIndex)
+	if err := obj.Call("org.freedesktop.resolve1.Manager.SetLinkDNS", 0, idx, addrs).Err; err != nil {
+		return err
+	}
+	if err := obj.Call("org.freedesktop.resolve1.Manager.SetLinkDomains", 0, idx, doms).Err; err != nil {
+		return err
+	}
+	// Older systemd versions lack SetLinkDefaultRoute; "~." above covers them
+	obj.Call("org.freedesktop.resolve1.Manager.SetLinkDefaultRoute", 0, idx, len(domains) == 0)
+	obj.Call("org.freedesktop.resolve1.Manager.FlushCaches", 0)
+	return nil
+}
+
+func revertResolvedLink(ifIndex int) error {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	obj := conn.Object("org.freedesktop.resolve1", "/org/freedesktop/resolve1")
+	return obj.Call("org.freedesktop.resolve1.Manager.RevertLink", 0, int32(ifIndex)).Err
+}
+
+func resolvConf(servers, search []string) string {
+	var b strings.Builder
+	b.WriteString("# Generated by SloPN helper\n")
+	for _, s := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", s)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+	return b.String()
+}
+
+// writeResolvConf replaces resolv.conf atomically. A symlinked resolv.conf is
+// replaced by a regular file; restoreDNS puts the symlink back.
+func writeResolvConf(content string) error {
+	tmp := resolvConfPath + ".slopn.tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, resolvConfPath)
+}
+
+func saveDNSState(st dnsState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(dnsStatePath), 0755)
+	return os.WriteFile(dnsStatePath, data, 0600)
+}
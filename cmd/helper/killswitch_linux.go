@@ -0,0 +1,92 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// The nftables table is the only kill switch state: it outlives a crashed
+// helper and is picked up again by recoverKillSwitch
+const killSwitchTable = "slopn_killswitch"
+
+// enableKillSwitch drops all traffic except loopback, the tunnel interface,
+// DHCP/neighbour discovery and the VPN server itself. Calling it again
+// atomically replaces the rules, e.g. for a different server.
+func (h *Helper) enableKillSwitch(server *net.UDPAddr, ifceName string) error {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return fmt.Errorf("kill switch requires nftables: %v", err)
+	}
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(killSwitchRules(server, ifceName))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft: %v (%s)", err, strings.TrimSpace(string(out)))
+	}
+
+	h.mu.Lock()
+	h.killSwitch = true
+	h.mu.Unlock()
+	logHelper(fmt.Sprintf("[KILLSWITCH] Active: only %s and %s are reachable", server, ifceName))
+	return nil
+}
+
+// disableKillSwitch lifts the block. Only an explicit disconnect calls this.
+func (h *Helper) disableKillSwitch() {
+	h.mu.Lock()
+	active := h.killSwitch
+	h.killSwitch = false
+	h.mu.Unlock()
+
+	if err := exec.Command("nft", "delete", "table", "inet", killSwitchTable).Run(); err == nil || active {
+		logHelper("[KILLSWITCH] Lifted")
+	}
+}
+
+// recoverKillSwitch keeps a kill switch left behind by a crashed helper in
+// place, so traffic stays blocked until the user disconnects
+func (h *Helper) recoverKillSwitch() {
+	if exec.Command("nft", "list", "table", "inet", killSwitchTable).Run() != nil {
+		return
+	}
+	h.mu.Lock()
+	h.killSwitch = true
+	h.mu.Unlock()
+	logHelper("[KILLSWITCH] Still active from a previous session; disconnect to lift it")
+}
+
+func killSwitchRules(server *net.UDPAddr, ifceName string) string {
+	family := "ip"
+	if server.IP.To4() == nil {
+		family = "ip6"
+	}
+
+	var b strings.Builder
+	// Declaring the table first makes the delete safe when it does not exist yet
+	fmt.Fprintf(&b, "table inet %s\n", killSwitchTable)
+	fmt.Fprintf(&b, "delete table inet %s\n", killSwitchTable)
+	fmt.Fprintf(&b, "table inet %s {\n", killSwitchTable)
+
+	b.WriteString("\tchain output {\n")
+	b.WriteString("\t\ttype filter hook output priority 0; policy drop;\n")
+	b.WriteString("\t\toifname \"lo\" accept\n")
+	fmt.Fprintf(&b, "\t\toifname %q accept\n", ifceName)
+	fmt.Fprintf(&b, "\t\t%s daddr %s udp dport %d accept\n", family, server.IP, server.Port)
+	b.WriteString("\t\tudp sport 68 udp dport 67 accept\n")
+	b.WriteString("\t\ticmpv6 type { nd-router-solicit, nd-neighbor-solicit, nd-neighbor-advert } accept\n")
+	b.WriteString("\t}\n")
+
+	b.WriteString("\tchain input {\n")
+	b.WriteString("\t\ttype filter hook input priority 0; policy drop;\n")
+	b.WriteString("\t\tiifname \"lo\" accept\n")
+	fmt.Fprintf(&b, "\t\tiifname %q accept\n", ifceName)
+	b.WriteString("\t\tct state established,related accept\n")
+	b.WriteString("\t\tudp sport 67 udp dport 68 accept\n")
+	b.WriteString("\t\ticmpv6 type { nd-router-advert, nd-neighbor-solicit, nd-neighbor-advert } accept\n")
+	b.WriteString("\t}\n")
+
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,52 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestKillSwitchRules(t *testing.T) {
+	tests := []struct {
+		server string
+		allow  string
+	}{
+		{"203.0.113.7:4242", "ip daddr 203.0.113.7 udp dport 4242 accept"},
+		{"[2001:db8::7]:443", "ip6 daddr 2001:db8::7 udp dport 443 accept"},
+	}
+	for _, tt := range tests {
+		server, err := net.ResolveUDPAddr("udp", tt.server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules := killSwitchRules(server, "slopn0")
+
+		for _, want := range []string{
+			"table inet " + killSwitchTable + "\ndelete table inet " + killSwitchTable + "\n",
+			"type filter hook output priority 0; policy drop;",
+			"type filter hook input priority 0; policy drop;",
+			`oifname "lo" accept`,
+			`oifname "slopn0" accept`,
+			`iifname "slopn0" accept`,
+			tt.allow,
+			"ct state established,related accept",
+		} {
+			if !strings.Contains(rules, want) {
+				t.Errorf("%s: rules lack %q:\n%s", tt.server, want, rules)
+			}
+		}
+
+		// The server is the only address allowed out, and DNS is not
+		if n := strings.Count(rules, "daddr"); n != 1 {
+			t.Errorf("%s: %d daddr rules, want 1", tt.server, n)
+		}
+		if strings.Contains(rules, "dport 53") {
+			t.Errorf("%s: DNS allowed:\n%s", tt.server, rules)
+		}
+		if strings.Count(rules, "{") != strings.Count(rules, "}") {
+			t.Errorf("%s: unbalanced braces:\n%s", tt.server, rules)
+		}
+	}
+}
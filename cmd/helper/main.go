@@ -9,7 +9,10 @@ import (
 	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	mrand "math/rand"
 	"net"
 	"os"
 	"path/filepath"
@@ -19,22 +22,35 @@ import (
 	"time"
 
 	"github.com/quic-go/quic-go"
+	"github.com/songgao/water"
+	"github.com/webdunesurfer/SloPN/pkg/certutil"
 	"github.com/webdunesurfer/SloPN/pkg/ipc"
 	"github.com/webdunesurfer/SloPN/pkg/iputil"
 	"github.com/webdunesurfer/SloPN/pkg/obfuscator"
 	"github.com/webdunesurfer/SloPN/pkg/protocol"
+	"github.com/webdunesurfer/SloPN/pkg/routes"
 	"github.com/webdunesurfer/SloPN/pkg/tunutil"
 )
 
 const (
 	TCPAddr       = "127.0.0.1:54321"
 	HelperVersion = "0.9.9"
+	TunName       = "slopn-tap0"
 )
 
 type Helper struct {
 	mu            sync.RWMutex
 	state         string
 	assignedVIP   string
+	assignedVIP6  string
+	subnetMask    string
+	vpnCIDR       string // Kept after disconnect so route cleanup can use it
+	pushedRoutes  []string
+	excludeRoutes []string
+	installed     []string // Pushed/excluded CIDRs actually added to the routing table
+	dnsServers    []string
+	dnsSearch     []string
+	dnsDomains    []string // Split-DNS domains; empty means VPN DNS for everything
 	serverVIP     string
 	serverAddr    string
 	sni           string
@@ -42,11 +58,17 @@ type Helper struct {
 	serverVersion string
 	fullTunnel    bool
 	obfuscate     bool
+	killSwitch    bool         // Kill switch rules are installed
+	remote        *net.UDPAddr // Last resolved server address; DNS is blocked under the kill switch
+	remoteFor     string       // ServerAddr that remote was resolved from
 	verbose       bool
 	bytesSent     uint64
 	bytesRecv     uint64
+	quota         *ipc.Quota // Last quota status pushed by the server
 	startTime     time.Time
 	ipcSecret     string
+	deviceID      string
+	resumeTicket  string // Lets a reconnect resume the server-side session
 	
 	conn         *quic.Conn
 	tunIfce      interface{}
@@ -83,16 +105,39 @@ func (h *Helper) loadIPCSecret() {
 	logHelper("IPC Secret loaded and security enabled.")
 }
 
+// loadDeviceID reads (or creates) the stable device ID used by the server
+// for VIP reservations and sticky leases
+func (h *Helper) loadDeviceID() {
+	path := filepath.Join(filepath.Dir(SecretPath), "device.id")
+	data, err := os.ReadFile(path)
+	if err == nil {
+		h.deviceID = strings.TrimSpace(string(data))
+		return
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return
+	}
+	id := hex.EncodeToString(b)
+	if err := os.WriteFile(path, []byte(id), 0644); err != nil {
+		logHelper(fmt.Sprintf("WARNING: Could not persist device ID: %v", err))
+	}
+	h.deviceID = id
+	logHelper(fmt.Sprintf("Generated new device ID: %s", id))
+}
+
 func (h *Helper) getStatus() ipc.Status {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 	return ipc.Status{
 		State:         h.state,
 		AssignedVIP:   h.assignedVIP,
+		AssignedVIP6:  h.assignedVIP6,
 		ServerVIP:     h.serverVIP,
 		ServerAddr:    h.serverAddr,
 		HelperVersion: HelperVersion,
 		ServerVersion: h.serverVersion,
+		KillSwitch:    h.killSwitch,
 	}
 }
 
@@ -107,6 +152,7 @@ func (h *Helper) getStats() ipc.Stats {
 		BytesSent: h.bytesSent,
 		BytesRecv: h.bytesRecv,
 		Uptime:    uptime,
+		Quota:     h.quota,
 	}
 }
 
@@ -136,7 +182,9 @@ func (h *Helper) run(ctx context.Context) error {
 	}
 
 	logHelper(fmt.Sprintf("Helper starting. Verbose: %v, Args: %v", h.verbose, os.Args))
+	h.recoverNetworkState()
 	h.loadIPCSecret()
+	h.loadDeviceID()
 
 	l, err := net.Listen("tcp", TCPAddr)
 	if err != nil {
@@ -165,6 +213,7 @@ func (h *Helper) run(ctx context.Context) error {
 	logHelper("Stopping helper...")
 	h.disconnect()
 	h.vpnWG.Wait()
+	h.disableKillSwitch()
 	return nil
 }
 
@@ -194,8 +243,8 @@ func (h *Helper) handleIPC(c net.Conn) {
 
 	switch req.Command {
 	case ipc.CmdConnect:
-		logHelper(fmt.Sprintf("[IPC] Connecting to %s (SNI: %s, Obfs: %v)", req.ServerAddr, req.SNI, req.Obfuscate))
-		err := h.connect(req.ServerAddr, req.Token, req.SNI, req.FullTunnel, req.Obfuscate)
+		logHelper(fmt.Sprintf("[IPC] Connecting to %s (SNI: %s, Obfs: %v, Kill switch: %v)", req.ServerAddr, req.SNI, req.Obfuscate, req.KillSwitch))
+		err := h.connect(req)
 		if err != nil {
 			resp = ipc.Response{Status: "error", Message: err.Error()}
 		} else {
@@ -204,6 +253,7 @@ func (h *Helper) handleIPC(c net.Conn) {
 	case ipc.CmdDisconnect:
 		logHelper("[IPC] Disconnecting")
 		h.disconnect()
+		h.disableKillSwitch()
 		resp = ipc.Response{Status: "success", Message: "Disconnected"}
 	case ipc.CmdGetStatus:
 		resp = ipc.Response{Status: "success", Data: h.getStatus()}
@@ -225,40 +275,130 @@ func (h *Helper) disconnect() {
 	}
 	h.state = "disconnected"
 	h.assignedVIP = ""
+	h.assignedVIP6 = ""
 	h.serverVIP = ""
 	h.serverVersion = ""
 	h.conn = nil
+	h.resumeTicket = ""
 	h.bytesSent = 0
 	h.bytesRecv = 0
+	h.quota = nil
 	h.startTime = time.Time{}
 }
 
-func (h *Helper) connect(addr, token, sni string, full, obfs bool) error {
+func (h *Helper) connect(req ipc.Request) error {
 	h.mu.Lock()
-	if h.state == "connected" || h.state == "connecting" {
+	if h.state == "connected" || h.state == "connecting" || h.state == "reconnecting" {
 		h.mu.Unlock()
 		return fmt.Errorf("already %s", h.state)
 	}
-	addr = strings.TrimSpace(addr)
-	sni = strings.TrimSpace(sni)
+	req.ServerAddr = strings.TrimSpace(req.ServerAddr)
+	req.SNI = strings.TrimSpace(req.SNI)
 	h.state = "connecting"
-	h.serverAddr = addr
-	h.sni = sni
-	h.fullTunnel = full
-	h.obfuscate = obfs
+	h.serverAddr = req.ServerAddr
+	h.sni = req.SNI
+	h.fullTunnel = req.FullTunnel
+	h.obfuscate = req.Obfuscate
 	h.mu.Unlock()
 
+	// The kill switch goes up before dialing so nothing leaks while connecting.
+	// Its rules allow only this address, so vpnLoop dials it instead of
+	// resolving again.
+	var remote *net.UDPAddr
+	if req.KillSwitch {
+		var err error
+		remote, err = h.resolveServer(req.ServerAddr)
+		if err == nil {
+			err = h.enableKillSwitch(remote, TunName)
+		}
+		if err != nil {
+			h.mu.Lock()
+			h.state = "disconnected"
+			h.mu.Unlock()
+			return err
+		}
+	} else {
+		h.disableKillSwitch()
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	h.mu.Lock()
 	h.cancelVPN = cancel
 	h.mu.Unlock()
 
-	go h.vpnLoop(ctx, addr, token, sni, full, obfs)
+	go h.vpnLoop(ctx, req, remote)
 	return nil
 }
 
-func getLocalIP() string {
-	targets := []string{"8.8.8.8:80", "1.1.1.1:80", "208.67.222.222:80"}
+// resolveServer resolves the server address. While the kill switch blocks DNS
+// it falls back to the address resolved for the same server earlier.
+func (h *Helper) resolveServer(addr string) (*net.UDPAddr, error) {
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		if h.killSwitch && h.remote != nil && h.remoteFor == addr {
+			return h.remote, nil
+		}
+		return nil, err
+	}
+	h.remote, h.remoteFor = remote, addr
+	return remote, nil
+}
+
+// routesToInstall returns the pushed and excluded CIDRs for this session
+func (h *Helper) routesToInstall() (include, exclude []string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.pushedRoutes, h.excludeRoutes
+}
+
+// takeInstalled returns and forgets the CIDRs installed by addPushedRoutes
+func (h *Helper) takeInstalled() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := h.installed
+	h.installed = nil
+	return list
+}
+
+func (h *Helper) recordInstalled(cidr string) {
+	h.mu.Lock()
+	h.installed = append(h.installed, cidr)
+	h.mu.Unlock()
+}
+
+// dnsConfig returns the DNS settings for this session. Servers that push no
+// DNS servers get the legacy behaviour of resolving via the server VIP.
+func (h *Helper) dnsConfig() (servers, search, domains []string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	servers = h.dnsServers
+	if len(servers) == 0 && h.serverVIP != "" {
+		servers = []string{h.serverVIP}
+	} else if len(servers) == 0 {
+		servers = []string{"10.100.0.1"}
+	}
+	return servers, h.dnsSearch, h.dnsDomains
+}
+
+// dnsPushed reports whether the server sent DNS servers for this session
+func (h *Helper) dnsPushed() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.dnsServers) > 0
+}
+
+func isIPv6CIDR(cidr string) bool {
+	ip, _, err := net.ParseCIDR(cidr)
+	return err == nil && ip.To4() == nil
+}
+
+// getLocalIP returns the source IP the OS uses towards server. The public
+// resolvers are only a fallback: during a full tunnel reconnect they are
+// still routed via the TUN interface.
+func getLocalIP(server string) string {
+	targets := []string{server, "8.8.8.8:80", "1.1.1.1:80", "208.67.222.222:80"}
 	for _, target := range targets {
 		conn, err := net.DialTimeout("udp", target, 2*time.Second)
 		if err == nil {
@@ -270,64 +410,165 @@ func getLocalIP() string {
 	return "0.0.0.0"
 }
 
-func (h *Helper) vpnLoop(ctx context.Context, addr, token, sni string, full, obfs bool) {
+const (
+	reconnectMin    = 1 * time.Second
+	reconnectMax    = 60 * time.Second
+	reconnectStable = 30 * time.Second // A session that lasted this long resets the backoff
+)
+
+// permanentError ends vpnLoop instead of triggering a reconnect
+type permanentError struct{ error }
+
+// loginDenied reports whether the server rejected the credentials or account.
+// Servers before LoginResponse.Reason are recognised by their messages.
+func loginDenied(resp protocol.LoginResponse) bool {
+	if resp.Reason != "" {
+		return resp.Reason == protocol.LoginDenied
+	}
+	switch resp.Message {
+	case "Invalid authentication token", "Account disabled", "Account expired":
+		return true
+	}
+	return false
+}
+
+// tunnel is the local side of a VPN session. It survives reconnects so the
+// interface, routes and DNS stay in place while QUIC is re-established.
+type tunnel struct {
+	ifce       *water.Interface
+	cfg        tunutil.Config
+	errs       chan error // TUN read failures for ifce
+	full       bool
+	serverHost string
+}
+
+// vpnLoop runs the tunnel until ctx is cancelled. remote, if set, is the
+// server address to dial; otherwise it is resolved once here. Reconnects
+// always dial the same address.
+func (h *Helper) vpnLoop(ctx context.Context, req ipc.Request, remote *net.UDPAddr) {
 	h.vpnWG.Add(1)
 	defer h.vpnWG.Done()
 	
-	addr = strings.TrimSpace(addr)
-	sni = strings.TrimSpace(sni)
+	addr, sni := req.ServerAddr, req.SNI
 	
-	logHelper(fmt.Sprintf("[VPN] Starting vpnLoop for %s (SNI: %s, Obfs: %v)", addr, sni, obfs))
+	logHelper(fmt.Sprintf("[VPN] Starting vpnLoop for %s (SNI: %s, Obfs: %v)", addr, sni, req.Obfuscate))
 	
 	serverHost, _, _ := net.SplitHostPort(addr)
-	var ifceName string
+	t := &tunnel{full: req.FullTunnel, serverHost: serverHost}
 
 	defer func() {
 		if r := recover(); r != nil {
 			logHelper(fmt.Sprintf("[VPN] Loop Panic: %v", r))
 		}
-
-		if h.conn != nil {
-			h.conn.CloseWithError(0, "logout")
-		}
-		
-		h.cleanupRouting(full, serverHost, ifceName)
+		h.teardownTunnel(t)
 		h.disconnect()
 		logHelper("[VPN] Loop exit complete.")
 	}()
 
-	h.setupRouting(full, serverHost, "", "") // serverVIP not known yet
-
 	// Reality-style SNI Spoofing
 	if sni == "" {
 		sni = serverHost
 	}
-	tlsConf := &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         []string{"h3"},
-		ServerName:         sni,
-	}
-	
-	localIP := getLocalIP()
-	logHelper(fmt.Sprintf("[VPN] Using local source IP: %s", localIP))
-	udpConn, err := net.ListenPacket("udp4", localIP+":0")
+	tlsConf, err := certutil.ClientConfig(sni, req.ServerFingerprint, []byte(req.ServerCA))
 	if err != nil {
-		logHelper(fmt.Sprintf("[VPN] UDP Listen error: %v", err))
+		logHelper(fmt.Sprintf("[VPN] TLS config error: %v", err))
 		return
 	}
-	defer udpConn.Close()
+	if req.ServerFingerprint == "" && req.ServerCA == "" {
+		logHelper("[VPN] WARNING: server identity is not verified; configure a fingerprint or CA to prevent MITM")
+	}
+	if req.ClientCert != "" {
+		if err := certutil.AddClientCert(tlsConf, []byte(req.ClientCert), []byte(req.ClientKey)); err != nil {
+			logHelper(fmt.Sprintf("[VPN] TLS config error: %v", err))
+			return
+		}
+	}
+	
+	remoteAddr := remote
+	if remoteAddr == nil {
+		if remoteAddr, err = h.resolveServer(addr); err != nil {
+			logHelper(fmt.Sprintf("[VPN] Resolve error: %v", err))
+			return
+		}
+	}
+	// Route by address: hostname lookups may be blocked by the kill switch
+	t.serverHost = remoteAddr.IP.String()
+	h.setupRouting(t.full, t.serverHost, "", "") // serverVIP not known yet
 
-	var finalConn net.PacketConn = udpConn
-	if obfs {
+	// Stats ticker
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.mu.RLock()
+				sent := h.bytesSent
+				recv := h.bytesRecv
+				h.mu.RUnlock()
+				h.logVerbose(fmt.Sprintf("Heartbeat/Stats: Sent=%d bytes, Recv=%d bytes", sent, recv))
+			}
+		}
+	}()
+
+	backoff := reconnectMin
+	for {
+		started := time.Now()
+		err := h.runSession(ctx, req, remoteAddr, tlsConf, t)
+		if ctx.Err() != nil {
+			logHelper("[VPN] Context cancelled")
+			return
+		}
+		var perm permanentError
+		if errors.As(err, &perm) || t.ifce == nil {
+			// Failures before the first login are reported, not retried
+			logHelper(fmt.Sprintf("[VPN] %v", err))
+			return
+		}
+
+		if time.Since(started) > reconnectStable {
+			backoff = reconnectMin
+		}
+		delay := backoff/2 + time.Duration(mrand.Int63n(int64(backoff/2)+1))
+		h.mu.Lock()
+		if ctx.Err() == nil {
+			h.state = "reconnecting"
+		}
+		h.mu.Unlock()
+		logHelper(fmt.Sprintf("[VPN] Session ended: %v. Reconnecting in %v", err, delay.Round(time.Millisecond)))
+
+		select {
+		case <-ctx.Done():
+			logHelper("[VPN] Context cancelled")
+			return
+		case <-time.After(delay):
+		}
+		backoff = min(backoff*2, reconnectMax)
+	}
+}
+
+// runSession dials the server, logs in and relays packets until the QUIC
+// connection fails. The TUN interface is created on the first login and
+// reused afterwards unless the server hands out different parameters.
+func (h *Helper) runSession(ctx context.Context, req ipc.Request, remoteAddr *net.UDPAddr, tlsConf *tls.Config, t *tunnel) error {
+	// IPv6 transport: let the OS pick the source; IPv4 keeps the explicit source IP
+	localIP := getLocalIP(remoteAddr.String())
+	network, localAddr := "udp6", "[::]:0"
+	if remoteAddr.IP.To4() != nil {
+		logHelper(fmt.Sprintf("[VPN] Using local source IP: %s", localIP))
+		network, localAddr = "udp4", localIP+":0"
+	}
+	if req.Obfuscate {
 		logHelper("[VPN] Protocol Obfuscation (Reality) enabled.")
-		finalConn = obfuscator.NewRealityConn(udpConn, token, "") // Client doesn't need mimicTarget
 	}
-	
-	remoteAddr, err := net.ResolveUDPAddr("udp4", addr)
+	udpConn, tr, err := listenPath(network, localAddr, req)
 	if err != nil {
-		logHelper(fmt.Sprintf("[VPN] Resolve error: %v", err))
-		return
+		return fmt.Errorf("UDP listen error: %v", err)
 	}
+	defer udpConn.Close()
+	defer tr.Close()
 
 	logHelper("[VPN] Dialing QUIC...")
 	h.logVerbose("QUIC Config: KeepAlive=10s, Datagrams=true")
@@ -335,98 +576,132 @@ func (h *Helper) vpnLoop(ctx context.Context, addr, token, sni string, full, obf
 	dialCtx, dialCancel := context.WithTimeout(ctx, 15*time.Second)
 	defer dialCancel()
 
-	conn, err := quic.Dial(dialCtx, finalConn, remoteAddr, tlsConf, &quic.Config{
+	conn, err := tr.Dial(dialCtx, remoteAddr, tlsConf, &quic.Config{
 		EnableDatagrams: true,
 		KeepAlivePeriod: 10 * time.Second,
 	})
+	// Neither side will accept the other's certificate on a retry
+	var te *quic.TransportError
+	if errors.Is(err, certutil.ErrUntrustedServer) || (errors.As(err, &te) && te.Remote && te.ErrorCode.IsCryptoError()) {
+		return permanentError{fmt.Errorf("QUIC dial error: %v", err)}
+	}
 	if err != nil {
-		logHelper(fmt.Sprintf("[VPN] QUIC Dial error: %v", err))
-		return
+		return fmt.Errorf("QUIC dial error: %v", err)
 	}
-	h.mu.Lock()
-	h.conn = conn
-	h.mu.Unlock()
+	defer conn.CloseWithError(0, "logout")
 
 	stream, err := conn.OpenStreamSync(dialCtx)
 	if err != nil {
-		logHelper(fmt.Sprintf("[VPN] Stream error: %v", err))
-		return
+		return fmt.Errorf("stream error: %v", err)
 	}
+	h.mu.RLock()
+	previousVIP, ticket := h.assignedVIP, h.resumeTicket
+	h.mu.RUnlock()
 	json.NewEncoder(stream).Encode(protocol.LoginRequest{
-		Type: protocol.MessageTypeLoginRequest, Token: token,
+		Type: protocol.MessageTypeLoginRequest, User: req.User, Token: req.Token,
+		DeviceID: h.deviceID, PreviousVIP: previousVIP, ResumeTicket: ticket,
 		ClientVersion: HelperVersion, OS: runtime.GOOS,
 	})
 
 	var loginResp protocol.LoginResponse
 	if err := json.NewDecoder(stream).Decode(&loginResp); err != nil {
-		logHelper(fmt.Sprintf("[VPN] Login decode error: %v", err))
-		return
+		return fmt.Errorf("login decode error: %v", err)
 	}
 	stream.Close()
 
 	if loginResp.Status != "success" {
-		logHelper(fmt.Sprintf("[VPN] Login failed: %s", loginResp.Message))
-		return
+		err := fmt.Errorf("login failed: %s", loginResp.Message)
+		if loginDenied(loginResp) {
+			return permanentError{err}
+		}
+		return err // e.g. no free VIP or quota used up: retried with backoff
+	}
+
+	mask := loginResp.SubnetMask
+	if mask == "" {
+		mask = tunutil.DefaultMask // Older servers only support /24
+	}
+	// Server-pushed routes override the client's own tunnel mode
+	full, pushed := req.FullTunnel, []string(nil)
+	if len(loginResp.Routes) > 0 {
+		full, pushed = routes.Split(loginResp.Routes)
+		logHelper(fmt.Sprintf("[VPN] Server pushed %d routes (Full: %v)", len(loginResp.Routes), full))
 	}
 
 	h.mu.Lock()
 	h.state = "connected"
+	h.conn = conn
 	h.assignedVIP = loginResp.AssignedVIP
+	h.assignedVIP6 = loginResp.AssignedVIP6
+	h.subnetMask = mask
+	h.vpnCIDR = tunutil.Network(loginResp.AssignedVIP, mask)
+	h.fullTunnel = full
+	h.pushedRoutes = pushed
+	h.excludeRoutes = loginResp.ExcludeRoutes
+	h.dnsServers = loginResp.DNSServers
+	h.dnsSearch = loginResp.DNSSearch
+	h.dnsDomains = loginResp.DNSDomains
 	h.serverVIP = loginResp.ServerVIP
 	h.serverVersion = loginResp.ServerVersion
-	h.startTime = time.Now()
+	h.resumeTicket = loginResp.ResumeTicket
+	if h.startTime.IsZero() {
+		h.startTime = time.Now() // Uptime spans reconnects
+	}
 	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		if h.conn == conn {
+			h.conn = nil
+		}
+		h.mu.Unlock()
+	}()
 
 	logHelper(fmt.Sprintf("Connected! VIP: %s (Server v%s)", loginResp.AssignedVIP, loginResp.ServerVersion))
 
 	tunCfg := tunutil.Config{
-		Name: "slopn-tap0", // Use the name we established
+		Name: TunName,
 		Addr: loginResp.AssignedVIP, Peer: loginResp.ServerVIP,
-		Mask: "255.255.255.0", MTU: 900,
+		Mask: mask, MTU: 900,
+		Addr6: loginResp.AssignedVIP6, Prefix6: loginResp.Prefix6Len,
 	}
-	ifce, err := tunutil.CreateInterface(tunCfg)
-	if err != nil {
-		logHelper(fmt.Sprintf("[VPN] TUN error: %v", err))
-		return
+	if t.ifce != nil && (t.cfg != tunCfg || t.full != full) {
+		logHelper("[VPN] Session parameters changed, rebuilding interface")
+		h.teardownTunnel(t)
 	}
-	logHelper(fmt.Sprintf("[VPN] Interface %s created (IP: %s, MTU: %d)", tunCfg.Name, tunCfg.Addr, tunCfg.MTU))
-	defer ifce.Close()
-	ifceName = tunCfg.Name
+	t.full = full
 
-	// Update routing with known serverVIP and dynamic IF Name
-	h.tunIfce = ifce // Store for potential future use
-	h.setupRouting(full, serverHost, loginResp.ServerVIP, ifceName)
+	if t.ifce == nil {
+		ifce, err := tunutil.CreateInterface(tunCfg)
+		if err != nil {
+			return permanentError{fmt.Errorf("TUN error: %v", err)}
+		}
+		logHelper(fmt.Sprintf("[VPN] Interface %s created (IP: %s, MTU: %d)", tunCfg.Name, tunCfg.Addr, tunCfg.MTU))
+		t.ifce, t.cfg, t.errs = ifce, tunCfg, make(chan error, 1)
+		h.tunIfce = ifce // Store for potential future use
 
-	isLinux := runtime.GOOS == "linux"
-	errChan := make(chan error, 2)
+		// Update routing with known serverVIP and dynamic IF Name
+		h.setupRouting(full, t.serverHost, loginResp.ServerVIP, tunCfg.Name)
+		h.addPushedRoutes(loginResp.ServerVIP, tunCfg.Name)
 
-	// Log max datagram size
-	h.logVerbose("MTU lowered to 900 for stability")
+		// Log max datagram size
+		h.logVerbose("MTU lowered to 900 for stability")
+		go h.readTUN(ifce, t.errs)
+	} else {
+		logHelper(fmt.Sprintf("[VPN] Reusing interface %s", tunCfg.Name))
+	}
 
-	// Stats ticker
-	go func() {
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-ticker.C:
-				h.mu.RLock()
-				sent := h.bytesSent
-				recv := h.bytesRecv
-				h.mu.RUnlock()
-				h.logVerbose(fmt.Sprintf("Heartbeat/Stats: Sent=%d bytes, Recv=%d bytes", sent, recv))
-			}
-		}
-	}()
+	go h.watchPath(ctx, conn, req, remoteAddr, network, localIP)
+	go h.acceptControl(ctx, conn)
 
+	ifce := t.ifce
+	isLinux := runtime.GOOS == "linux"
+	recvErr := make(chan error, 1)
 	go func() {
 		first := true
 		for {
 			data, err := conn.ReceiveDatagram(ctx)
 			if err != nil {
-				errChan <- err
+				recvErr <- err
 				return
 			}
 			if first {
@@ -440,35 +715,209 @@ func (h *Helper) vpnLoop(ctx context.Context, addr, token, sni string, full, obf
 		}
 	}()
 
-	go func() {
-		packet := make([]byte, 2000)
-		first := true
-		for {
-			n, err := ifce.Read(packet)
-			if err != nil {
-				errChan <- err
-				return
-			}
-			payload := iputil.StripHeader(packet[:n])
-			if first {
-				h.logVerbose(fmt.Sprintf("First packet from TUN: %s", iputil.FormatPacketSummary(payload)))
-				first = false
-			}
-			h.mu.Lock()
-			h.bytesSent += uint64(len(payload))
-			h.mu.Unlock()
-			if err := conn.SendDatagram(payload); err != nil {
-				h.logVerbose(fmt.Sprintf("SendDatagram error: %v (Size: %d)", err, len(payload)))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-recvErr:
+		return fmt.Errorf("data channel error: %v", err)
+	case err := <-t.errs:
+		return permanentError{fmt.Errorf("TUN read error: %v", err)}
+	}
+}
+
+// acceptControl reads the control messages the server pushes after login,
+// one per unidirectional stream
+func (h *Helper) acceptControl(ctx context.Context, conn *quic.Conn) {
+	var quotaSeq uint64
+	for {
+		stream, err := conn.AcceptUniStream(ctx)
+		if err != nil {
+			return
+		}
+		var raw json.RawMessage
+		if err := json.NewDecoder(io.LimitReader(stream, 64*1024)).Decode(&raw); err != nil {
+			continue
+		}
+		var msg protocol.ControlMessage
+		json.Unmarshal(raw, &msg)
+		switch msg.Type {
+		case protocol.MessageTypeQuota:
+			var q protocol.Quota
+			if err := json.Unmarshal(raw, &q); err != nil || q.Seq <= quotaSeq {
+				continue // Malformed, or overtaken by a newer update
 			}
+			quotaSeq = q.Seq
+			h.setQuota(q)
+		default:
+			h.logVerbose(fmt.Sprintf("Ignoring control message %q", msg.Type))
+		}
+	}
+}
+
+func (h *Helper) setQuota(q protocol.Quota) {
+	remaining := uint64(0)
+	if q.UsedBytes < q.LimitBytes {
+		remaining = q.LimitBytes - q.UsedBytes
+	}
+	h.mu.Lock()
+	wasExceeded := h.quota != nil && h.quota.Exceeded
+	h.quota = &ipc.Quota{
+		Period:         q.Period,
+		LimitBytes:     q.LimitBytes,
+		UsedBytes:      q.UsedBytes,
+		RemainingBytes: remaining,
+		Resets:         q.Resets,
+		Exceeded:       q.Exceeded,
+		Action:         q.Action,
+	}
+	h.mu.Unlock()
+
+	if q.Exceeded && !wasExceeded {
+		logHelper(fmt.Sprintf("[VPN] Data quota for this %s used up (%d bytes, resets %s, action: %s)",
+			q.Period, q.LimitBytes, time.Unix(q.Resets, 0).Format(time.RFC1123), q.Action))
+	}
+}
+
+// listenPath opens a UDP socket for one network path and a QUIC transport on
+// top of it. Every path gets its own RealityConn, so the server sees fresh FPO
+// packets from the new address and whitelists it.
+func listenPath(network, localAddr string, req ipc.Request) (net.PacketConn, *quic.Transport, error) {
+	udpConn, err := net.ListenPacket(network, localAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	var finalConn net.PacketConn = udpConn
+	if req.Obfuscate {
+		secret := req.ObfsSecret
+		if secret == "" {
+			secret = req.Token
+		}
+		finalConn = obfuscator.NewRealityConn(udpConn, secret, "") // Client doesn't need mimicTarget
+	}
+	// Connection migration needs non-zero connection IDs
+	return udpConn, &quic.Transport{Conn: finalConn, ConnectionIDLength: 8}, nil
+}
+
+// watchPath follows changes of the local address used to reach the server,
+// e.g. a laptop moving from Wi-Fi to LTE, and migrates the QUIC connection to
+// a new path. If migration fails the session dies and the reconnect resumes it
+// with the resumption ticket.
+func (h *Helper) watchPath(ctx context.Context, conn *quic.Conn, req ipc.Request, remoteAddr *net.UDPAddr, network, localIP string) {
+	var closers []func()
+	defer func() {
+		for _, c := range closers {
+			c()
 		}
 	}()
 
-	select {
-	case <-ctx.Done():
-		logHelper("[VPN] Context cancelled")
-		return
-	case err := <-errChan:
-		logHelper(fmt.Sprintf("[VPN] Data channel error: %v", err))
-		return
+	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-conn.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		h.refreshServerRoute(remoteAddr.IP)
+		ip := getLocalIP(remoteAddr.String())
+		if ip == localIP || ip == "0.0.0.0" || h.isVPNAddr(ip) {
+			continue
+		}
+
+		logHelper(fmt.Sprintf("[VPN] Local address changed (%s -> %s), migrating connection...", localIP, ip))
+		udpConn, tr, err := listenPath(network, net.JoinHostPort(ip, "0"), req)
+		if err != nil {
+			logHelper(fmt.Sprintf("[VPN] Migration failed: %v", err))
+			continue
+		}
+		closePath := func() {
+			tr.Close()
+			udpConn.Close()
+		}
+		if err := h.migrate(ctx, conn, tr); err != nil {
+			logHelper(fmt.Sprintf("[VPN] Migration failed: %v", err))
+			closePath()
+			continue
+		}
+		closers = append(closers, closePath)
+		localIP = ip
+		logHelper(fmt.Sprintf("[VPN] Migrated to %s", ip))
+	}
+}
+
+// migrate probes a new path and switches the connection over to it
+func (h *Helper) migrate(ctx context.Context, conn *quic.Conn, tr *quic.Transport) error {
+	path, err := conn.AddPath(tr)
+	if err != nil {
+		return err
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := path.Probe(probeCtx); err != nil {
+		path.Close()
+		return err
+	}
+	if err := path.Switch(); err != nil {
+		path.Close()
+		return err
+	}
+	return nil
+}
+
+// isVPNAddr reports whether ip belongs to the tunnel, i.e. the route to the
+// server currently points into the TUN interface
+func (h *Helper) isVPNAddr(ip string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if ip == h.assignedVIP || ip == h.assignedVIP6 {
+		return true
+	}
+	_, vpnNet, err := net.ParseCIDR(h.vpnCIDR)
+	return err == nil && vpnNet.Contains(net.ParseIP(ip))
+}
+
+// readTUN forwards packets from the TUN interface to the current QUIC
+// connection. It runs for the lifetime of ifce; packets read while
+// reconnecting are dropped.
+func (h *Helper) readTUN(ifce *water.Interface, errs chan<- error) {
+	packet := make([]byte, 2000)
+	first := true
+	for {
+		n, err := ifce.Read(packet)
+		if err != nil {
+			errs <- err
+			return
+		}
+		payload := iputil.StripHeader(packet[:n])
+		if first {
+			h.logVerbose(fmt.Sprintf("First packet from TUN: %s", iputil.FormatPacketSummary(payload)))
+			first = false
+		}
+		h.mu.Lock()
+		conn := h.conn
+		if conn != nil {
+			h.bytesSent += uint64(len(payload))
+		}
+		h.mu.Unlock()
+		if conn == nil {
+			continue
+		}
+		if err := conn.SendDatagram(payload); err != nil {
+			h.logVerbose(fmt.Sprintf("SendDatagram error: %v (Size: %d)", err, len(payload)))
+		}
+	}
+}
+
+// teardownTunnel closes the TUN interface and removes its routes and DNS
+func (h *Helper) teardownTunnel(t *tunnel) {
+	if t.ifce != nil {
+		t.ifce.Close()
+		t.ifce = nil
 	}
+	h.removePushedRoutes(t.cfg.Name)
+	h.cleanupRouting(t.full, t.serverHost, t.cfg.Name)
+	t.cfg = tunutil.Config{}
 }
@@ -3,7 +3,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"os/exec"
 	"strings"
 )
@@ -36,9 +38,11 @@ func (h *Helper) setupDNS() {
 	interfaces := h.getAllActiveInterfaces()
 	logHelper(fmt.Sprintf("[DNS] Protecting %d interfaces...", len(interfaces)))
 
+	servers, _, _ := h.dnsConfig()
 	for _, iface := range interfaces {
 		logHelper(fmt.Sprintf("[DNS] Forcing SloPN Internal DNS on %s...", iface))
-		exec.Command("networksetup", "-setdnsservers", iface, "10.100.0.1").Run()
+		args := append([]string{"-setdnsservers", iface}, servers...)
+		exec.Command("networksetup", args...).Run()
 	}
 	
 	exec.Command("dscacheutil", "-flushcache").Run()
@@ -54,6 +58,20 @@ func (h *Helper) restoreDNS() {
 	exec.Command("dscacheutil", "-flushcache").Run()
 }
 
+// recoverNetworkState undoes changes left behind by a crashed helper.
+// macOS DNS is reset by restoreDNS on the next disconnect, so nothing to do here.
+func (h *Helper) recoverNetworkState() {}
+
+// The kill switch is only implemented on Linux (nftables)
+func (h *Helper) enableKillSwitch(server *net.UDPAddr, ifceName string) error {
+	return errors.New("kill switch is not supported on macOS")
+}
+
+func (h *Helper) disableKillSwitch() {}
+
+// refreshServerRoute is Linux-only; the server host route is left as is here
+func (h *Helper) refreshServerRoute(server net.IP) {}
+
 func (h *Helper) getLogs() string {
 	out, err := exec.Command("tail", "-n", "100", LogPath).Output()
 	if err != nil {
@@ -102,3 +120,58 @@ func (h *Helper) cleanupRouting(full bool, serverHost, ifceName string) {
 		logHelper(fmt.Sprintf("[VPN] Removed host route for: %s", serverHost))
 	}
 }
+
+func defaultGateway(v6 bool) string {
+	family := "-inet"
+	if v6 {
+		family = "-inet6"
+	}
+	out, _ := exec.Command("sh", "-c", "route -n get "+family+" default | awk '/gateway: / {print $2}'").Output()
+	return strings.TrimSpace(string(out))
+}
+
+// addPushedRoutes installs server-pushed routes via the tunnel and excluded
+// routes via the original gateway
+func (h *Helper) addPushedRoutes(serverVIP, ifceName string) {
+	include, exclude := h.routesToInstall()
+	for _, cidr := range include {
+		args := []string{"add", "-net", cidr, serverVIP}
+		if isIPv6CIDR(cidr) {
+			args = []string{"add", "-inet6", "-net", cidr, "-interface", ifceName}
+		}
+		if err := exec.Command("route", args...).Run(); err != nil {
+			logHelper(fmt.Sprintf("[VPN] Error adding pushed route %s: %v", cidr, err))
+			continue
+		}
+		h.recordInstalled(cidr)
+		logHelper(fmt.Sprintf("[VPN] Added pushed route %s", cidr))
+	}
+	for _, cidr := range exclude {
+		v6 := isIPv6CIDR(cidr)
+		gw := defaultGateway(v6)
+		if gw == "" {
+			logHelper(fmt.Sprintf("[VPN] No gateway for excluded route %s", cidr))
+			continue
+		}
+		args := []string{"add", "-net", cidr, gw}
+		if v6 {
+			args = []string{"add", "-inet6", "-net", cidr, gw}
+		}
+		if err := exec.Command("route", args...).Run(); err != nil {
+			logHelper(fmt.Sprintf("[VPN] Error adding excluded route %s: %v", cidr, err))
+			continue
+		}
+		h.recordInstalled(cidr)
+		logHelper(fmt.Sprintf("[VPN] Excluded %s via %s", cidr, gw))
+	}
+}
+
+func (h *Helper) removePushedRoutes(ifceName string) {
+	for _, cidr := range h.takeInstalled() {
+		if isIPv6CIDR(cidr) {
+			exec.Command("route", "delete", "-inet6", "-net", cidr).Run()
+		} else {
+			exec.Command("route", "delete", "-net", cidr).Run()
+		}
+	}
+}
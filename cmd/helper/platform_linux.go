@@ -12,11 +12,12 @@ const (
 	SecretPath = "/etc/slopn/ipc.secret"
 )
 
-func (h *Helper) setupDNS() {
-	// Typically managed via resolvconf or systemd-resolved on Linux
-}
-
-func (h *Helper) restoreDNS() {
+// recoverNetworkState undoes changes left behind by a crashed helper. An
+// active kill switch is deliberately kept.
+func (h *Helper) recoverNetworkState() {
+	flushRoutes()
+	h.restoreDNS()
+	h.recoverKillSwitch()
 }
 
 func (h *Helper) getLogs() string {
@@ -28,7 +29,50 @@ func (h *Helper) getLogs() string {
 }
 
 func (h *Helper) setupRouting(full bool, serverHost, serverVIP, ifceName string) {
+	if serverVIP == "" {
+		return
+	}
+	h.setupLinuxRoutes(full, serverHost, ifceName)
+	// A split tunnel only takes over DNS when the server asks for it: the
+	// server VIP need not run a resolver reachable without -nat
+	if !full && !h.dnsPushed() {
+		logHelper("[DNS] Split tunnel and no DNS pushed by the server, keeping system DNS")
+		return
+	}
+	h.setupDNS(ifceName, full)
 }
 
 func (h *Helper) cleanupRouting(full bool, serverHost, ifceName string) {
-}
\ No newline at end of file
+	logHelper("[VPN] Cleaning up routing...")
+	flushRoutes()
+	h.restoreDNS()
+}
+
+// addPushedRoutes installs server-pushed routes via the tunnel and excluded
+// routes via the original gateway
+func (h *Helper) addPushedRoutes(serverVIP, ifceName string) {
+	include, exclude := h.routesToInstall()
+	for _, cidr := range include {
+		if err := addRoute(routeEntry{Dst: cidr, Link: ifceName}); err != nil {
+			logHelper(fmt.Sprintf("[VPN] Error adding pushed route %s: %v", cidr, err))
+			continue
+		}
+		logHelper(fmt.Sprintf("[VPN] Added pushed route %s", cidr))
+	}
+	for _, cidr := range exclude {
+		gw, ok := physicalGateway(isIPv6CIDR(cidr))
+		if !ok {
+			logHelper(fmt.Sprintf("[VPN] No gateway for excluded route %s", cidr))
+			continue
+		}
+		if err := addRoute(routeEntry{Dst: cidr, Gw: gw.Gw, Link: gw.Link}); err != nil {
+			logHelper(fmt.Sprintf("[VPN] Error adding excluded route %s: %v", cidr, err))
+			continue
+		}
+		logHelper(fmt.Sprintf("[VPN] Excluded %s via %s (%s)", cidr, gw.Gw, gw.Link))
+	}
+}
+
+// removePushedRoutes is a no-op on Linux: pushed routes are recorded with all
+// other helper routes and removed by cleanupRouting
+func (h *Helper) removePushedRoutes(ifceName string) {}
@@ -5,10 +5,14 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"strings"
+
+	"github.com/webdunesurfer/SloPN/pkg/tunutil"
 )
 
 const (
@@ -42,13 +46,16 @@ func (h *Helper) getAllActiveInterfaces() []string {
 
 func (h *Helper) setupDNS(ifceName string) {
 	logHelper(fmt.Sprintf("[DNS] Configuring DNS for VPN interface %s...", ifceName))
-	
+
+	servers, _, _ := h.dnsConfig()
+	dns := servers[0]
+
 	// 1. Force DNS on the VPN interface itself
-	if err := exec.Command("netsh", "interface", "ip", "set", "dns", fmt.Sprintf("name=\"%s\"", ifceName), "static", "10.100.0.1", "validate=no").Run(); err != nil {
+	if err := exec.Command("netsh", "interface", "ip", "set", "dns", fmt.Sprintf("name=\"%s\"", ifceName), "static", dns, "validate=no").Run(); err != nil {
 		logHelper(fmt.Sprintf("[DNS] Error setting VPN DNS: %v", err))
 	}
 
-	// 2. Aggressive Leak Protection: Force DNS on ALL other active interfaces to 10.100.0.1
+	// 2. Aggressive Leak Protection: Force DNS on ALL other active interfaces to the VPN DNS
 	// This prevents Windows from using the ISP DNS via parallel queries.
 	active := h.getAllActiveInterfaces()
 	for _, name := range active {
@@ -56,27 +63,41 @@ func (h *Helper) setupDNS(ifceName string) {
 			continue
 		}
 		logHelper(fmt.Sprintf("[DNS] Forcing protection on %s...", name))
-		if err := exec.Command("netsh", "interface", "ip", "set", "dns", fmt.Sprintf("name=\"%s\"", name), "static", "10.100.0.1", "validate=no").Run(); err != nil {
+		if err := exec.Command("netsh", "interface", "ip", "set", "dns", fmt.Sprintf("name=\"%s\"", name), "static", dns, "validate=no").Run(); err != nil {
 			logHelper(fmt.Sprintf("[DNS] Error forcing protection on %s: %v", name, err))
 		}
 	}
-	
+
 	exec.Command("ipconfig", "/flushdns").Run()
 	logHelper("[DNS] System-wide DNS protection active.")
 }
 
 func (h *Helper) restoreDNS(ifceName string) {
 	logHelper("[DNS] Restoring system-wide DNS settings...")
-	
+
 	active := h.getAllActiveInterfaces()
 	for _, name := range active {
 		logHelper(fmt.Sprintf("[DNS] Restoring DHCP for %s...", name))
 		exec.Command("netsh", "interface", "ip", "set", "dns", fmt.Sprintf("name=\"%s\"", name), "source=dhcp").Run()
 	}
-	
+
 	exec.Command("ipconfig", "/flushdns").Run()
 }
 
+// recoverNetworkState undoes changes left behind by a crashed helper.
+// Windows DNS is reset to DHCP by restoreDNS on the next disconnect.
+func (h *Helper) recoverNetworkState() {}
+
+// The kill switch is only implemented on Linux (nftables)
+func (h *Helper) enableKillSwitch(server *net.UDPAddr, ifceName string) error {
+	return errors.New("kill switch is not supported on Windows")
+}
+
+func (h *Helper) disableKillSwitch() {}
+
+// refreshServerRoute is Linux-only; the server host route is left as is here
+func (h *Helper) refreshServerRoute(server net.IP) {}
+
 // getLogs efficiently reads the last N bytes of the log file using native Go
 func (h *Helper) getLogs() string {
 	f, err := os.Open(LogPath)
@@ -143,13 +164,14 @@ func (h *Helper) setupRouting(full bool, serverHost, serverVIP, ifceName string)
 	}
 
 	if !full {
-		logHelper(fmt.Sprintf("[VPN] Adding split-tunnel route for 10.100.0.0/24 via %s (IF %s)", serverVIP, ifIndex))
-		if err := exec.Command("route", "add", "10.100.0.0", "mask", "255.255.255.0", serverVIP, "IF", ifIndex, "metric", "1").Run(); err != nil {
+		network, mask := h.vpnNetwork()
+		logHelper(fmt.Sprintf("[VPN] Adding split-tunnel route for %s/%s via %s (IF %s)", network, mask, serverVIP, ifIndex))
+		if err := exec.Command("route", "add", network, "mask", mask, serverVIP, "IF", ifIndex, "metric", "1").Run(); err != nil {
 			logHelper(fmt.Sprintf("[VPN] Error adding split-tunnel route: %v", err))
 		}
 		return
 	}
-	
+
 	logHelper(fmt.Sprintf("[VPN] Configuring Full Tunnel via IF %s...", ifIndex))
 
 	gwIP := getGatewayIP()
@@ -167,10 +189,21 @@ func (h *Helper) setupRouting(full bool, serverHost, serverVIP, ifceName string)
 	if err := exec.Command("route", "add", "128.0.0.0", "mask", "128.0.0.0", serverVIP, "IF", ifIndex, "metric", "1").Run(); err != nil {
 		logHelper(fmt.Sprintf("[VPN] Error adding route 128.0.0.0/1: %v", err))
 	}
-	
+
 	h.setupDNS(ifceName)
 }
 
+// vpnNetwork returns the VPN subnet address and dotted mask announced by the server
+func (h *Helper) vpnNetwork() (string, string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, ipNet, err := net.ParseCIDR(h.vpnCIDR)
+	if err != nil {
+		return "10.100.0.0", tunutil.DefaultMask
+	}
+	return ipNet.IP.String(), net.IP(ipNet.Mask).String()
+}
+
 func getGatewayIP() string {
 	out, _ := exec.Command("route", "print", "0.0.0.0").Output()
 	scanner := bufio.NewScanner(bytes.NewReader(out))
@@ -186,7 +219,7 @@ func getGatewayIP() string {
 
 func (h *Helper) cleanupRouting(full bool, serverHost, ifceName string) {
 	logHelper("[VPN] Cleaning up Windows routes...")
-	
+
 	if full {
 		exec.Command("route", "delete", "0.0.0.0", "mask", "128.0.0.0").Run()
 		exec.Command("route", "delete", "128.0.0.0", "mask", "128.0.0.0").Run()
@@ -195,6 +228,67 @@ func (h *Helper) cleanupRouting(full bool, serverHost, ifceName string) {
 		}
 		h.restoreDNS(ifceName)
 	}
-	
-	exec.Command("route", "delete", "10.100.0.0", "mask", "255.255.255.0").Run()
-}
\ No newline at end of file
+
+	network, mask := h.vpnNetwork()
+	exec.Command("route", "delete", network, "mask", mask).Run()
+}
+
+// addPushedRoutes installs server-pushed routes via the tunnel and excluded
+// routes via the original gateway
+func (h *Helper) addPushedRoutes(serverVIP, ifceName string) {
+	include, exclude := h.routesToInstall()
+	if len(include) == 0 && len(exclude) == 0 {
+		return
+	}
+	ifIndex := h.getInterfaceIndex(ifceName)
+	for _, cidr := range include {
+		var cmd *exec.Cmd
+		if isIPv6CIDR(cidr) {
+			cmd = exec.Command("netsh", "interface", "ipv6", "add", "route", cidr, "interface="+ifIndex, "store=active")
+		} else {
+			network, mask := splitCIDR(cidr)
+			cmd = exec.Command("route", "add", network, "mask", mask, serverVIP, "IF", ifIndex, "metric", "1")
+		}
+		if err := cmd.Run(); err != nil {
+			logHelper(fmt.Sprintf("[VPN] Error adding pushed route %s: %v", cidr, err))
+			continue
+		}
+		h.recordInstalled(cidr)
+		logHelper(fmt.Sprintf("[VPN] Added pushed route %s", cidr))
+	}
+
+	gwIP := getGatewayIP()
+	for _, cidr := range exclude {
+		if isIPv6CIDR(cidr) || gwIP == "" {
+			logHelper(fmt.Sprintf("[VPN] Skipping excluded route %s (no IPv4 gateway)", cidr))
+			continue
+		}
+		network, mask := splitCIDR(cidr)
+		if err := exec.Command("route", "add", network, "mask", mask, gwIP, "metric", "1").Run(); err != nil {
+			logHelper(fmt.Sprintf("[VPN] Error adding excluded route %s: %v", cidr, err))
+			continue
+		}
+		h.recordInstalled(cidr)
+		logHelper(fmt.Sprintf("[VPN] Excluded %s via %s", cidr, gwIP))
+	}
+}
+
+func (h *Helper) removePushedRoutes(ifceName string) {
+	for _, cidr := range h.takeInstalled() {
+		if isIPv6CIDR(cidr) {
+			exec.Command("netsh", "interface", "ipv6", "delete", "route", cidr, "interface="+h.getInterfaceIndex(ifceName)).Run()
+			continue
+		}
+		network, mask := splitCIDR(cidr)
+		exec.Command("route", "delete", network, "mask", mask).Run()
+	}
+}
+
+// splitCIDR converts "10.0.0.0/8" to ("10.0.0.0", "255.0.0.0") for route.exe
+func splitCIDR(cidr string) (string, string) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return cidr, "255.255.255.255"
+	}
+	return ipNet.IP.String(), net.IP(ipNet.Mask).String()
+}
@@ -0,0 +1,252 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// routeStatePath records every route the helper added so that cleanup (or the
+// next start after a crash) removes exactly those and nothing else
+var routeStatePath = filepath.Join(filepath.Dir(SecretPath), "routes.state")
+
+type routeEntry struct {
+	Dst         string `json:"dst"`
+	Gw          string `json:"gw,omitempty"`
+	Link        string `json:"link"`
+	Unreachable bool   `json:"unreachable,omitempty"` // Reject route without a link
+}
+
+var routeState struct {
+	mu      sync.Mutex
+	entries []routeEntry
+}
+
+// addRoute installs a route via netlink. Routes that already exist are left
+// alone and not recorded, since the helper did not create them.
+func addRoute(e routeEntry) error {
+	r, err := e.netlinkRoute()
+	if err != nil {
+		return err
+	}
+
+	routeState.mu.Lock()
+	defer routeState.mu.Unlock()
+
+	// Record intent first: a crash right after RouteAdd must still be cleaned up
+	routeState.entries = append(routeState.entries, e)
+	saveRouteState()
+
+	if err := netlink.RouteAdd(r); err != nil {
+		routeState.entries = routeState.entries[:len(routeState.entries)-1]
+		saveRouteState()
+		if errors.Is(err, syscall.EEXIST) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// flushRoutes removes every route recorded by addRoute
+func flushRoutes() {
+	routeState.mu.Lock()
+	defer routeState.mu.Unlock()
+
+	// Routes from a previous run are only known via the state file
+	if len(routeState.entries) == 0 {
+		if data, err := os.ReadFile(routeStatePath); err == nil {
+			json.Unmarshal(data, &routeState.entries)
+		}
+	}
+
+	for i := len(routeState.entries) - 1; i >= 0; i-- {
+		e := routeState.entries[i]
+		r, err := e.netlinkRoute()
+		if err != nil {
+			continue // Link is gone, and its routes with it
+		}
+		if err := netlink.RouteDel(r); err != nil && !errors.Is(err, syscall.ESRCH) {
+			logHelper(fmt.Sprintf("[VPN] Failed to remove route %s: %v", e.Dst, err))
+		}
+	}
+	routeState.entries = nil
+	os.Remove(routeStatePath)
+}
+
+func (e routeEntry) netlinkRoute() (*netlink.Route, error) {
+	_, dst, err := net.ParseCIDR(e.Dst)
+	if err != nil {
+		return nil, err
+	}
+	if e.Unreachable {
+		return &netlink.Route{Dst: dst, Type: syscall.RTN_UNREACHABLE}, nil
+	}
+	link, err := netlink.LinkByName(e.Link)
+	if err != nil {
+		return nil, err
+	}
+	r := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst}
+	if e.Gw != "" {
+		r.Gw = net.ParseIP(e.Gw)
+	}
+	return r, nil
+}
+
+// saveRouteState persists the route list. Caller must hold routeState.mu.
+func saveRouteState() {
+	if len(routeState.entries) == 0 {
+		os.Remove(routeStatePath)
+		return
+	}
+	data, _ := json.Marshal(routeState.entries)
+	os.MkdirAll(filepath.Dir(routeStatePath), 0755)
+	if err := os.WriteFile(routeStatePath, data, 0600); err != nil {
+		logHelper(fmt.Sprintf("[VPN] WARNING: could not save route state: %v", err))
+	}
+}
+
+// physicalRoute returns a host route entry for dst via its current gateway,
+// or false if dst is on-link or unreachable
+func physicalRoute(dst net.IP) (routeEntry, bool) {
+	found, err := netlink.RouteGet(dst)
+	if err != nil || len(found) == 0 || found[0].Gw == nil {
+		return routeEntry{}, false
+	}
+	link, err := netlink.LinkByIndex(found[0].LinkIndex)
+	if err != nil {
+		return routeEntry{}, false
+	}
+	bits := 32
+	if dst.To4() == nil {
+		bits = 128
+	}
+	return routeEntry{
+		Dst:  fmt.Sprintf("%s/%d", dst, bits),
+		Gw:   found[0].Gw.String(),
+		Link: link.Attrs().Name,
+	}, true
+}
+
+// physicalGateway returns the system default route for the given family. It
+// reads the routing table rather than resolving a probe address, because in
+// full tunnel mode the probe would resolve to the TUN interface.
+func physicalGateway(v6 bool) (routeEntry, bool) {
+	family := netlink.FAMILY_V4
+	if v6 {
+		family = netlink.FAMILY_V6
+	}
+	list, err := netlink.RouteList(nil, family)
+	if err != nil {
+		return routeEntry{}, false
+	}
+	var best *netlink.Route
+	for i, r := range list {
+		if r.Gw == nil || (r.Dst != nil && !isDefaultNet(r.Dst)) {
+			continue
+		}
+		if best == nil || r.Priority < best.Priority {
+			best = &list[i]
+		}
+	}
+	if best == nil {
+		return routeEntry{}, false
+	}
+	link, err := netlink.LinkByIndex(best.LinkIndex)
+	if err != nil || link.Attrs().Name == TunName {
+		return routeEntry{}, false
+	}
+	return routeEntry{Gw: best.Gw.String(), Link: link.Attrs().Name}, true
+}
+
+func isDefaultNet(n *net.IPNet) bool {
+	ones, _ := n.Mask.Size()
+	return ones == 0
+}
+
+// refreshServerRoute moves the pinned server route to the current default
+// gateway after a network change. Only full tunnel pins the server; without
+// a pin the kernel already picks the new path.
+func (h *Helper) refreshServerRoute(server net.IP) {
+	bits := 32
+	if server.To4() == nil {
+		bits = 128
+	}
+	dst := fmt.Sprintf("%s/%d", server, bits)
+
+	gw, ok := physicalGateway(bits == 128)
+	if !ok {
+		return
+	}
+	want := routeEntry{Dst: dst, Gw: gw.Gw, Link: gw.Link}
+
+	routeState.mu.Lock()
+	defer routeState.mu.Unlock()
+	for i, e := range routeState.entries {
+		if e.Dst != dst {
+			continue
+		}
+		// Replace even if unchanged: the kernel drops the route when its link goes down
+		r, err := want.netlinkRoute()
+		if err != nil {
+			return
+		}
+		if err := netlink.RouteReplace(r); err != nil {
+			h.logVerbose(fmt.Sprintf("[VPN] Re-pinning %s failed: %v", dst, err))
+			return
+		}
+		if e != want {
+			routeState.entries[i] = want
+			saveRouteState()
+			logHelper(fmt.Sprintf("[VPN] Re-pinned %s via %s (%s)", dst, want.Gw, want.Link))
+		}
+		return
+	}
+}
+
+// setupLinuxRoutes pins the server via the original gateway and points the
+// default route halves at the tunnel (full tunnel only). serverHost is the
+// address actually dialed; a fresh lookup could return a different one,
+// which would then be routed into the tunnel. Without an IPv6 VIP the IPv6
+// halves are unreachable, so IPv6 traffic cannot bypass the tunnel.
+func (h *Helper) setupLinuxRoutes(full bool, serverHost, ifceName string) {
+	if !full {
+		return
+	}
+
+	if server := net.ParseIP(serverHost); server == nil {
+		logHelper(fmt.Sprintf("[VPN] Not pinning server route: %q is not an address", serverHost))
+	} else if e, ok := physicalRoute(server); ok {
+		if err := addRoute(e); err != nil {
+			logHelper(fmt.Sprintf("[VPN] Error pinning server route: %v", err))
+		} else {
+			logHelper(fmt.Sprintf("[VPN] Pinned %s via %s (%s)", e.Dst, e.Gw, e.Link))
+		}
+	}
+
+	h.mu.RLock()
+	hasV6 := h.assignedVIP6 != ""
+	h.mu.RUnlock()
+	for _, dst := range []string{"0.0.0.0/1", "128.0.0.0/1", "::/1", "8000::/1"} {
+		e := routeEntry{Dst: dst, Link: ifceName}
+		if isIPv6CIDR(dst) && !hasV6 {
+			e = routeEntry{Dst: dst, Unreachable: true}
+		}
+		if err := addRoute(e); err != nil {
+			logHelper(fmt.Sprintf("[VPN] Error adding route %s: %v", dst, err))
+		}
+	}
+	if !hasV6 {
+		logHelper("[VPN] No IPv6 VIP assigned, blocking IPv6 for the full tunnel")
+	}
+	logHelper(fmt.Sprintf("[VPN] Full tunnel active via %s", ifceName))
+}
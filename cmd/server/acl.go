@@ -0,0 +1,64 @@
+// Author: webdunesurfer <vkh@gmx.at>
+// Licensed under the GNU General Public License v3.0
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/webdunesurfer/SloPN/pkg/acl"
+	"github.com/webdunesurfer/SloPN/pkg/iputil"
+	"github.com/webdunesurfer/SloPN/pkg/session"
+	"github.com/webdunesurfer/SloPN/pkg/userdb"
+)
+
+// groupsOf returns the user's current groups, so reloads apply right away
+func groupsOf(users *userdb.Store, user string) []string {
+	if users == nil {
+		return nil
+	}
+	account, err := users.Lookup(user)
+	if err != nil {
+		return nil
+	}
+	return account.Groups
+}
+
+// spoofed reports whether data claims a source other than s's VIPs. Such
+// packets are dropped before the ACL, whose reply tracking trusts the source.
+func spoofed(s *session.Session, data []byte) bool {
+	src := iputil.GetSourceIP(data)
+	return src == nil || !(src.Equal(s.VIP) || (s.VIP6 != nil && src.Equal(s.VIP6)))
+}
+
+// aclDrops reports whether the ACL forbids s to send data, logging the first
+// drop of each flow. Without an ACL everything passes.
+func aclDrops(filter *acl.Policy, users *userdb.Store, sm *session.Manager, s *session.Session, data []byte) bool {
+	if filter == nil {
+		return false
+	}
+	pkt := acl.Packet{Session: s.VIP.String(), User: s.User, Groups: groupsOf(users, s.User)}
+	if !pkt.Parse(data) {
+		counters.aclDropped.Add(1)
+		return true
+	}
+	if !sm.IsServerIP(pkt.Dst) {
+		if dst, ok := sm.Lookup(pkt.Dst.String()); ok {
+			pkt.DstSession = dst.VIP.String()
+			pkt.DstUser, pkt.DstGroups = dst.User, groupsOf(users, dst.User)
+		}
+	}
+	v := filter.Check(&pkt)
+	if v.Allow {
+		return false
+	}
+	counters.aclDropped.Add(1)
+	if v.Log {
+		details := fmt.Sprintf("User: %s; Flow: %s; Rule: %s", s.User, pkt.String(), v.Rule)
+		if pkt.DstUser != "" {
+			details += "; To: " + pkt.DstUser
+		}
+		logServer("ACL_DROP", s.VIP.String(), s.Conn.RemoteAddr().String(), details)
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/webdunesurfer/SloPN/pkg/session"
+)
+
+func TestSpoofed(t *testing.T) {
+	s := &session.Session{VIP: net.ParseIP("10.100.0.2").To4(), VIP6: net.ParseIP("fd00::2")}
+	v4 := func(src string) []byte {
+		b := make([]byte, 20)
+		b[0] = 0x45
+		copy(b[12:16], net.ParseIP(src).To4())
+		copy(b[16:20], net.ParseIP("10.0.0.5").To4())
+		return b
+	}
+	v6 := func(src string) []byte {
+		b := make([]byte, 40)
+		b[0] = 0x60
+		copy(b[8:24], net.ParseIP(src))
+		copy(b[24:40], net.ParseIP("fd00::1"))
+		return b
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"own VIP", v4("10.100.0.2"), false},
+		{"own VIP6", v6("fd00::2"), false},
+		{"other client", v4("10.100.0.3"), true},
+		{"other client v6", v6("fd00::3"), true},
+		{"link-local", v6("fe80::1"), true},
+		{"truncated", []byte{0x45, 0}, true},
+	}
+	for _, tt := range tests {
+		if got := spoofed(s, tt.data); got != tt.want {
+			t.Errorf("%s: spoofed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	s.VIP6 = nil
+	if !spoofed(s, v6("fd00::2")) {
+		t.Error("IPv6 accepted from a session without a VIP6")
+	}
+}
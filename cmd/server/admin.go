@@ -0,0 +1,209 @@
+// Author: webdunesurfer <vkh@gmx.at>
+// Licensed under the GNU General Public License v3.0
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/webdunesurfer/SloPN/pkg/admin"
+	"github.com/webdunesurfer/SloPN/pkg/session"
+)
+
+// loadAdminSecret reads the admin API secret, generating it on first start
+func loadAdminSecret(path string) (string, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		if secret := strings.TrimSpace(string(data)); secret != "" {
+			return secret, nil
+		}
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(b)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(secret+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// serveAdmin starts the admin API on a Unix socket only root can connect to
+func serveAdmin(socketPath, secretPath string, sm *session.Manager, rl *RateLimiter) error {
+	secret, err := loadAdminSecret(secretPath)
+	if err != nil {
+		return fmt.Errorf("secret: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return err
+	}
+	os.Remove(socketPath) // Stale socket from a previous run
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	fmt.Printf("Admin API listening on %s\n", socketPath)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleAdmin(conn, secret, sm, rl)
+		}
+	}()
+	return nil
+}
+
+func handleAdmin(conn net.Conn, secret string, sm *session.Manager, rl *RateLimiter) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	var req admin.Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+
+	var resp admin.Response
+	if subtle.ConstantTimeCompare([]byte(req.Secret), []byte(secret)) != 1 {
+		resp = admin.Response{Status: "error", Message: "unauthorized: invalid admin secret"}
+	} else {
+		data, msg, err := adminCommand(req, sm, rl)
+		if err != nil {
+			resp = admin.Response{Status: "error", Message: err.Error()}
+		} else {
+			resp = admin.Response{Status: "success", Message: msg}
+			if data != nil {
+				resp.Data, _ = json.Marshal(data)
+			}
+		}
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// banAddress bans ip on request of an administrator for mins minutes (0 uses
+// -ban-duration) and closes its sessions
+func banAddress(sm *session.Manager, rl *RateLimiter, ip string, mins int) (banned, kicked int, err error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return 0, 0, fmt.Errorf("invalid IP address %q", ip)
+	}
+	ip = addr.String() // Same form as the rate limiter's keys
+	if allowed(ip) {
+		return 0, 0, fmt.Errorf("%s is on the allow list", ip)
+	}
+	if mins <= 0 {
+		mins = settings().banMins
+	}
+	rl.Ban(ip, time.Duration(mins)*time.Minute)
+	logServer("BAN", "---", ip, fmt.Sprintf("Duration: %dm; Source: admin", mins))
+
+	// A ban also ends the address's current sessions
+	for _, s := range sm.Sessions() {
+		if host, _, _ := net.SplitHostPort(s.Conn.RemoteAddr().String()); host == ip {
+			s.Conn.CloseWithError(0x03, "banned")
+			kicked++
+		}
+	}
+	return mins, kicked, nil
+}
+
+func adminCommand(req admin.Request, sm *session.Manager, rl *RateLimiter) (data interface{}, msg string, err error) {
+	switch req.Command {
+	case admin.CmdSessions:
+		list := []admin.SessionInfo{}
+		for _, s := range sm.Sessions() {
+			info := admin.SessionInfo{
+				VIP:       s.VIP.String(),
+				Remote:    s.Conn.RemoteAddr().String(),
+				User:      s.User,
+				Device:    s.Device,
+				Connected: s.Connected,
+				LastRx:    s.Traffic.LastRx(),
+				LastTx:    s.Traffic.LastTx(),
+				RxPackets: s.Traffic.RxPackets.Load(),
+				RxBytes:   s.Traffic.RxBytes.Load(),
+				TxPackets: s.Traffic.TxPackets.Load(),
+				TxBytes:   s.Traffic.TxBytes.Load(),
+				Dropped:   s.Traffic.Limits.Dropped.Load(),
+				Delayed:   s.Traffic.Limits.Delayed.Load(),
+			}
+			if s.VIP6 != nil {
+				info.VIP6 = s.VIP6.String()
+			}
+			list = append(list, info)
+		}
+		return list, "", nil
+
+	case admin.CmdKick:
+		conn, user, ok := sm.Kick(req.VIP)
+		if !ok {
+			return nil, "", fmt.Errorf("no session for %s", req.VIP)
+		}
+		conn.CloseWithError(0, "kicked by administrator")
+		logServer("KICKED", req.VIP, conn.RemoteAddr().String(), "User: "+user)
+		msg := fmt.Sprintf("Kicked %s (%s)", req.VIP, user)
+		if !req.Ban {
+			return nil, msg, nil
+		}
+		// The client logs straight back in with its token otherwise
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		mins, kicked, err := banAddress(sm, rl, host, req.Minutes)
+		if err != nil {
+			return nil, "", fmt.Errorf("kicked %s (%s) but not banned: %v", req.VIP, user, err)
+		}
+		return nil, fmt.Sprintf("%s and banned %s for %dm (%d more sessions closed)", msg, host, mins, kicked), nil
+
+	case admin.CmdBans:
+		list := rl.Bans()
+		if list == nil {
+			list = []admin.BanInfo{}
+		}
+		return list, "", nil
+
+	case admin.CmdBan:
+		mins, kicked, err := banAddress(sm, rl, req.IP, req.Minutes)
+		if err != nil {
+			return nil, "", err
+		}
+		return nil, fmt.Sprintf("Banned %s for %dm (%d sessions closed)", net.ParseIP(req.IP), mins, kicked), nil
+
+	case admin.CmdUnban:
+		if ip := net.ParseIP(req.IP); ip != nil {
+			req.IP = ip.String()
+		}
+		if !rl.Unban(req.IP) {
+			return nil, "", fmt.Errorf("%s is not banned", req.IP)
+		}
+		logServer("UNBAN", "---", req.IP, "Source: admin")
+		return nil, "Unbanned " + req.IP, nil
+
+	case admin.CmdPool:
+		used, total := sm.PoolStats()
+		return admin.PoolInfo{
+			Subnet:   sm.Subnet().String(),
+			ServerIP: sm.GetServerIP().String(),
+			Used:     used,
+			Total:    total,
+			Sessions: len(sm.Sessions()),
+		}, "", nil
+	}
+	return nil, "", fmt.Errorf("unknown command %q", req.Command)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/webdunesurfer/SloPN/pkg/session"
+)
+
+func TestBanAddress(t *testing.T) {
+	useSettings(t, &liveSettings{banMins: 60, allow: mustNets(t, "192.0.2.1")})
+	sm, err := session.NewManager("10.100.0.0/24", "10.100.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := NewRateLimiter()
+
+	if _, _, err := banAddress(sm, rl, "not-an-ip", 0); err == nil {
+		t.Error("invalid address banned")
+	}
+	if _, _, err := banAddress(sm, rl, "192.0.2.1", 0); err == nil || rl.IsBanned("192.0.2.1") {
+		t.Error("address on the allow list banned")
+	}
+
+	mins, _, err := banAddress(sm, rl, "::ffff:203.0.113.7", 0)
+	if err != nil || mins != 60 {
+		t.Fatalf("banAddress = %dm, %v; want the default 60m", mins, err)
+	}
+	// Stored in the rate limiter's form, so IsBanned and unban find it
+	if !rl.IsBanned("203.0.113.7") {
+		t.Fatal("mapped address not banned in its plain form")
+	}
+	if left := time.Until(rl.banned["203.0.113.7"].Expires); left < 59*time.Minute {
+		t.Fatalf("ban lasts %v", left)
+	}
+	if mins, _, _ := banAddress(sm, rl, "203.0.113.8", 5); mins != 5 {
+		t.Fatalf("explicit duration %dm, want 5m", mins)
+	}
+}
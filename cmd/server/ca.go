@@ -0,0 +1,188 @@
+// Author: webdunesurfer <vkh@gmx.at>
+// Licensed under the GNU General Public License v3.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/webdunesurfer/SloPN/pkg/certutil"
+)
+
+const caUsage = `Usage: slopn-server ca <command> [flags]
+
+Offline certificate authority for server certificates and device
+certificates (-client-ca).
+
+Commands:
+  init [-name CN] [-days N]                      Create the root CA
+  issue -name NAME [-server] [-san LIST]         Issue a certificate; client certificates
+        [-days N] [-out DIR]                     use NAME as the user name
+  list                                           Show issued certificates
+  export [SERIAL|NAME] [-out FILE]               Write the PEM chain of a certificate,
+                                                 or the CA certificate without an argument
+  revoke SERIAL|NAME                             Revoke certificates and rewrite the CRL
+
+Common flags:
+  -dir DIR   CA directory (default $SLOPN_CA_DIR or /var/lib/slopn/ca)
+`
+
+// runCA implements the "ca" subcommand and returns the process exit code
+func runCA(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, caUsage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("ca "+args[0], flag.ContinueOnError)
+	dir := fs.String("dir", getEnv("SLOPN_CA_DIR", "/var/lib/slopn/ca"), "CA directory")
+	name := fs.String("name", "", "Subject common name (user name for client certificates)")
+	server := fs.Bool("server", false, "Issue a server certificate instead of a client certificate")
+	sans := fs.String("san", "", "Comma-separated DNS names, IPs, e-mails or URIs (server default: -name)")
+	days := fs.Int("days", 0, "Validity in days (default: 3650 for the CA, 365 for certificates)")
+	out := fs.String("out", "", "Output directory (issue) or file (export)")
+	positional, err := parseArgs(fs, args[1:])
+	if err != nil {
+		return 2
+	}
+	validity := time.Duration(*days) * 24 * time.Hour
+
+	if args[0] == "init" {
+		ca, err := certutil.InitCA(*dir, *name, validity)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Init failed: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Created CA %q in %s (expires %s)\n", ca.Cert.Subject.CommonName, *dir, ca.Cert.NotAfter.Format(time.RFC3339))
+		fmt.Printf("  Trust anchor for clients (server_ca) and -client-ca: %s\n", filepath.Join(*dir, certutil.CACertFile))
+		fmt.Printf("  Revocation list for -crl: %s\n", filepath.Join(*dir, certutil.CRLFile))
+		return 0
+	}
+
+	ca, err := certutil.OpenCA(*dir)
+	if err == certutil.ErrNoCA {
+		fmt.Fprintf(os.Stderr, "No CA in %s; run \"slopn-server ca init\" first\n", *dir)
+		return 1
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open CA in %s: %v\n", *dir, err)
+		return 1
+	}
+
+	switch args[0] {
+	case "issue":
+		req := certutil.IssueRequest{Kind: certutil.KindClient, Name: *name, SANs: splitList(*sans), Validity: validity}
+		if *server {
+			req.Kind = certutil.KindServer
+		}
+		certPEM, keyPEM, entry, err := ca.Issue(req)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Issue failed: %v\n", err)
+			return 1
+		}
+		if *out == "" {
+			*out = "."
+		}
+		// The file name is derived from a user-supplied name; keep it inside -out
+		base := filepath.Join(*out, strings.NewReplacer("/", "_", "\\", "_").Replace(entry.Name))
+		bundle, err := ca.Bundle(entry)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to build bundle: %v\n", err)
+			return 1
+		}
+		if err := os.WriteFile(base+".key", keyPEM, 0600); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write key: %v\n", err)
+			return 1
+		}
+		if err := os.WriteFile(base+".crt", certPEM, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write certificate: %v\n", err)
+			return 1
+		}
+		if err := os.WriteFile(base+".pem", bundle, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write bundle: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Issued %s certificate %s (serial %s, expires %s)\n", entry.Kind, entry.Name, entry.Serial, entry.NotAfter.Format(time.RFC3339))
+		if len(entry.SANs) > 0 {
+			fmt.Printf("  SANs:        %s\n", strings.Join(entry.SANs, ", "))
+		}
+		fmt.Printf("  Certificate: %s\n  Chain:       %s\n  Key:         %s\n", base+".crt", base+".pem", base+".key")
+		if entry.Kind == certutil.KindServer {
+			fmt.Printf("Run the server with -cert %s -key %s\n", base+".pem", base+".key")
+		}
+
+	case "list":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SERIAL\tKIND\tNAME\tEXPIRES\tSTATUS")
+		for _, c := range ca.List() {
+			kind := c.Kind
+			if kind == "" {
+				kind = certutil.KindClient
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", c.Serial, kind, c.Name, c.NotAfter.Format("2006-01-02"), c.Status())
+		}
+		w.Flush()
+
+	case "export":
+		data := ca.CertPEM()
+		if len(positional) > 0 {
+			c, err := ca.Find(positional[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+				return 1
+			}
+			if data, err = ca.Bundle(c); err != nil {
+				fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+				return 1
+			}
+		}
+		if *out == "" {
+			os.Stdout.Write(data)
+		} else if err := os.WriteFile(*out, data, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+			return 1
+		}
+
+	case "revoke":
+		if len(positional) != 1 {
+			fmt.Fprint(os.Stderr, caUsage)
+			return 2
+		}
+		revoked, err := ca.Revoke(positional[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Revoke failed: %v\n", err)
+			return 1
+		}
+		for _, c := range revoked {
+			fmt.Printf("Revoked %s (serial %s)\n", c.Name, c.Serial)
+		}
+		fmt.Printf("CRL updated: %s (copy it to the server and send SIGHUP)\n", filepath.Join(*dir, certutil.CRLFile))
+
+	default:
+		fmt.Fprint(os.Stderr, caUsage)
+		return 2
+	}
+	return 0
+}
+
+// parseArgs parses flags that may also follow positional arguments, e.g.
+// "export alice -out a.pem", and returns the positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for len(args) > 0 {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	return positional, nil
+}
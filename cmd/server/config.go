@@ -0,0 +1,483 @@
+// Author: webdunesurfer <vkh@gmx.at>
+// Licensed under the GNU General Public License v3.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/webdunesurfer/SloPN/pkg/acl"
+	"github.com/webdunesurfer/SloPN/pkg/obfuscator"
+	"github.com/webdunesurfer/SloPN/pkg/routes"
+	"github.com/webdunesurfer/SloPN/pkg/shaper"
+	"github.com/webdunesurfer/SloPN/pkg/userdb"
+)
+
+// Config is the server configuration file (-config). Every setting mirrors a
+// flag; keys missing from the file keep the flag's default (or environment)
+// value, and flags given on the command line win over the file.
+type Config struct {
+	Network struct {
+		Subnet       string `json:"subnet"`
+		ServerIP     string `json:"server_ip"`
+		Subnet6      string `json:"subnet6"`
+		NAT          bool   `json:"nat"`
+		Reservations string `json:"reservations"`
+		Leases       string `json:"leases"`
+	} `json:"network"`
+	Listen struct {
+		Port   int    `json:"port"`
+		Family string `json:"family"`
+	} `json:"listen"`
+	DNS struct {
+		Servers []string `json:"servers"`
+		Search  []string `json:"search"`
+		Domains []string `json:"domains"`
+	} `json:"dns"`
+	Auth struct {
+		Token     string         `json:"token"`
+		UsersFile string         `json:"users_file"`
+		Users     []*userdb.User `json:"users,omitempty"` // Inline alternative to users_file
+		QuotaFile string         `json:"quota_usage"`
+	} `json:"auth"`
+	TLS struct {
+		Cert       string `json:"cert"`
+		Key        string `json:"key"`
+		ClientCA   string `json:"client_ca"`
+		ClientAuth string `json:"client_auth"`
+		CRL        string `json:"crl"`
+	} `json:"tls"`
+	Obfuscation struct {
+		Enabled bool   `json:"enabled"`
+		Secret  string `json:"secret"`
+		Mimic   string `json:"mimic"`
+		Legacy  bool   `json:"legacy"`
+	} `json:"obfuscation"`
+	Routes struct {
+		Path        string `json:"file"`
+		routes.File        // Inline alternative to file
+	} `json:"routes"`
+	Shaping struct {
+		Path        string `json:"file"`
+		shaper.File        // Inline alternative to file
+	} `json:"shaping"`
+	ACL struct {
+		Path     string `json:"file"`
+		acl.File        // Inline alternative to file
+	} `json:"acl"`
+	RateLimit struct {
+		MaxAttempts int      `json:"max_attempts"`
+		WindowMins  int      `json:"window_minutes"`
+		BanMins     int      `json:"ban_minutes"`
+		MaxBanMins  int      `json:"max_ban_minutes"`
+		BanFile     string   `json:"ban_file"`
+		Bans        []string `json:"bans,omitempty"`  // IPs or CIDRs refused until removed
+		Allow       []string `json:"allow,omitempty"` // IPs or CIDRs never refused or banned
+	} `json:"rate_limit"`
+	Admin struct {
+		Socket     string `json:"socket"`
+		SecretFile string `json:"secret_file"`
+	} `json:"admin"`
+	Metrics struct {
+		Listen string `json:"listen"`
+	} `json:"metrics"`
+	Verbose bool `json:"verbose"`
+}
+
+// binding ties a config field to its flag. Live settings take effect on
+// SIGHUP; changing any other one requires a restart.
+type binding struct {
+	flag  string
+	field interface{} // *string, *int, *bool or *[]string (comma-separated flag)
+	live  bool
+}
+
+func (c *Config) bindings() []binding {
+	return []binding{
+		{"subnet", &c.Network.Subnet, false},
+		{"ip", &c.Network.ServerIP, false},
+		{"subnet6", &c.Network.Subnet6, false},
+		{"nat", &c.Network.NAT, false},
+		{"reservations", &c.Network.Reservations, false},
+		{"leases", &c.Network.Leases, false},
+		{"port", &c.Listen.Port, false},
+		{"family", &c.Listen.Family, false},
+		{"dns", &c.DNS.Servers, true},
+		{"dns-search", &c.DNS.Search, true},
+		{"dns-domains", &c.DNS.Domains, true},
+		{"token", &c.Auth.Token, true},
+		{"users", &c.Auth.UsersFile, false},
+		{"quota-usage", &c.Auth.QuotaFile, false},
+		{"cert", &c.TLS.Cert, false},
+		{"key", &c.TLS.Key, false},
+		{"client-ca", &c.TLS.ClientCA, false},
+		{"client-auth", &c.TLS.ClientAuth, false},
+		{"crl", &c.TLS.CRL, false},
+		{"obfs", &c.Obfuscation.Enabled, false},
+		{"obfs-secret", &c.Obfuscation.Secret, false},
+		{"mimic", &c.Obfuscation.Mimic, true},
+		{"obfs-legacy", &c.Obfuscation.Legacy, false},
+		{"routes", &c.Routes.Path, false},
+		{"shaping", &c.Shaping.Path, false},
+		{"acl", &c.ACL.Path, false},
+		{"max-attempts", &c.RateLimit.MaxAttempts, true},
+		{"window", &c.RateLimit.WindowMins, true},
+		{"ban-duration", &c.RateLimit.BanMins, true},
+		{"max-ban-duration", &c.RateLimit.MaxBanMins, true},
+		{"ban-file", &c.RateLimit.BanFile, false},
+		{"admin", &c.Admin.Socket, false},
+		{"admin-secret", &c.Admin.SecretFile, false},
+		{"metrics", &c.Metrics.Listen, false},
+		{"v", &c.Verbose, false},
+	}
+}
+
+// cmdline records the flags given on the command line before applyFlags
+// sets the rest, since flag.Visit cannot tell them apart afterwards
+var cmdline map[string]bool
+
+// loadConfig reads path on top of the flag defaults, then re-applies flags
+// set on the command line, and validates the result
+func loadConfig(path string) (*Config, error) {
+	if cmdline == nil {
+		cmdline = make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { cmdline[f.Name] = true })
+	}
+
+	c := &Config{}
+	for _, b := range c.bindings() {
+		if err := b.set(flag.Lookup(b.flag).DefValue); err != nil {
+			return nil, fmt.Errorf("default for -%s: %v", b.flag, err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+
+	for _, b := range c.bindings() {
+		if cmdline[b.flag] {
+			b.set(flag.Lookup(b.flag).Value.String())
+		}
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// applyFlags makes the flag variables reflect c. Only called at startup:
+// afterwards the flags are read without locking.
+func (c *Config) applyFlags() {
+	for _, b := range c.bindings() {
+		flag.Set(b.flag, b.get())
+	}
+}
+
+// restartRequired lists the settings that differ between c and next but
+// cannot be changed while the server runs
+func (c *Config) restartRequired(next *Config) []string {
+	var out []string
+	nb := next.bindings()
+	for i, b := range c.bindings() {
+		if !b.live && b.get() != nb[i].get() {
+			out = append(out, b.flag)
+		}
+	}
+	if (len(c.Auth.Users) > 0) != (len(next.Auth.Users) > 0) {
+		out = append(out, "auth.users")
+	}
+	if c.Routes.IsEmpty() != next.Routes.IsEmpty() {
+		out = append(out, "routes (inline)")
+	}
+	if c.Shaping.IsEmpty() != next.Shaping.IsEmpty() {
+		out = append(out, "shaping (inline)")
+	}
+	if c.ACL.IsEmpty() != next.ACL.IsEmpty() {
+		out = append(out, "acl (inline)")
+	}
+	return out
+}
+
+func (c *Config) validate() error {
+	if _, _, err := net.ParseCIDR(c.Network.Subnet); err != nil {
+		return fmt.Errorf("network.subnet: %v", err)
+	}
+	if net.ParseIP(c.Network.ServerIP) == nil {
+		return fmt.Errorf("network.server_ip: invalid address %q", c.Network.ServerIP)
+	}
+	if c.Network.Subnet6 != "" {
+		if _, _, err := net.ParseCIDR(c.Network.Subnet6); err != nil {
+			return fmt.Errorf("network.subnet6: %v", err)
+		}
+	}
+	if c.Listen.Port < 1 || c.Listen.Port > 65535 {
+		return fmt.Errorf("listen.port: %d out of range", c.Listen.Port)
+	}
+	switch c.Listen.Family {
+	case "4", "6", "dual":
+	default:
+		return fmt.Errorf("listen.family: %q (expected 4, 6 or dual)", c.Listen.Family)
+	}
+	for _, d := range c.DNS.Servers {
+		if net.ParseIP(d) == nil {
+			return fmt.Errorf("dns.servers: invalid address %q", d)
+		}
+	}
+	if c.Auth.UsersFile != "" && len(c.Auth.Users) > 0 {
+		return fmt.Errorf("auth: set either users_file or users, not both")
+	}
+	if len(c.Auth.Users) > 0 {
+		if _, err := userdb.New(c.Auth.Users); err != nil {
+			return fmt.Errorf("auth.users: %v", err)
+		}
+	}
+	if c.Obfuscation.Mimic != "" {
+		if _, _, err := net.SplitHostPort(c.Obfuscation.Mimic); err != nil {
+			return fmt.Errorf("obfuscation.mimic: %v", err)
+		}
+	}
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			return fmt.Errorf("metrics.listen: %v", err)
+		}
+	}
+	if c.Routes.Path != "" && !c.Routes.IsEmpty() {
+		return fmt.Errorf("routes: set either file or an inline policy, not both")
+	}
+	if !c.Routes.IsEmpty() {
+		if _, err := routes.New(c.Routes.File); err != nil {
+			return fmt.Errorf("routes: %v", err)
+		}
+	}
+	if c.Shaping.Path != "" && !c.Shaping.IsEmpty() {
+		return fmt.Errorf("shaping: set either file or an inline policy, not both")
+	}
+	if !c.Shaping.IsEmpty() {
+		if _, err := shaper.New(c.Shaping.File); err != nil {
+			return fmt.Errorf("shaping: %v", err)
+		}
+	}
+	if c.ACL.Path != "" && !c.ACL.IsEmpty() {
+		return fmt.Errorf("acl: set either file or inline rules, not both")
+	}
+	if !c.ACL.IsEmpty() {
+		if _, err := acl.New(c.ACL.File); err != nil {
+			return fmt.Errorf("acl: %v", err)
+		}
+	}
+	if c.RateLimit.MaxAttempts < 1 || c.RateLimit.WindowMins < 1 || c.RateLimit.BanMins < 1 {
+		return fmt.Errorf("rate_limit: max_attempts, window_minutes and ban_minutes must be positive")
+	}
+	if c.RateLimit.MaxBanMins < c.RateLimit.BanMins {
+		return fmt.Errorf("rate_limit: max_ban_minutes must be at least ban_minutes")
+	}
+	if _, err := parseBans(c.RateLimit.Bans); err != nil {
+		return fmt.Errorf("rate_limit.bans: %v", err)
+	}
+	if _, err := parseBans(c.RateLimit.Allow); err != nil {
+		return fmt.Errorf("rate_limit.allow: %v", err)
+	}
+	return nil
+}
+
+func (b binding) get() string {
+	switch v := b.field.(type) {
+	case *string:
+		return *v
+	case *int:
+		return strconv.Itoa(*v)
+	case *bool:
+		return strconv.FormatBool(*v)
+	case *[]string:
+		return strings.Join(*v, ",")
+	}
+	panic("unsupported binding type")
+}
+
+func (b binding) set(s string) error {
+	switch v := b.field.(type) {
+	case *string:
+		*v = s
+	case *int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		*v = i
+	case *bool:
+		t, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		*v = t
+	case *[]string:
+		*v = splitList(s)
+	}
+	return nil
+}
+
+// liveSettings are the values SIGHUP may replace while sessions are up.
+// Readers take a snapshot with settings().
+type liveSettings struct {
+	token       string
+	dnsServers  []string
+	dnsSearch   []string
+	dnsDomains  []string
+	mimic       string
+	maxAttempts int
+	windowMins  int
+	banMins     int
+	maxBanMins  int
+	bans        []*net.IPNet // Static deny list
+	allow       []*net.IPNet // Wins over bans and the deny list
+}
+
+var live atomic.Pointer[liveSettings]
+
+func settings() *liveSettings {
+	return live.Load()
+}
+
+// settingsFromFlags builds the live settings at startup, after the config
+// file (if any) has been applied to the flags
+func settingsFromFlags(bans, allow []string) (*liveSettings, error) {
+	nets, err := parseBans(bans)
+	if err != nil {
+		return nil, err
+	}
+	allowNets, err := parseBans(allow)
+	if err != nil {
+		return nil, err
+	}
+	return &liveSettings{
+		token:       *token,
+		dnsServers:  splitList(*dnsList),
+		dnsSearch:   splitList(*dnsSearch),
+		dnsDomains:  splitList(*dnsSplit),
+		mimic:       *mimic,
+		maxAttempts: *maxAttempts,
+		windowMins:  *windowMins,
+		banMins:     *banMins,
+		maxBanMins:  *maxBanMins,
+		bans:        nets,
+		allow:       allowNets,
+	}, nil
+}
+
+// settingsFromConfig builds the live settings from a reloaded config file
+func settingsFromConfig(c *Config) *liveSettings {
+	nets, _ := parseBans(c.RateLimit.Bans) // Checked by validate
+	allowNets, _ := parseBans(c.RateLimit.Allow)
+	return &liveSettings{
+		token:       c.Auth.Token,
+		dnsServers:  c.DNS.Servers,
+		dnsSearch:   c.DNS.Search,
+		dnsDomains:  c.DNS.Domains,
+		mimic:       c.Obfuscation.Mimic,
+		maxAttempts: c.RateLimit.MaxAttempts,
+		windowMins:  c.RateLimit.WindowMins,
+		banMins:     c.RateLimit.BanMins,
+		maxBanMins:  c.RateLimit.MaxBanMins,
+		bans:        nets,
+		allow:       allowNets,
+	}
+}
+
+// parseBans accepts single IPs and CIDRs
+func parseBans(list []string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// applied is the config file as of the last reload that got past validation.
+// Only the SIGHUP handler uses it.
+var applied *Config
+
+// reloadConfig re-reads the config file on SIGHUP and swaps in the live
+// settings. cfg is the config the server started with; other changes are
+// only reported, once per change.
+func reloadConfig(cfg *Config, users *userdb.Store, routeTable *routes.Table, shaping *shaper.Policy, filter *acl.Policy, reality *obfuscator.RealityConn) {
+	next, err := loadConfig(*cfgFile)
+	if err != nil {
+		logServer("RELOAD_FAILED", "---", "---", fmt.Sprintf("config: %v", err))
+		return
+	}
+	prev := settings()
+	ls := settingsFromConfig(next)
+
+	if reality != nil && ls.mimic != prev.mimic {
+		if err := reality.SetMimic(ls.mimic); err != nil {
+			logServer("RELOAD_FAILED", "---", "---", fmt.Sprintf("mimic: %v", err))
+			ls.mimic = prev.mimic
+		}
+	}
+	if users != nil && len(next.Auth.Users) > 0 {
+		if err := users.Set(next.Auth.Users); err != nil {
+			logServer("RELOAD_FAILED", "---", "---", fmt.Sprintf("users: %v", err))
+		}
+	}
+	if routeTable != nil && !next.Routes.IsEmpty() {
+		if err := routeTable.Set(next.Routes.File); err != nil {
+			logServer("RELOAD_FAILED", "---", "---", fmt.Sprintf("routes: %v", err))
+		}
+	}
+	if !cfg.Shaping.IsEmpty() && !next.Shaping.IsEmpty() {
+		if err := shaping.Set(next.Shaping.File); err != nil {
+			logServer("RELOAD_FAILED", "---", "---", fmt.Sprintf("shaping: %v", err))
+		}
+	}
+	if filter != nil && !next.ACL.IsEmpty() {
+		if err := filter.Set(next.ACL.File); err != nil {
+			logServer("RELOAD_FAILED", "---", "---", fmt.Sprintf("acl: %v", err))
+		}
+	}
+	live.Store(ls)
+
+	if applied == nil {
+		applied = cfg
+	}
+	details := "config"
+	if pending := applied.restartRequired(next); len(pending) > 0 {
+		details += "; restart required for: " + strings.Join(pending, " ")
+	}
+	applied = next
+	if ls.token != prev.token && reality != nil && *obfsKey == "" {
+		details += "; Reality secret keeps the old token until restart"
+	}
+	logServer("RELOAD", "---", "---", details)
+}
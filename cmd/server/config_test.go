@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// captureStdout returns what f prints, i.e. the server's log lines
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	f()
+	os.Stdout = stdout
+	w.Close()
+	var out bytes.Buffer
+	io.Copy(&out, r)
+	return out.String()
+}
+
+func TestReloadReportsRestartOncePerChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.json")
+	*cfgFile = path
+	defer func() { *cfgFile, applied = "", nil }()
+
+	write := func(port int) {
+		data := fmt.Sprintf(`{"listen": {"port": %d}}`, port)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(4242)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live.Store(settingsFromConfig(cfg))
+
+	steps := []struct {
+		port    int
+		restart bool
+	}{
+		{5000, true},  // Changed: reported
+		{5000, false}, // Same file again: already reported
+		{6000, true},  // Changed again: reported, not missed
+		{4242, true},  // Back to the startup value is still a change
+	}
+	for i, st := range steps {
+		write(st.port)
+		out := captureStdout(t, func() { reloadConfig(cfg, nil, nil, nil, nil, nil) })
+		if got := strings.Contains(out, "restart required for: port"); got != st.restart {
+			t.Errorf("reload %d (port %d): restart reported = %v, want %v\n%s", i+1, st.port, got, st.restart, out)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Author: webdunesurfer <vkh@gmx.at>
+// Licensed under the GNU General Public License v3.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/webdunesurfer/SloPN/pkg/admin"
+)
+
+const ctlUsage = `Usage: slopn-server ctl <command> [flags]
+
+Manage a running server through its admin socket.
+
+Commands:
+  sessions               List connected clients and their traffic
+  kick VIP [-ban]        Disconnect a client and make it log in again; with
+                         -ban (and -minutes N), also ban its address so it
+                         cannot reconnect right away
+  bans                   List banned addresses
+  ban IP [-minutes N]    Ban an address and close its sessions
+  unban IP               Lift a ban
+  pool                   Show VIP pool usage
+
+Common flags:
+  -socket PATH   Admin socket (default $SLOPN_ADMIN_SOCKET or /var/run/slopn/admin.sock)
+  -secret PATH   Admin secret file (default $SLOPN_ADMIN_SECRET or /var/lib/slopn/admin.secret)
+`
+
+// runCtl implements the "ctl" subcommand and returns the process exit code
+func runCtl(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, ctlUsage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("ctl "+args[0], flag.ContinueOnError)
+	socket := fs.String("socket", getEnv("SLOPN_ADMIN_SOCKET", "/var/run/slopn/admin.sock"), "Admin socket")
+	secretFile := fs.String("secret", getEnv("SLOPN_ADMIN_SECRET", "/var/lib/slopn/admin.secret"), "Admin secret file")
+	minutes := fs.Int("minutes", 0, "Ban duration in minutes (default: the server's -ban-duration)")
+	ban := fs.Bool("ban", false, "kick: also ban the client's address")
+	positional, err := parseArgs(fs, args[1:])
+	if err != nil {
+		return 2
+	}
+
+	secret, err := os.ReadFile(*secretFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read admin secret: %v\n", err)
+		return 1
+	}
+	req := admin.Request{Command: admin.Command(args[0]), Secret: strings.TrimSpace(string(secret)), Minutes: *minutes, Ban: *ban}
+
+	switch req.Command {
+	case admin.CmdKick, admin.CmdBan, admin.CmdUnban:
+		if len(positional) != 1 {
+			fmt.Fprint(os.Stderr, ctlUsage)
+			return 2
+		}
+		req.VIP, req.IP = positional[0], positional[0]
+	case admin.CmdSessions, admin.CmdBans, admin.CmdPool:
+	default:
+		fmt.Fprint(os.Stderr, ctlUsage)
+		return 2
+	}
+
+	var out interface{}
+	switch req.Command {
+	case admin.CmdSessions:
+		out = &[]admin.SessionInfo{}
+	case admin.CmdBans:
+		out = &[]admin.BanInfo{}
+	case admin.CmdPool:
+		out = &admin.PoolInfo{}
+	}
+	msg, err := admin.Call(*socket, req, out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	switch v := out.(type) {
+	case *[]admin.SessionInfo:
+		fmt.Fprintln(w, "VIP\tVIP6\tREMOTE\tUSER\tDEVICE\tUPTIME\tIDLE\tRX\tTX")
+		for _, s := range *v {
+			idle := "-"
+			last := s.LastRx
+			if s.LastTx.After(last) {
+				last = s.LastTx
+			}
+			if !last.IsZero() {
+				idle = time.Since(last).Round(time.Second).String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.VIP, dash(s.VIP6), s.Remote, s.User, dash(s.Device),
+				time.Since(s.Connected).Round(time.Second), idle, formatBytes(s.RxBytes), formatBytes(s.TxBytes))
+		}
+	case *[]admin.BanInfo:
+		fmt.Fprintln(w, "ADDRESS\tEXPIRES\tFAILURES\tSTRIKES")
+		for _, b := range *v {
+			expires := "config"
+			if !b.Static {
+				expires = fmt.Sprintf("in %s", time.Until(b.Expires).Round(time.Second))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", b.IP, expires, b.Failures, b.Strikes)
+		}
+	case *admin.PoolInfo:
+		fmt.Fprintf(w, "Subnet:\t%s (server %s)\n", v.Subnet, v.ServerIP)
+		fmt.Fprintf(w, "Addresses:\t%d of %d in use\n", v.Used, v.Total)
+		fmt.Fprintf(w, "Sessions:\t%d\n", v.Sessions)
+	default:
+		fmt.Fprintln(w, msg)
+	}
+	return 0
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. "1.5 MiB"
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -5,6 +5,8 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -12,19 +14,25 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"runtime"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/quic-go/quic-go"
 	"github.com/songgao/water"
+	"github.com/webdunesurfer/SloPN/pkg/acl"
 	"github.com/webdunesurfer/SloPN/pkg/certutil"
 	"github.com/webdunesurfer/SloPN/pkg/iputil"
 	"github.com/webdunesurfer/SloPN/pkg/obfuscator"
 	"github.com/webdunesurfer/SloPN/pkg/protocol"
+	"github.com/webdunesurfer/SloPN/pkg/quota"
+	"github.com/webdunesurfer/SloPN/pkg/routes"
 	"github.com/webdunesurfer/SloPN/pkg/session"
+	"github.com/webdunesurfer/SloPN/pkg/shaper"
 	"github.com/webdunesurfer/SloPN/pkg/tunutil"
+	"github.com/webdunesurfer/SloPN/pkg/userdb"
 )
 
 func getEnv(key, fallback string) string {
@@ -44,74 +52,146 @@ func getEnvInt(key string, fallback int) int {
 }
 
 var (
+	cfgFile   = flag.String("config", getEnv("SLOPN_CONFIG", ""), "Path to server config file (JSON); reloaded on SIGHUP")
 	verbose   = flag.Bool("v", false, "Enable verbose logging")
 	subnet    = flag.String("subnet", getEnv("SLOPN_SUBNET", "10.100.0.0/24"), "VPN Subnet")
 	srvIP     = flag.String("ip", getEnv("SLOPN_IP", "10.100.0.1"), "Server Virtual IP")
+	subnet6   = flag.String("subnet6", getEnv("SLOPN_SUBNET6", ""), "IPv6 ULA prefix for dual-stack tunnels (e.g. fd00:5105::/64); empty disables")
 	port      = flag.Int("port", 4242, "UDP Port to listen on")
+	family    = flag.String("family", getEnv("SLOPN_FAMILY", "4"), "Listener transport family: 4, 6 or dual")
 	token     = flag.String("token", getEnv("SLOPN_TOKEN", "secret-token"), "Authentication token required for clients")
+	usersFile = flag.String("users", getEnv("SLOPN_USERS", ""), "Path to users database (JSON). Replaces the shared -token for logins")
+	obfsKey   = flag.String("obfs-secret", getEnv("SLOPN_OBFS_SECRET", ""), "Reality pre-shared secret (defaults to -token)")
+	dnsList   = flag.String("dns", getEnv("SLOPN_DNS", ""), "Comma-separated DNS servers pushed to clients (default: server VIP when -nat is on)")
+	dnsSearch = flag.String("dns-search", getEnv("SLOPN_DNS_SEARCH", ""), "Comma-separated DNS search domains pushed to clients")
+	dnsSplit  = flag.String("dns-domains", getEnv("SLOPN_DNS_DOMAINS", ""), "Comma-separated domains resolved via the VPN only (split-DNS)")
+	routeFile = flag.String("routes", getEnv("SLOPN_ROUTES", ""), "Path to pushed route policy (JSON)")
+	shapeFile = flag.String("shaping", getEnv("SLOPN_SHAPING", ""), "Path to per-user bandwidth limits (JSON)")
+	aclFile   = flag.String("acl", getEnv("SLOPN_ACL", ""), "Path to access control rules for client traffic (JSON)")
+	quotaFile = flag.String("quota-usage", getEnv("SLOPN_QUOTA_USAGE", "/var/lib/slopn/quota.json"), "Path to persisted data quota usage (empty keeps it in memory)")
+	resvFile  = flag.String("reservations", getEnv("SLOPN_RESERVATIONS", ""), "Path to static VIP reservations (JSON)")
+	leaseFile = flag.String("leases", getEnv("SLOPN_LEASES", "/var/lib/slopn/leases.json"), "Path to persisted sticky leases (empty disables)")
+	certFile  = flag.String("cert", getEnv("SLOPN_CERT", "/var/lib/slopn/server.crt"), "TLS certificate (generated on first start; empty uses a throwaway cert)")
+	keyFile   = flag.String("key", getEnv("SLOPN_KEY", "/var/lib/slopn/server.key"), "TLS private key for -cert")
+	clientCA  = flag.String("client-ca", getEnv("SLOPN_CLIENT_CA", ""), "CA certificate for client certificates; when set, clients must present one (mutual TLS)")
+	crlFile   = flag.String("crl", getEnv("SLOPN_CRL", ""), "Certificate revocation list for -client-ca (PEM or DER)")
+	certAuth  = flag.String("client-auth", getEnv("SLOPN_CLIENT_AUTH", CertAndToken), "With -client-ca: \"cert+token\" also requires the user's token, \"cert\" accepts the certificate alone")
 	enableNAT = flag.Bool("nat", false, "Enable NAT (MASQUERADE) for internet access")
 	obfs      = flag.Bool("obfs", true, "Enable protocol obfuscation (Reality-style)")
+	obfsV1    = flag.Bool("obfs-legacy", false, "Also accept v1 (XOR-masked) Reality headers from clients not yet updated; enable only while upgrading")
 	mimic     = flag.String("mimic", getEnv("SLOPN_MIMIC", "www.google.com:443"), "Target server to mimic for unauthorized probes")
 
 	// Rate Limiting Config
 	maxAttempts = flag.Int("max-attempts", getEnvInt("SLOPN_MAX_ATTEMPTS", 5), "Maximum failed attempts before ban")
 	windowMins  = flag.Int("window", getEnvInt("SLOPN_WINDOW", 5), "Window in minutes for failed attempts")
 	banMins     = flag.Int("ban-duration", getEnvInt("SLOPN_BAN_DURATION", 60), "Ban duration in minutes")
+	maxBanMins  = flag.Int("max-ban-duration", getEnvInt("SLOPN_MAX_BAN_DURATION", 7*24*60), "Longest ban in minutes; each repeat ban doubles -ban-duration up to this")
+	banFile     = flag.String("ban-file", getEnv("SLOPN_BAN_FILE", "/var/lib/slopn/bans.json"), "Path to persisted bans (empty keeps them in memory)")
+
+	// Admin API
+	adminSocket = flag.String("admin", getEnv("SLOPN_ADMIN_SOCKET", "/var/run/slopn/admin.sock"), "Unix socket for the admin API (empty disables)")
+	adminSecret = flag.String("admin-secret", getEnv("SLOPN_ADMIN_SECRET", "/var/lib/slopn/admin.secret"), "File holding the admin API secret (generated on first start)")
+
+	// Monitoring
+	metricsAddr = flag.String("metrics", getEnv("SLOPN_METRICS", ""), "Listen address for the Prometheus /metrics endpoint, e.g. 127.0.0.1:9100 (empty disables)")
 )
 
 const ServerVersion = "0.9.9"
 
-type RateLimiter struct {
-	mu       sync.Mutex
-	attempts map[string][]time.Time // IP -> List of failure timestamps
-	banned   map[string]time.Time   // IP -> Ban expiration time
-}
+// DefaultUser is the identity given to clients authenticated by the shared -token
+const DefaultUser = "default"
+
+// -client-auth modes
+const (
+	CertAndToken = "cert+token" // The certificate names the user, the token proves it as usual
+	CertOnly     = "cert"       // The certificate alone authenticates its user
+)
 
-func NewRateLimiter() *RateLimiter {
-	return &RateLimiter{
-		attempts: make(map[string][]time.Time),
-		banned:   make(map[string]time.Time),
+// authenticate resolves a login request to a user account.
+// A verified client certificate names the user; unless certOnly, the login
+// must also carry that user's token (the shared -token without a users
+// database). Without a certificate, the shared -token is accepted as DefaultUser.
+func authenticate(users *userdb.Store, req protocol.LoginRequest, certUser string, certOnly bool) (*userdb.User, error) {
+	if certUser != "" {
+		if req.User != "" && req.User != certUser {
+			return nil, userdb.ErrInvalidCredentials
+		}
+		switch {
+		case certOnly && users == nil:
+			return &userdb.User{Name: certUser, Enabled: true}, nil
+		case certOnly:
+			return users.Lookup(certUser)
+		case users == nil:
+			if !sharedToken(req.Token) {
+				return nil, userdb.ErrInvalidCredentials
+			}
+			return &userdb.User{Name: certUser, Enabled: true}, nil
+		}
+		return users.Authenticate(certUser, req.Token)
+	}
+	if users == nil {
+		if !sharedToken(req.Token) {
+			return nil, userdb.ErrInvalidCredentials
+		}
+		return &userdb.User{Name: DefaultUser, Enabled: true}, nil
 	}
+	return users.Authenticate(req.User, req.Token)
 }
 
-func (rl *RateLimiter) IsBanned(ip string) bool {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
+// sharedToken reports whether token is the shared -token
+func sharedToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(settings().token)) == 1
+}
 
-	expiry, exists := rl.banned[ip]
-	if !exists {
-		return false
+// resumeSession redeems the login's resumption ticket, if any. It returns nil
+// when there is no ticket or it cannot be used; the caller then falls back to
+// token authentication.
+func resumeSession(conn *quic.Conn, req protocol.LoginRequest, sm *session.Manager, users *userdb.Store, quotas *quotaEnforcer, certUser string) (*session.Session, *userdb.User) {
+	if req.ResumeTicket == "" {
+		return nil, nil
+	}
+	sess, old, err := sm.Resume(req.ResumeTicket, certUser, conn)
+	if err != nil {
+		return nil, nil
+	}
+	if old != nil {
+		old.CloseWithError(0, "superseded")
 	}
 
-	if time.Now().After(expiry) {
-		delete(rl.banned, ip)
-		delete(rl.attempts, ip)
-		return false
+	// The account may have been disabled or used up its quota since the
+	// ticket was issued
+	account := &userdb.User{Name: sess.User, Enabled: true}
+	if users != nil {
+		if account, err = users.Lookup(sess.User); err != nil || quotas.blocked(account) {
+			sm.RemoveSession(sess.VIP.String(), conn)
+			return nil, nil
+		}
 	}
-	return true
+	counters.resumed.Add(1)
+	logServer("RESUMED", sess.VIP.String(), conn.RemoteAddr().String(), "User: "+sess.User)
+	return sess, account
 }
 
-func (rl *RateLimiter) RecordFailure(ip string) {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-
-	now := time.Now()
-	rl.attempts[ip] = append(rl.attempts[ip], now)
-
-	// Keep only attempts within the window
-	window := time.Duration(*windowMins) * time.Minute
-	var recent []time.Time
-	for _, t := range rl.attempts[ip] {
-		if now.Sub(t) < window {
-			recent = append(recent, t)
+// dropRevoked closes sessions whose client certificate is now on the CRL
+func dropRevoked(sm *session.Manager, clientAuth *certutil.ClientAuth) {
+	for _, s := range sm.Sessions() {
+		peers := s.Conn.ConnectionState().TLS.PeerCertificates
+		if len(peers) > 0 && clientAuth.Revoked(peers[0].SerialNumber) {
+			logServer("REVOKED", s.VIP.String(), s.Conn.RemoteAddr().String(), fmt.Sprintf("User: %s; Cert: %s", s.User, peers[0].SerialNumber.Text(16)))
+			s.Conn.CloseWithError(1, "certificate revoked")
 		}
 	}
-	rl.attempts[ip] = recent
+}
 
-	if len(rl.attempts[ip]) >= *maxAttempts {
-		rl.banned[ip] = now.Add(time.Duration(*banMins) * time.Minute)
-		logServer("BAN", "---", ip, fmt.Sprintf("Duration: %dm; Attempts: %d", *banMins, len(rl.attempts[ip])))
+// splitList parses a comma-separated flag value, dropping empty entries
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
 	}
+	return out
 }
 
 // Log formats: TIMESTAMP,EVENT,VIP,REMOTE_ADDR,DETAILS
@@ -120,14 +200,144 @@ func logServer(event, vip, remote, details string) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		os.Exit(runCA(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
+	}
 	flag.Parse()
 
+	var cfg *Config
+	if *cfgFile != "" {
+		var err error
+		if cfg, err = loadConfig(*cfgFile); err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+		cfg.applyFlags()
+		fmt.Printf("Loaded config from %s\n", *cfgFile)
+	}
+	var bans, allow []string
+	if cfg != nil {
+		bans, allow = cfg.RateLimit.Bans, cfg.RateLimit.Allow
+	}
+	initial, err := settingsFromFlags(bans, allow)
+	if err != nil {
+		log.Fatalf("Invalid bans or allow list: %v", err)
+	}
+	live.Store(initial)
+
 	sm, err := session.NewManager(*subnet, *srvIP)
 	if err != nil {
 		log.Fatalf("Failed to initialize session manager: %v", err)
 	}
+	for _, d := range splitList(*dnsList) {
+		if net.ParseIP(d) == nil {
+			log.Fatalf("Invalid -dns server: %s", d)
+		}
+	}
+	if *subnet6 != "" {
+		if err := sm.EnableIPv6(*subnet6); err != nil {
+			log.Fatalf("Failed to enable IPv6: %v", err)
+		}
+	}
+	if *resvFile != "" {
+		if err := sm.LoadReservations(*resvFile); err != nil {
+			log.Fatalf("Failed to load VIP reservations: %v", err)
+		}
+	}
+	if *leaseFile != "" {
+		if err := sm.EnableLeases(*leaseFile); err != nil {
+			fmt.Printf("Warning: could not load leases from %s: %v\n", *leaseFile, err)
+		}
+	}
 
 	rl := NewRateLimiter()
+	if *banFile != "" {
+		if err := rl.LoadBans(*banFile); err != nil {
+			fmt.Printf("Warning: could not load bans from %s: %v\n", *banFile, err)
+		}
+	}
+	go rl.run()
+
+	var users *userdb.Store
+	if cfg != nil && len(cfg.Auth.Users) > 0 {
+		users, err = userdb.New(cfg.Auth.Users)
+		if err != nil {
+			log.Fatalf("Failed to load users: %v", err)
+		}
+		fmt.Printf("Loaded %d users from %s\n", users.Count(), *cfgFile)
+	} else if *usersFile != "" {
+		users, err = userdb.Load(*usersFile)
+		if err != nil {
+			log.Fatalf("Failed to load users database: %v", err)
+		}
+		fmt.Printf("Loaded %d users from %s\n", users.Count(), *usersFile)
+	}
+
+	var clientAuth *certutil.ClientAuth
+	if *clientCA != "" {
+		if *certAuth != CertAndToken && *certAuth != CertOnly {
+			log.Fatalf("-client-auth must be %q or %q, not %q", CertAndToken, CertOnly, *certAuth)
+		}
+		clientAuth, err = certutil.LoadClientAuth(*clientCA, *crlFile)
+		if err != nil {
+			log.Fatalf("Failed to load client CA: %v", err)
+		}
+		fmt.Printf("Client certificates required (CA: %s, revoked: %d, mode: %s)\n", *clientCA, clientAuth.RevokedCount(), *certAuth)
+	}
+
+	var routeTable *routes.Table
+	if cfg != nil && !cfg.Routes.IsEmpty() {
+		if routeTable, err = routes.New(cfg.Routes.File); err != nil {
+			log.Fatalf("Failed to load route policy: %v", err)
+		}
+		fmt.Printf("Loaded route policy from %s\n", *cfgFile)
+	} else if *routeFile != "" {
+		routeTable, err = routes.Load(*routeFile)
+		if err != nil {
+			log.Fatalf("Failed to load route policy: %v", err)
+		}
+		fmt.Printf("Loaded route policy from %s\n", *routeFile)
+	}
+
+	var shaping *shaper.Policy
+	if cfg != nil && !cfg.Shaping.IsEmpty() {
+		if shaping, err = shaper.New(cfg.Shaping.File); err != nil {
+			log.Fatalf("Failed to load shaping policy: %v", err)
+		}
+		fmt.Printf("Loaded shaping policy from %s\n", *cfgFile)
+	} else if *shapeFile != "" {
+		shaping, err = shaper.Load(*shapeFile)
+		if err != nil {
+			log.Fatalf("Failed to load shaping policy: %v", err)
+		}
+		fmt.Printf("Loaded shaping policy from %s\n", *shapeFile)
+	} else {
+		shaping, _ = shaper.New(shaper.File{}) // Unlimited, but quotas may throttle sessions
+	}
+
+	var filter *acl.Policy
+	if cfg != nil && !cfg.ACL.IsEmpty() {
+		if filter, err = acl.New(cfg.ACL.File); err != nil {
+			log.Fatalf("Failed to load ACL: %v", err)
+		}
+		fmt.Printf("Loaded ACL from %s\n", *cfgFile)
+	} else if *aclFile != "" {
+		filter, err = acl.Load(*aclFile)
+		if err != nil {
+			log.Fatalf("Failed to load ACL: %v", err)
+		}
+		fmt.Printf("Loaded ACL from %s\n", *aclFile)
+	}
+
+	usage, err := quota.Load(*quotaFile)
+	if err != nil {
+		fmt.Printf("Warning: could not load quota usage from %s: %v\n", *quotaFile, err)
+		usage, _ = quota.Load("")
+	}
+	quotas := newQuotaEnforcer(usage, users, shaping)
+	go quotas.run(sm)
 
 	if runtime.GOOS == "linux" {
 		// Only attempt deletion if it exists to avoid noisy 255 exits
@@ -147,9 +357,13 @@ func main() {
 		Name: "tun0",
 		Addr: sm.GetServerIP().String(),
 		Peer: "10.100.0.2",
-		Mask: "255.255.255.0",
+		Mask: net.IP(sm.Subnet().Mask).String(),
 		MTU:  1100,
 	}
+	if ip6 := sm.GetServerIP6(); ip6 != nil {
+		tunCfg.Addr6 = ip6.String()
+		tunCfg.Prefix6 = sm.Prefix6Len()
+	}
 	ifce, err := tunutil.CreateInterface(tunCfg)
 	if err != nil {
 		log.Fatalf("Error creating TUN: %v", err)
@@ -162,6 +376,9 @@ func main() {
 		exec.Command("sysctl", "-w", "net.ipv4.conf.default.rp_filter=0").Run()
 		exec.Command("sysctl", "-w", fmt.Sprintf("net.ipv4.conf.%s.rp_filter=0", ifce.Name())).Run()
 		exec.Command("sysctl", "-w", fmt.Sprintf("net.ipv4.conf.%s.accept_local=1", ifce.Name())).Run()
+		if *subnet6 != "" {
+			exec.Command("sysctl", "-w", "net.ipv6.conf.all.forwarding=1").Run()
+		}
 
 		if *enableNAT {
 			fmt.Println("Enabling NAT (MASQUERADE)...")
@@ -171,6 +388,11 @@ func main() {
 				exec.Command("iptables", "-t", "nat", "-A", "POSTROUTING", "-s", *subnet, "-o", ifaceName, "-j", "MASQUERADE").Run()
 				exec.Command("iptables", "-A", "FORWARD", "-i", "tun0", "-j", "ACCEPT").Run()
 				exec.Command("iptables", "-A", "FORWARD", "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT").Run()
+				if *subnet6 != "" {
+					exec.Command("ip6tables", "-t", "nat", "-A", "POSTROUTING", "-s", *subnet6, "-o", ifaceName, "-j", "MASQUERADE").Run()
+					exec.Command("ip6tables", "-A", "FORWARD", "-i", "tun0", "-j", "ACCEPT").Run()
+					exec.Command("ip6tables", "-A", "FORWARD", "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT").Run()
+				}
 				fmt.Printf("NAT enabled on interface: %s\n", ifaceName)
 
 				// DNS REDIRECTION:
@@ -187,20 +409,63 @@ func main() {
 		}
 	}
 
-	tlsConfig, err := certutil.GenerateSelfSignedConfig()
-	if err != nil {
-		log.Fatal(err)
+	var tlsConfig *tls.Config
+	if *certFile != "" {
+		cert, err := certutil.LoadOrCreate(*certFile, *keyFile)
+		if err != nil {
+			log.Fatalf("Failed to load TLS identity: %v", err)
+		}
+		fp, err := certutil.LeafFingerprint(cert)
+		if err != nil {
+			log.Fatalf("Failed to read TLS certificate: %v", err)
+		}
+		tlsConfig = certutil.ServerConfig(cert)
+		fmt.Printf("Server certificate fingerprint: %s\n", fp)
+	} else {
+		tlsConfig, err = certutil.GenerateSelfSignedConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Warning: using a throwaway TLS certificate; clients cannot pin this server")
+	}
+	if clientAuth != nil {
+		clientAuth.Apply(tlsConfig)
 	}
 
-	udpConn, err := net.ListenPacket("udp4", fmt.Sprintf("0.0.0.0:%d", *port))
+	var network, bindAddr string
+	switch *family {
+	case "4":
+		network, bindAddr = "udp4", "0.0.0.0"
+	case "6":
+		network, bindAddr = "udp6", "::"
+	case "dual":
+		network, bindAddr = "udp", "::"
+	default:
+		log.Fatalf("Invalid -family %q (expected 4, 6 or dual)", *family)
+	}
+	udpConn, err := net.ListenPacket(network, net.JoinHostPort(bindAddr, fmt.Sprint(*port)))
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	var finalConn net.PacketConn = udpConn
+	// Banned and denied sources are rejected per packet, before the QUIC
+	// handshake: mirrored to the mimic target with Reality, else dropped
+	var finalConn net.PacketConn
+	var reality *obfuscator.RealityConn
+	var refused func() uint64
 	if *obfs {
 		fmt.Printf("Protocol Obfuscation (Reality) enabled. Mimicking: %s\n", *mimic)
-		finalConn = obfuscator.NewRealityConn(udpConn, *token, *mimic)
+		secret := *obfsKey
+		if secret == "" {
+			secret = *token
+		}
+		reality = obfuscator.NewRealityConn(udpConn, secret, *mimic)
+		reality.SetRefuse(rl.Refuses)
+		reality.SetLegacy(*obfsV1)
+		finalConn, refused = reality, reality.Refused
+	} else {
+		filtered := obfuscator.NewFilterConn(udpConn, rl.Refuses)
+		finalConn, refused = filtered, filtered.Refused
 	}
 
 	listener, err := quic.Listen(finalConn, tlsConfig, &quic.Config{
@@ -212,7 +477,80 @@ func main() {
 	}
 	defer listener.Close()
 
-	fmt.Printf("SloPN Server v%s listening on :%d (VIP: %s)\n", ServerVersion, *port, sm.GetServerIP())
+	// SIGHUP reloads the config file, users, routes, shaping, the ACL and the CRL without
+	// dropping sessions (except those whose certificate has been revoked)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if cfg != nil {
+				reloadConfig(cfg, users, routeTable, shaping, filter, reality)
+			}
+			if users != nil {
+				if err := users.Reload(); err != nil {
+					logServer("RELOAD_FAILED", "---", "---", fmt.Sprintf("users: %v", err))
+				} else {
+					logServer("RELOAD", "---", "---", fmt.Sprintf("users: %d", users.Count()))
+				}
+			}
+			if routeTable != nil {
+				if err := routeTable.Reload(); err != nil {
+					logServer("RELOAD_FAILED", "---", "---", fmt.Sprintf("routes: %v", err))
+				} else {
+					logServer("RELOAD", "---", "---", "routes")
+				}
+			}
+			if err := shaping.Reload(); err != nil {
+				logServer("RELOAD_FAILED", "---", "---", fmt.Sprintf("shaping: %v", err))
+			} else {
+				reshape(sm, users, shaping)
+				if *shapeFile != "" {
+					logServer("RELOAD", "---", "---", "shaping")
+				}
+			}
+			if filter != nil && *aclFile != "" {
+				if err := filter.Reload(); err != nil {
+					logServer("RELOAD_FAILED", "---", "---", fmt.Sprintf("acl: %v", err))
+				} else {
+					logServer("RELOAD", "---", "---", "acl")
+				}
+			}
+			if clientAuth != nil && *crlFile != "" {
+				if err := clientAuth.Reload(); err != nil {
+					logServer("RELOAD_FAILED", "---", "---", fmt.Sprintf("crl: %v", err))
+				} else {
+					logServer("RELOAD", "---", "---", fmt.Sprintf("crl: %d revoked", clientAuth.RevokedCount()))
+					dropRevoked(sm, clientAuth)
+				}
+			}
+		}
+	}()
+
+	// SIGINT and SIGTERM persist the quota usage charged since the last tick before exiting
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-stop
+		quotas.flush(sm)
+		logServer("SHUTDOWN", "---", "---", sig.String())
+		os.Exit(0)
+	}()
+
+	if *adminSocket != "" {
+		if err := serveAdmin(*adminSocket, *adminSecret, sm, rl); err != nil {
+			fmt.Printf("Warning: admin API disabled: %v\n", err)
+		}
+	}
+	if *metricsAddr != "" {
+		if err := serveMetrics(*metricsAddr, sm, rl, shaping, filter, reality, refused); err != nil {
+			fmt.Printf("Warning: metrics endpoint disabled: %v\n", err)
+		}
+	}
+
+	fmt.Printf("SloPN Server v%s listening on %s (VIP: %s)\n", ServerVersion, udpConn.LocalAddr(), sm.GetServerIP())
+	if ip6 := sm.GetServerIP6(); ip6 != nil {
+		fmt.Printf("IPv6 enabled (VIP6: %s/%d)\n", ip6, sm.Prefix6Len())
+	}
 
 	// TUN -> QUIC loop
 	go func() {
@@ -226,12 +564,17 @@ func main() {
 			summary := iputil.FormatPacketSummary(packet[:n])
 			destIP := iputil.GetDestinationIP(packet[:n])
 
-			if conn, ok := sm.GetSession(destIP.String()); ok {
+			if conn, traffic, ok := sm.Target(destIP.String()); ok {
 				if *verbose {
 					fmt.Printf("TUN READ: %s\n", summary)
 				}
 				payload := iputil.StripHeader(packet[:n])
-				err = conn.SendDatagram(payload)
+				if filter != nil {
+					if s, ok := sm.Lookup(destIP.String()); ok {
+						filter.Seen(s.VIP.String(), payload) // Let the client reply
+					}
+				}
+				err = sendToClient(conn, traffic, shaping, payload, &counters.tunIn)
 				if err != nil && *verbose {
 					log.Printf("QUIC Send error: %v", err)
 				}
@@ -244,19 +587,24 @@ func main() {
 		if err != nil {
 			continue
 		}
-		go handleConnection(conn, ifce, sm, rl)
+		// Its addresses must pass FPO again for the next connection
+		if reality != nil {
+			go forgetPaths(conn, reality.Forget)
+		}
+		// Catches handshakes that were under way when the ban was imposed
+		if remoteIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); rl.IsBanned(remoteIP) {
+			fmt.Printf("[SECURITY] Refused connection from banned IP: %s\n", remoteIP)
+			counters.refused.Add(1)
+			conn.CloseWithError(0x03, "banned")
+			continue
+		}
+		go handleConnection(conn, ifce, sm, rl, users, routeTable, shaping, filter, quotas)
 	}
 }
 
-func handleConnection(conn *quic.Conn, ifce *water.Interface, sm *session.Manager, rl *RateLimiter) {
+func handleConnection(conn *quic.Conn, ifce *water.Interface, sm *session.Manager, rl *RateLimiter, users *userdb.Store, routeTable *routes.Table, shaping *shaper.Policy, filter *acl.Policy, quotas *quotaEnforcer) {
 	remoteIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 
-	if rl.IsBanned(remoteIP) {
-		fmt.Printf("[SECURITY] Refused connection from banned IP: %s\n", remoteIP)
-		conn.CloseWithError(0x03, "banned")
-		return
-	}
-
 	stream, err := conn.AcceptStream(context.Background())
 	if err != nil {
 		return
@@ -268,57 +616,131 @@ func handleConnection(conn *quic.Conn, ifce *water.Interface, sm *session.Manage
 		return
 	}
 
-	// Validate Token
-	if loginReq.Token != *token {
-		remoteIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-		logServer("AUTH_FAILURE", "---", remoteIP, "")
-		rl.RecordFailure(remoteIP)
-		resp := protocol.LoginResponse{
-			Type:          protocol.MessageTypeLoginResponse,
-			Status:        "error",
-			Message:       "Invalid authentication token",
-			ServerVersion: ServerVersion,
+	// With -client-ca the handshake has already verified the certificate
+	certUser, certSerial := certutil.PeerIdentity(conn.ConnectionState().TLS)
+
+	// A valid resumption ticket re-binds the existing session (and VIP) to
+	// this connection without a full re-auth, e.g. after the client roamed
+	sess, account := resumeSession(conn, loginReq, sm, users, quotas, certUser)
+
+	if sess == nil {
+		// Validate credentials
+		var err error
+		account, err = authenticate(users, loginReq, certUser, *certAuth == CertOnly)
+		if err != nil {
+			logServer("AUTH_FAILURE", "---", remoteIP, fmt.Sprintf("User: %s; Reason: %v", loginReq.User, err))
+			rl.RecordFailure(remoteIP)
+			counters.authFailure.Add(1)
+			msg := "Invalid authentication token"
+			if err == userdb.ErrDisabled {
+				msg = "Account disabled"
+			} else if err == userdb.ErrExpired {
+				msg = "Account expired"
+			}
+			resp := protocol.LoginResponse{
+				Type:          protocol.MessageTypeLoginResponse,
+				Status:        "error",
+				Message:       msg,
+				Reason:        protocol.LoginDenied,
+				ServerVersion: ServerVersion,
+			}
+			json.NewEncoder(stream).Encode(resp)
+			conn.CloseWithError(1, "unauthorized")
+			return
+		}
+
+		user := account.Name
+		if quotas.blocked(account) {
+			logServer("QUOTA_REFUSED", "---", remoteIP, "User: "+user)
+			resp := protocol.LoginResponse{
+				Type:          protocol.MessageTypeLoginResponse,
+				Status:        "error",
+				Message:       "Data quota exceeded",
+				ServerVersion: ServerVersion,
+			}
+			json.NewEncoder(stream).Encode(resp)
+			conn.CloseWithError(quotaExceededCloseErr, "quota exceeded")
+			return
 		}
-		json.NewEncoder(stream).Encode(resp)
-		conn.CloseWithError(1, "unauthorized")
-		return
-	}
 
-	vip, err := sm.AllocateIP()
-	if err != nil {
-		fmt.Printf("IP allocation failed for %v: %v\n", conn.RemoteAddr(), err)
-		resp := protocol.LoginResponse{
-			Type:          protocol.MessageTypeLoginResponse,
-			Status:        "error",
-			Message:       "Server failed to allocate IP",
-			ServerVersion: ServerVersion,
-		}
-		json.NewEncoder(stream).Encode(resp)
-		conn.CloseWithError(2, "ip allocation failed")
-		return
+		// A reconnecting client gets its old VIP back even if the previous
+		// connection has not timed out yet
+		if loginReq.PreviousVIP != "" {
+			if old, ok := sm.TakeOver(loginReq.PreviousVIP, user, loginReq.DeviceID); ok {
+				old.CloseWithError(0, "superseded")
+				logServer("SUPERSEDED", loginReq.PreviousVIP, old.RemoteAddr().String(), "User: "+user)
+			}
+		}
+
+		vip, err := sm.AllocateIP(user, loginReq.DeviceID, loginReq.PreviousVIP)
+		if err != nil {
+			fmt.Printf("IP allocation failed for %v (user %s): %v\n", conn.RemoteAddr(), user, err)
+			resp := protocol.LoginResponse{
+				Type:          protocol.MessageTypeLoginResponse,
+				Status:        "error",
+				Message:       "Server failed to allocate IP",
+				ServerVersion: ServerVersion,
+			}
+			json.NewEncoder(stream).Encode(resp)
+			conn.CloseWithError(2, "ip allocation failed")
+			return
+		}
+		sess = sm.AddSession(vip, conn, user, loginReq.DeviceID)
+		counters.authSuccess.Add(1)
+		details := "User: " + user
+		if certSerial != "" {
+			details += "; Cert: " + certSerial
+		}
+		logServer("CONNECTED", vip.String(), conn.RemoteAddr().String(), details)
 	}
+	vip, user := sess.VIP, sess.User
+	shaping.Apply(&sess.Traffic.Limits, user, account.Groups)
 
 	resp := protocol.LoginResponse{
 		Type: protocol.MessageTypeLoginResponse, Status: "success",
 		AssignedVIP: vip.String(), ServerVIP: sm.GetServerIP().String(),
+		SubnetMask:    net.IP(sm.Subnet().Mask).String(),
+		ResumeTicket:  sess.Ticket,
 		ServerVersion: ServerVersion,
 	}
+	if vip6 := sm.MapIPv6(vip); vip6 != nil {
+		resp.AssignedVIP6 = vip6.String()
+		resp.ServerVIP6 = sm.GetServerIP6().String()
+		resp.Prefix6Len = sm.Prefix6Len()
+	}
+	cfg := settings()
+	resp.DNSServers = cfg.dnsServers
+	if len(resp.DNSServers) == 0 && *enableNAT {
+		resp.DNSServers = []string{sm.GetServerIP().String()} // Redirected to CoreDNS
+	}
+	resp.DNSSearch = cfg.dnsSearch
+	resp.DNSDomains = cfg.dnsDomains
+	if routeTable != nil {
+		policy := routeTable.For(account.Groups)
+		resp.Routes = policy.Routes
+		resp.ExcludeRoutes = policy.Exclude
+	}
 	json.NewEncoder(stream).Encode(resp)
 
-	sm.AddSession(vip, conn)
-	logServer("CONNECTED", vip.String(), conn.RemoteAddr().String(), "")
+	// Report the quota right away and throttle if it is already used up.
+	// Resume may swap sess.Conn concurrently, so pass this connection.
+	current := session.Session{Conn: conn, VIP: vip, VIP6: sess.VIP6, User: user, Traffic: sess.Traffic}
+	quotas.check(&current, true)
 
 	ctx := conn.Context()
+	traffic := sess.Traffic
 	go func() {
 		defer func() {
-			sm.RemoveSession(vip.String())
-			logServer("DISCONNECTED", vip.String(), conn.RemoteAddr().String(), "")
-		}()
-		for {
-			data, err := conn.ReceiveDatagram(ctx)
-			if err != nil {
-				return
+			quotas.charge(&current)
+			sm.RemoveSession(vip.String(), conn)
+			if _, resumed := sm.Lookup(vip.String()); filter != nil && !resumed {
+				filter.Forget(vip.String())
 			}
+			logServer("DISCONNECTED", vip.String(), conn.RemoteAddr().String(),
+				fmt.Sprintf("User: %s; Duration: %s; %s", user, time.Since(sess.Connected).Round(time.Second), traffic))
+		}()
+		// forward routes an accepted client packet to another client or the TUN
+		forward := func(data []byte) {
 			// Only log data path in verbose mode
 			if *verbose {
 				fmt.Printf("QUIC RECV [%s]: %s\n", vip, iputil.FormatPacketSummary(data))
@@ -327,22 +749,61 @@ func handleConnection(conn *quic.Conn, ifce *water.Interface, sm *session.Manage
 			// OPTIMIZATION: Spoke-to-Spoke Fast Path
 			// If destination is another client, route directly without TUN
 			destIP := iputil.GetDestinationIP(data)
-			if destIP != nil && !destIP.Equal(sm.GetServerIP()) {
-				if targetConn, ok := sm.GetSession(destIP.String()); ok {
+			if destIP != nil && !sm.IsServerIP(destIP) {
+				if targetConn, target, ok := sm.Target(destIP.String()); ok {
 					if *verbose {
 						fmt.Printf("  -> FAST-PATH: %s -> %s\n", vip, destIP)
 					}
-					targetConn.SendDatagram(data)
-					continue
+					sendToClient(targetConn, target, shaping, data, &counters.fastPath)
+					return
 				}
 			}
 
 			// Always use false here because we pre-create tun0 with 'nopi'
 			payload := iputil.AddHeader(data, false)
-			_, err = ifce.Write(payload)
-			if err != nil && *verbose {
-				log.Printf("TUN Write error: %v (Hex: %s)", err, iputil.HexDump(payload))
+			_, err := ifce.Write(payload)
+			if err == nil {
+				counters.tunOut.Add(1)
+			} else {
+				counters.tunWriteErrors.Add(1)
+				if *verbose {
+					log.Printf("TUN Write error: %v (Hex: %s)", err, iputil.HexDump(payload))
+				}
+			}
+		}
+		spoofLogged := false // Logged once per connection
+		for {
+			data, err := conn.ReceiveDatagram(ctx)
+			if err != nil {
+				return
+			}
+			if spoofed(&current, data) {
+				counters.spoofed.Add(1)
+				// Link-local and unspecified sources (router solicitations, DAD) are only counted
+				if src := iputil.GetSourceIP(data); !spoofLogged && src != nil && !src.IsLinkLocalUnicast() && !src.IsUnspecified() {
+					spoofLogged = true
+					logServer("SPOOFED", vip.String(), conn.RemoteAddr().String(),
+						fmt.Sprintf("User: %s; Packet: %s", user, iputil.FormatPacketSummary(data)))
+				}
+				continue
+			}
+			// Applies to both the fast path and the TUN path
+			if aclDrops(filter, users, sm, &current, data) {
+				continue
+			}
+			wait, ok := shaping.Allow(&traffic.Limits, shaper.Up, len(data))
+			if !ok {
+				continue
+			}
+			// Counted past the drops, so totals and quotas only see forwarded traffic
+			traffic.Received(len(data))
+			if wait > 0 {
+				// Held back on a timer like downstream, so the connection's reads never
+				// block. Each datagram is a fresh slice, so data needs no copy.
+				time.AfterFunc(wait, func() { forward(data) })
+				continue
 			}
+			forward(data)
 		}
 	}()
 	<-ctx.Done()
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/webdunesurfer/SloPN/pkg/protocol"
+	"github.com/webdunesurfer/SloPN/pkg/userdb"
+)
+
+func TestAuthenticate(t *testing.T) {
+	useSettings(t, &liveSettings{token: "shared"})
+	users, err := userdb.New([]*userdb.User{
+		{Name: "alice", TokenHash: userdb.HashToken("a"), Enabled: true},
+		{Name: "bob", TokenHash: userdb.HashToken("b"), Enabled: true},
+		{Name: "carol", TokenHash: userdb.HashToken("c")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		users    *userdb.Store
+		user     string // In the login request
+		token    string
+		certUser string
+		certOnly bool
+		want     string // Resulting user, empty if refused
+	}{
+		{"shared token", nil, "", "shared", "", false, DefaultUser},
+		{"wrong shared token", nil, "", "nope", "", false, ""},
+		{"user token", users, "", "a", "", false, "alice"},
+
+		{"cert and shared token", nil, "", "shared", "dev1", false, "dev1"},
+		{"cert without shared token", nil, "", "", "dev1", false, ""},
+		{"cert and own token", users, "", "a", "alice", false, "alice"},
+		{"cert and named own token", users, "alice", "a", "alice", false, "alice"},
+		{"cert without token", users, "", "", "alice", false, ""},
+		{"cert and someone else's token", users, "", "b", "alice", false, ""},
+		{"cert and name mismatch", users, "bob", "b", "alice", false, ""},
+		{"cert of disabled user", users, "", "c", "carol", false, ""},
+
+		{"cert only", users, "", "", "alice", true, "alice"},
+		{"cert only, no database", nil, "", "", "dev1", true, "dev1"},
+		{"cert only, unknown user", users, "", "", "mallory", true, ""},
+		{"cert only, disabled user", users, "", "", "carol", true, ""},
+		{"cert only, name mismatch", users, "bob", "", "alice", true, ""},
+	}
+	for _, tt := range tests {
+		req := protocol.LoginRequest{User: tt.user, Token: tt.token}
+		u, err := authenticate(tt.users, req, tt.certUser, tt.certOnly)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("%s: accepted as %s", tt.name, u.Name)
+		case tt.want != "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.want != "" && u.Name != tt.want:
+			t.Errorf("%s: user %s, want %s", tt.name, u.Name, tt.want)
+		}
+	}
+
+	if _, err := authenticate(users, protocol.LoginRequest{Token: "c"}, "carol", false); !errors.Is(err, userdb.ErrDisabled) {
+		t.Errorf("disabled account: %v, want %v", err, userdb.ErrDisabled)
+	}
+}
@@ -0,0 +1,168 @@
+// Author: webdunesurfer <vkh@gmx.at>
+// Licensed under the GNU General Public License v3.0
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/webdunesurfer/SloPN/pkg/acl"
+	"github.com/webdunesurfer/SloPN/pkg/obfuscator"
+	"github.com/webdunesurfer/SloPN/pkg/session"
+	"github.com/webdunesurfer/SloPN/pkg/shaper"
+)
+
+// counters are the server-wide event counters exported on /metrics. Gauges
+// (sessions, pool, bans, ...) are read from their owners at scrape time.
+var counters struct {
+	authSuccess    atomic.Uint64
+	authFailure    atomic.Uint64
+	resumed        atomic.Uint64
+	bans           atomic.Uint64
+	refused        atomic.Uint64 // Connections from banned addresses
+	sendErrors     atomic.Uint64
+	tunWriteErrors atomic.Uint64
+	fastPath       atomic.Uint64 // Spoke-to-spoke packets
+	tunOut         atomic.Uint64 // Client packets written to the TUN device
+	tunIn          atomic.Uint64 // TUN packets sent to a client
+	aclDropped     atomic.Uint64 // Client packets refused by the ACL
+	spoofed        atomic.Uint64 // Client packets whose source is not the client's VIP
+}
+
+// sample is one value of a metric family; labels is the rendered label set
+type sample struct {
+	labels string
+	value  float64
+}
+
+// writeMetric writes one metric family in the Prometheus text format
+func writeMetric(w io.Writer, name, kind, help string, samples ...sample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %v\n", name, s.labels, s.value)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels renders alternating label names and values as {name="value",...}
+func labels(kv ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", kv[i], labelEscaper.Replace(kv[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func counter(c *atomic.Uint64, kv ...string) sample {
+	s := sample{value: float64(c.Load())}
+	if len(kv) > 0 {
+		s.labels = labels(kv...)
+	}
+	return s
+}
+
+// serveMetrics starts the Prometheus endpoint on addr. filter and reality may
+// be nil; refused counts packets rejected at the packet layer.
+func serveMetrics(addr string, sm *session.Manager, rl *RateLimiter, shaping *shaper.Policy, filter *acl.Policy, reality *obfuscator.RealityConn, refused func() uint64) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, sm, rl, shaping, filter, reality, refused)
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(l)
+	fmt.Printf("Metrics available at http://%s/metrics\n", l.Addr())
+	return nil
+}
+
+func writeMetrics(w io.Writer, sm *session.Manager, rl *RateLimiter, shaping *shaper.Policy, filter *acl.Policy, reality *obfuscator.RealityConn, refused func() uint64) {
+	sessions := sm.Sessions()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].VIP.String() < sessions[j].VIP.String() })
+	used, total := sm.PoolStats()
+
+	writeMetric(w, "slopn_build_info", "gauge", "Server version.", sample{labels("version", ServerVersion), 1})
+	writeMetric(w, "slopn_sessions_active", "gauge", "Connected clients.", sample{"", float64(len(sessions))})
+	writeMetric(w, "slopn_ip_pool_addresses", "gauge", "Client addresses in the VIP pool.",
+		sample{labels("state", "used"), float64(used)}, sample{labels("state", "free"), float64(total - used)})
+	writeMetric(w, "slopn_auth_total", "counter", "Login attempts by result.",
+		counter(&counters.authSuccess, "result", "success"),
+		counter(&counters.authFailure, "result", "failure"),
+		counter(&counters.resumed, "result", "resumed"))
+	writeMetric(w, "slopn_bans_active", "gauge", "Banned addresses and networks, including static bans.", sample{"", float64(len(rl.Bans()))})
+	writeMetric(w, "slopn_bans_total", "counter", "Bans imposed by the rate limiter or an administrator.", counter(&counters.bans))
+	writeMetric(w, "slopn_banned_connections_total", "counter", "Connections refused from banned addresses.", counter(&counters.refused))
+	writeMetric(w, "slopn_banned_packets_total", "counter", "Packets from banned or denied addresses rejected before the QUIC handshake.", sample{"", float64(refused())})
+	writeMetric(w, "slopn_datagram_send_errors_total", "counter", "QUIC datagrams that could not be sent to a client.", counter(&counters.sendErrors))
+	writeMetric(w, "slopn_tun_write_errors_total", "counter", "Client packets that could not be written to the TUN device.", counter(&counters.tunWriteErrors))
+	writeMetric(w, "slopn_packets_total", "counter", "Forwarded packets by path: spoke-to-spoke (fast), client to TUN (tun_out), TUN to client (tun_in).",
+		counter(&counters.fastPath, "path", "fast"),
+		counter(&counters.tunOut, "path", "tun_out"),
+		counter(&counters.tunIn, "path", "tun_in"))
+	writeMetric(w, "slopn_spoofed_packets_total", "counter", "Client packets dropped because their source is not the client's VIP.", counter(&counters.spoofed))
+
+	var shaped []sample
+	for _, d := range []struct {
+		dir  shaper.Direction
+		name string
+	}{{shaper.Up, "up"}, {shaper.Down, "down"}} {
+		dropped, delayed := shaping.Stats(d.dir)
+		shaped = append(shaped,
+			sample{labels("direction", d.name, "action", "dropped"), float64(dropped)},
+			sample{labels("direction", d.name, "action", "delayed"), float64(delayed)})
+	}
+	writeMetric(w, "slopn_shaped_packets_total", "counter", "Packets dropped or delayed by bandwidth limits.", shaped...)
+
+	if filter != nil {
+		writeMetric(w, "slopn_acl_dropped_packets_total", "counter", "Client packets dropped by the access control rules.", counter(&counters.aclDropped))
+		writeMetric(w, "slopn_acl_tracked_flows", "gauge", "Flows whose replies pass the access control rules.", sample{"", float64(filter.Flows())})
+	}
+
+	if reality != nil {
+		active, mirrored := reality.MirrorStats()
+		writeMetric(w, "slopn_reality_mirror_sessions", "gauge", "Unauthorized probes currently mirrored to the mimic target.", sample{"", float64(active)})
+		writeMetric(w, "slopn_reality_mirror_sessions_total", "counter", "Unauthorized probes mirrored to the mimic target.", sample{"", float64(mirrored)})
+		stale, replayed := reality.RejectedHeaders()
+		writeMetric(w, "slopn_reality_rejected_headers_total", "counter", "Signed FPO headers refused as stale or replayed.",
+			sample{labels("reason", "stale"), float64(stale)}, sample{labels("reason", "replayed"), float64(replayed)})
+		writeMetric(w, "slopn_reality_peers", "gauge", "Remote addresses with FPO state, i.e. connections being set up or authorized.", sample{"", float64(reality.Peers())})
+		v1, v2 := reality.AcceptedHeaders()
+		writeMetric(w, "slopn_reality_fpo_packets_total", "counter", "FPO packets accepted, by header version.",
+			sample{labels("version", "1"), float64(v1)}, sample{labels("version", "2"), float64(v2)})
+	}
+
+	// Per-session QUIC path and tunnel traffic statistics
+	var rtt, minRTT, sent, lost, bytes []sample
+	for _, s := range sessions {
+		id := labels("vip", s.VIP.String(), "user", s.User)
+		st := s.Conn.ConnectionStats()
+		rtt = append(rtt, sample{id, st.SmoothedRTT.Seconds()})
+		minRTT = append(minRTT, sample{id, st.MinRTT.Seconds()})
+		sent = append(sent, sample{id, float64(st.PacketsSent)})
+		lost = append(lost, sample{id, float64(st.PacketsLost)})
+		bytes = append(bytes,
+			sample{labels("vip", s.VIP.String(), "user", s.User, "direction", "rx"), float64(s.Traffic.RxBytes.Load())},
+			sample{labels("vip", s.VIP.String(), "user", s.User, "direction", "tx"), float64(s.Traffic.TxBytes.Load())})
+	}
+	writeMetric(w, "slopn_session_rtt_seconds", "gauge", "Smoothed QUIC round-trip time per session.", rtt...)
+	writeMetric(w, "slopn_session_min_rtt_seconds", "gauge", "Minimum QUIC round-trip time per session.", minRTT...)
+	writeMetric(w, "slopn_session_quic_packets_sent_total", "counter", "QUIC packets sent per session, including lost ones.", sent...)
+	writeMetric(w, "slopn_session_quic_packets_lost_total", "counter", "QUIC packets declared lost per session.", lost...)
+	writeMetric(w, "slopn_session_tunnel_bytes_total", "counter", "Tunnel payload bytes per session, received from (rx) or sent to (tx) the client.", bytes...)
+}
@@ -0,0 +1,43 @@
+// Author: webdunesurfer <vkh@gmx.at>
+// Licensed under the GNU General Public License v3.0
+
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// pathPollInterval is how often a connection's remote address is sampled
+const pathPollInterval = time.Second
+
+// remoteConn is the part of a QUIC connection that forgetPaths watches
+type remoteConn interface {
+	Context() context.Context
+	RemoteAddr() net.Addr
+}
+
+// forgetPaths calls forget for every remote address conn used, once it
+// closes, so that none of them stays whitelisted by FPO after a client has
+// migrated. Paths the client only probed, or left again within
+// pathPollInterval, are not seen here and expire with obfuscator.PeerTimeout.
+func forgetPaths(conn remoteConn, forget func(net.Addr)) {
+	paths := make(map[string]net.Addr)
+	ticker := time.NewTicker(pathPollInterval)
+	defer ticker.Stop()
+	for {
+		addr := conn.RemoteAddr()
+		paths[addr.String()] = addr
+		select {
+		case <-conn.Context().Done():
+			addr := conn.RemoteAddr() // The path may have changed since the last tick
+			paths[addr.String()] = addr
+			for _, a := range paths {
+				forget(a)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+)
+
+// migratingConn moves to a new port every time its address is read and
+// closes after a few reads
+type migratingConn struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	reads  int
+}
+
+func (c *migratingConn) Context() context.Context { return c.ctx }
+
+func (c *migratingConn) RemoteAddr() net.Addr {
+	c.reads++
+	if c.reads == 2 {
+		c.cancel() // Closes right after the first tick
+	}
+	return &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000 + c.reads}
+}
+
+func TestForgetPaths(t *testing.T) {
+	conn := &migratingConn{}
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
+
+	var forgotten []string
+	forgetPaths(conn, func(addr net.Addr) { forgotten = append(forgotten, addr.String()) })
+	sort.Strings(forgotten)
+
+	var want []string
+	for i := 1; i <= 3; i++ {
+		want = append(want, fmt.Sprintf("192.0.2.1:%d", 40000+i))
+	}
+	if fmt.Sprint(forgotten) != fmt.Sprint(want) {
+		t.Fatalf("forgot %v, want %v", forgotten, want)
+	}
+}
@@ -0,0 +1,209 @@
+// Author: webdunesurfer <vkh@gmx.at>
+// Licensed under the GNU General Public License v3.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/webdunesurfer/SloPN/pkg/protocol"
+	"github.com/webdunesurfer/SloPN/pkg/quota"
+	"github.com/webdunesurfer/SloPN/pkg/session"
+	"github.com/webdunesurfer/SloPN/pkg/shaper"
+	"github.com/webdunesurfer/SloPN/pkg/userdb"
+)
+
+const (
+	quotaInterval         = 10 * time.Second // How often usage is charged and checked
+	defaultThrottleKbps   = 256
+	quotaExceededCloseErr = 0x04
+)
+
+// quotaEnforcer charges session traffic to the users' quotas. The data path
+// only bumps the sessions' atomic counters; deltas are charged every
+// quotaInterval and when a session ends, so enforcement lags by at most that.
+type quotaEnforcer struct {
+	mu        sync.Mutex
+	store     *quota.Store
+	users     *userdb.Store
+	shaping   *shaper.Policy
+	charged   map[*session.Traffic]uint64 // Bytes already charged per session
+	throttled map[*session.Traffic]bool
+	pushed    map[*session.Traffic]quota.Status // Last status sent to the client
+}
+
+func newQuotaEnforcer(store *quota.Store, users *userdb.Store, shaping *shaper.Policy) *quotaEnforcer {
+	return &quotaEnforcer{
+		store:     store,
+		users:     users,
+		shaping:   shaping,
+		charged:   make(map[*session.Traffic]uint64),
+		throttled: make(map[*session.Traffic]bool),
+		pushed:    make(map[*session.Traffic]quota.Status),
+	}
+}
+
+// lookup returns the user's account, or nil without a users database
+func (q *quotaEnforcer) lookup(user string) *userdb.User {
+	if q.users == nil {
+		return nil
+	}
+	account, err := q.users.Lookup(user)
+	if err != nil {
+		return nil
+	}
+	return account
+}
+
+// blocked reports whether a login must be refused because the account has
+// used up a quota whose action is to disconnect
+func (q *quotaEnforcer) blocked(account *userdb.User) bool {
+	if account.Quota == nil || account.Quota.Action == userdb.QuotaThrottle {
+		return false
+	}
+	st, ok := q.store.Status(account.Name, account.Quota, time.Now())
+	return ok && st.Exceeded
+}
+
+// charge adds the session's traffic since the last charge to its user
+func (q *quotaEnforcer) charge(s *session.Session) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.chargeLocked(s, time.Now())
+}
+
+func (q *quotaEnforcer) chargeLocked(s *session.Session, now time.Time) {
+	total := s.Traffic.RxBytes.Load() + s.Traffic.TxBytes.Load()
+	if delta := total - q.charged[s.Traffic]; delta > 0 {
+		q.store.Add(s.User, delta, now)
+	}
+	q.charged[s.Traffic] = total
+}
+
+// check charges s, then enforces and reports its user's quota. force sends
+// the status to the client even if it has not changed.
+func (q *quotaEnforcer) check(s *session.Session, force bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	q.chargeLocked(s, now)
+
+	var limit *userdb.Quota
+	var groups []string
+	if account := q.lookup(s.User); account != nil {
+		limit, groups = account.Quota, account.Groups
+	}
+	st, ok := q.store.Status(s.User, limit, now)
+	if !ok || !st.Exceeded {
+		if q.throttled[s.Traffic] {
+			// A new period has started or the quota was raised
+			delete(q.throttled, s.Traffic)
+			q.shaping.Apply(&s.Traffic.Limits, s.User, groups)
+			logServer("QUOTA_RESTORED", s.VIP.String(), s.Conn.RemoteAddr().String(), "User: "+s.User)
+		}
+	}
+	if !ok {
+		return
+	}
+
+	if last, sent := q.pushed[s.Traffic]; force || !sent || last.Used != st.Used || last.Exceeded != st.Exceeded || last.Period != st.Period {
+		q.pushed[s.Traffic] = st
+		pushQuota(s.Conn, st, limit)
+	}
+	if !st.Exceeded {
+		return
+	}
+
+	details := fmt.Sprintf("User: %s; Period: %s; Used: %d of %d bytes", s.User, st.Period, st.Used, st.Limit)
+	if limit.Action == userdb.QuotaThrottle {
+		kbps := limit.ThrottleKbps
+		if kbps == 0 {
+			kbps = defaultThrottleKbps
+		}
+		if !q.throttled[s.Traffic] {
+			q.throttled[s.Traffic] = true
+			logServer("QUOTA_THROTTLED", s.VIP.String(), s.Conn.RemoteAddr().String(), fmt.Sprintf("%s; Rate: %d kbps", details, kbps))
+		}
+		// Re-applied on every check, since a shaping reload resets the buckets
+		s.Traffic.Limits.Set(shaper.Limit{UpKbps: kbps, DownKbps: kbps})
+		return
+	}
+	logServer("QUOTA_EXCEEDED", s.VIP.String(), s.Conn.RemoteAddr().String(), details)
+	conn := s.Conn
+	// Give the quota message a moment to reach the client
+	time.AfterFunc(time.Second, func() { conn.CloseWithError(quotaExceededCloseErr, "quota exceeded") })
+}
+
+// run charges and checks all sessions every quotaInterval and persists usage
+func (q *quotaEnforcer) run(sm *session.Manager) {
+	ticker := time.NewTicker(quotaInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		live := make(map[*session.Traffic]bool)
+		for _, s := range sm.Sessions() {
+			live[s.Traffic] = true
+			q.check(&s, false)
+		}
+
+		q.mu.Lock()
+		for t := range q.charged {
+			if !live[t] {
+				delete(q.charged, t)
+				delete(q.throttled, t)
+				delete(q.pushed, t)
+			}
+		}
+		q.mu.Unlock()
+		q.save()
+	}
+}
+
+// flush charges all sessions and persists usage, for a shutdown in between ticks
+func (q *quotaEnforcer) flush(sm *session.Manager) {
+	for _, s := range sm.Sessions() {
+		q.charge(&s)
+	}
+	q.save()
+}
+
+func (q *quotaEnforcer) save() {
+	if err := q.store.Save(time.Now()); err != nil {
+		fmt.Printf("Warning: failed to persist quota usage: %v\n", err)
+	}
+}
+
+// quotaSeq orders quota messages, which travel on separate streams
+var quotaSeq atomic.Uint64
+
+// pushQuota sends the quota status to the client as a control message.
+// Older clients never accept the stream, which is harmless.
+func pushQuota(conn *quic.Conn, st quota.Status, limit *userdb.Quota) {
+	action := limit.Action
+	if action == "" {
+		action = userdb.QuotaDisconnect
+	}
+	msg := protocol.Quota{
+		Type:       protocol.MessageTypeQuota,
+		Seq:        quotaSeq.Add(1),
+		Period:     st.Period,
+		LimitBytes: st.Limit,
+		UsedBytes:  st.Used,
+		Resets:     st.Resets.Unix(),
+		Exceeded:   st.Exceeded,
+		Action:     action,
+	}
+	go func() {
+		stream, err := conn.OpenUniStream()
+		if err != nil {
+			return
+		}
+		stream.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		json.NewEncoder(stream).Encode(msg)
+		stream.Close()
+	}()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/webdunesurfer/SloPN/pkg/certutil"
+	"github.com/webdunesurfer/SloPN/pkg/quota"
+	"github.com/webdunesurfer/SloPN/pkg/session"
+	"github.com/webdunesurfer/SloPN/pkg/shaper"
+	"github.com/webdunesurfer/SloPN/pkg/userdb"
+)
+
+// quicPair returns both ends of a QUIC connection over loopback
+func quicPair(t *testing.T) (server, client *quic.Conn) {
+	t.Helper()
+	conf, err := certutil.GenerateSelfSignedConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := quic.ListenAddr("127.0.0.1:0", conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err = quic.DialAddr(ctx, ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: conf.NextProtos}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.CloseWithError(0, "") })
+	if server, err = ln.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+// quotaServer returns an enforcer for a single user with quota q and a
+// session manager holding one session of theirs
+func quotaServer(t *testing.T, q *userdb.Quota, conn *quic.Conn) (*quotaEnforcer, *session.Manager, *session.Session) {
+	t.Helper()
+	users, err := userdb.New([]*userdb.User{{Name: "alice", TokenHash: userdb.HashToken("secret"), Enabled: true, Quota: q}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, _ := quota.Load("")
+	shaping, _ := shaper.New(shaper.File{})
+	sm, err := session.NewManager("10.100.0.0/24", "10.100.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sm.AddSession(net.ParseIP("10.100.0.2"), conn, "alice", "laptop")
+	return newQuotaEnforcer(store, users, shaping), sm, s
+}
+
+func TestQuotaBlocked(t *testing.T) {
+	q, _, _ := quotaServer(t, &userdb.Quota{DailyMB: 1}, nil)
+	alice, _ := q.users.Lookup("alice")
+	if q.blocked(alice) {
+		t.Fatal("blocked before using the quota")
+	}
+	q.store.Add("alice", 1e6, time.Now())
+	if !q.blocked(alice) {
+		t.Fatal("not blocked with the quota used up")
+	}
+	// Throttled users may still log in
+	alice.Quota.Action = userdb.QuotaThrottle
+	if q.blocked(alice) {
+		t.Fatal("throttled user blocked")
+	}
+	if q.blocked(&userdb.User{Name: "alice"}) {
+		t.Fatal("user without a quota blocked")
+	}
+}
+
+func TestQuotaFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	q, sm, s := quotaServer(t, nil, nil)
+	q.store, _ = quota.Load(path)
+
+	s.Traffic.Received(1000)
+	s.Traffic.Sent(500)
+	q.flush(sm)
+	s.Traffic.Sent(100)
+	q.flush(sm)
+
+	// Only bytes not yet charged are added
+	saved, err := quota.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := saved.Get("alice", time.Now()); u.DayBytes != 1600 {
+		t.Fatalf("saved %d bytes, want 1600", u.DayBytes)
+	}
+}
+
+func TestQuotaThrottle(t *testing.T) {
+	conn, client := quicPair(t)
+	q, _, s := quotaServer(t, &userdb.Quota{DailyMB: 1, Action: userdb.QuotaThrottle}, conn)
+
+	s.Traffic.Received(1e6)
+	if out := captureStdout(t, func() { q.check(s, false) }); !strings.Contains(out, "QUOTA_THROTTLED") || !q.throttled[s.Traffic] {
+		t.Fatalf("not throttled: %q", out)
+	}
+	if out := captureStdout(t, func() { q.check(s, false) }); out != "" {
+		t.Fatalf("throttle logged again: %q", out)
+	}
+
+	// Raising the quota restores the session
+	q.users.Set([]*userdb.User{{Name: "alice", TokenHash: userdb.HashToken("secret"), Enabled: true, Quota: &userdb.Quota{DailyMB: 2, Action: userdb.QuotaThrottle}}})
+	if out := captureStdout(t, func() { q.check(s, false) }); !strings.Contains(out, "QUOTA_RESTORED") || q.throttled[s.Traffic] {
+		t.Fatalf("not restored: %q", out)
+	}
+	select {
+	case <-client.Context().Done():
+		t.Fatal("throttled session closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestQuotaDisconnect(t *testing.T) {
+	conn, client := quicPair(t)
+	q, _, s := quotaServer(t, &userdb.Quota{MonthlyMB: 1}, conn)
+
+	s.Traffic.Sent(999999)
+	captureStdout(t, func() { q.check(s, false) })
+	s.Traffic.Sent(1)
+	if out := captureStdout(t, func() { q.check(s, false) }); !strings.Contains(out, "QUOTA_EXCEEDED") {
+		t.Fatalf("not exceeded: %q", out)
+	}
+
+	select {
+	case <-client.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not closed")
+	}
+	var appErr *quic.ApplicationError
+	if err := context.Cause(client.Context()); !errors.As(err, &appErr) || appErr.ErrorCode != quotaExceededCloseErr {
+		t.Fatalf("closed with %v", err)
+	}
+}
@@ -0,0 +1,314 @@
+// Author: webdunesurfer <vkh@gmx.at>
+// Licensed under the GNU General Public License v3.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/webdunesurfer/SloPN/pkg/admin"
+)
+
+// sweepInterval is how often expired failures and bans are forgotten
+const sweepInterval = time.Minute
+
+// banRecord is an address's ban. It is kept after the ban runs out, so that
+// a repeat offender gets a longer one.
+type banRecord struct {
+	Expires time.Time `json:"expires"`
+	Strikes int       `json:"strikes,omitempty"` // Automatic bans so far
+}
+
+type RateLimiter struct {
+	mu       sync.Mutex
+	attempts map[string][]time.Time // IP -> List of failure timestamps
+	banned   map[string]*banRecord  // IP -> Ban, including recently expired ones
+	path     string                 // Empty keeps bans in memory only
+	dirty    bool
+
+	// active is a copy of the bans for Refuses, replaced on every change
+	active atomic.Pointer[map[netip.Addr]time.Time]
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		attempts: make(map[string][]time.Time),
+		banned:   make(map[string]*banRecord),
+	}
+}
+
+// LoadBans restores bans from path and saves them there from now on. A
+// missing file is not an error.
+func (rl *RateLimiter) LoadBans(path string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.path = path
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	saved := make(map[string]*banRecord)
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("parse %s: %v", path, err)
+	}
+	for ip, b := range saved {
+		if net.ParseIP(ip) != nil && b != nil {
+			rl.banned[ip] = b
+		}
+	}
+	rl.publish()
+	return nil
+}
+
+// changed publishes and saves the bans after a change. Callers hold rl.mu.
+func (rl *RateLimiter) changed() {
+	rl.dirty = true
+	rl.publish()
+	rl.save()
+}
+
+// publish replaces the snapshot read by Refuses. Callers hold rl.mu.
+func (rl *RateLimiter) publish() {
+	now := time.Now()
+	active := make(map[netip.Addr]time.Time)
+	for ip, b := range rl.banned {
+		if addr, err := netip.ParseAddr(ip); err == nil && now.Before(b.Expires) {
+			active[addr.Unmap()] = b.Expires
+		}
+	}
+	rl.active.Store(&active)
+}
+
+// save writes the bans if they changed. Callers hold rl.mu.
+func (rl *RateLimiter) save() {
+	if rl.path == "" || !rl.dirty {
+		return
+	}
+	data, err := json.MarshalIndent(rl.banned, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(rl.path), 0755)
+	}
+	tmp := rl.path + ".tmp"
+	if err == nil {
+		err = os.WriteFile(tmp, data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp, rl.path)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to persist bans: %v\n", err)
+		return
+	}
+	rl.dirty = false
+}
+
+// inList reports whether ip is in one of the static lists
+func inList(list []*net.IPNet, ip net.IP) bool {
+	for _, n := range list {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether ip is on the static allow list, which is never
+// refused or banned
+func allowed(ip string) bool {
+	addr := net.ParseIP(ip)
+	return addr != nil && inList(settings().allow, addr)
+}
+
+func (rl *RateLimiter) IsBanned(ip string) bool {
+	// Static lists from the config file; the allow list wins
+	if addr := net.ParseIP(ip); addr != nil {
+		cfg := settings()
+		if inList(cfg.allow, addr) {
+			return false
+		}
+		if inList(cfg.bans, addr) {
+			return true
+		}
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	b, exists := rl.banned[ip]
+	return exists && time.Now().Before(b.Expires)
+}
+
+// Refuses is IsBanned for the packet layer. It runs for every datagram the
+// server receives, so it reads the published snapshot without locking.
+func (rl *RateLimiter) Refuses(addr net.Addr) bool {
+	u, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	cfg := settings()
+	if inList(cfg.allow, u.IP) {
+		return false
+	}
+	if inList(cfg.bans, u.IP) {
+		return true
+	}
+	active := rl.active.Load()
+	if active == nil || len(*active) == 0 {
+		return false
+	}
+	ip, ok := netip.AddrFromSlice(u.IP)
+	if !ok {
+		return false
+	}
+	expiry, banned := (*active)[ip.Unmap()]
+	return banned && time.Now().Before(expiry)
+}
+
+// banDuration is the ban after strikes earlier bans: -ban-duration, doubled
+// for each strike up to -max-ban-duration
+func banDuration(cfg *liveSettings, strikes int) time.Duration {
+	d := time.Duration(cfg.banMins) * time.Minute
+	limit := max(time.Duration(cfg.maxBanMins)*time.Minute, d)
+	for i := 0; i < strikes && d < limit; i++ {
+		d *= 2
+	}
+	return min(d, limit)
+}
+
+// recent drops failures before since. Callers hold rl.mu.
+func (rl *RateLimiter) recent(ip string, since time.Time) []time.Time {
+	var out []time.Time
+	for _, t := range rl.attempts[ip] {
+		if t.After(since) {
+			out = append(out, t)
+		}
+	}
+	if len(out) == 0 {
+		delete(rl.attempts, ip)
+	} else {
+		rl.attempts[ip] = out
+	}
+	return out
+}
+
+func (rl *RateLimiter) RecordFailure(ip string) {
+	if allowed(ip) {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.attempts[ip] = append(rl.attempts[ip], now)
+	cfg := settings()
+
+	// Keep only attempts within the window and since the last ban ended
+	since := now.Add(-time.Duration(cfg.windowMins) * time.Minute)
+	if b := rl.banned[ip]; b != nil && b.Expires.After(since) {
+		since = b.Expires
+	}
+	recent := rl.recent(ip, since)
+
+	if len(recent) >= cfg.maxAttempts {
+		b := rl.banned[ip]
+		if b == nil {
+			b = &banRecord{}
+			rl.banned[ip] = b
+		}
+		d := banDuration(cfg, b.Strikes)
+		b.Strikes++
+		b.Expires = now.Add(d)
+		rl.changed()
+		counters.bans.Add(1)
+		logServer("BAN", "---", ip, fmt.Sprintf("Duration: %dm; Attempts: %d; Strikes: %d", int(d/time.Minute), len(recent), b.Strikes))
+	}
+}
+
+// Ban bans ip for d, e.g. on request of an administrator. Earlier strikes
+// are kept but this ban adds none.
+func (rl *RateLimiter) Ban(ip string, d time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	b := rl.banned[ip]
+	if b == nil {
+		b = &banRecord{}
+		rl.banned[ip] = b
+	}
+	b.Expires = time.Now().Add(d)
+	rl.changed()
+	counters.bans.Add(1)
+}
+
+// Unban lifts a ban and forgets recorded failures and strikes. It reports
+// whether ip was banned.
+func (rl *RateLimiter) Unban(ip string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	delete(rl.attempts, ip)
+	b, ok := rl.banned[ip]
+	if !ok {
+		return false
+	}
+	delete(rl.banned, ip)
+	rl.changed()
+	return time.Now().Before(b.Expires)
+}
+
+// Bans lists active bans, including static ones from the config file
+func (rl *RateLimiter) Bans() []admin.BanInfo {
+	var out []admin.BanInfo
+	for _, n := range settings().bans {
+		out = append(out, admin.BanInfo{IP: n.String(), Static: true})
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	for ip, b := range rl.banned {
+		if now.Before(b.Expires) {
+			out = append(out, admin.BanInfo{IP: ip, Expires: b.Expires, Failures: len(rl.attempts[ip]), Strikes: b.Strikes})
+		}
+	}
+	return out
+}
+
+// sweep forgets failures outside the window, and bans that ran out longer
+// than -max-ban-duration ago, so neither map grows without bound
+func (rl *RateLimiter) sweep() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	cfg := settings()
+	since := now.Add(-time.Duration(cfg.windowMins) * time.Minute)
+	for ip := range rl.attempts {
+		rl.recent(ip, since)
+	}
+	memory := max(time.Duration(cfg.maxBanMins), time.Duration(cfg.banMins)) * time.Minute
+	for ip, b := range rl.banned {
+		if now.Sub(b.Expires) > memory {
+			delete(rl.banned, ip)
+			rl.dirty = true
+		}
+	}
+	rl.publish() // Also drops bans that ran out
+	rl.save()
+}
+
+// run sweeps every sweepInterval
+func (rl *RateLimiter) run() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		rl.sweep()
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/webdunesurfer/SloPN/pkg/obfuscator"
+)
+
+// useSettings installs live settings for the test and restores the old ones
+func useSettings(t *testing.T, cfg *liveSettings) {
+	t.Helper()
+	old := live.Load()
+	live.Store(cfg)
+	t.Cleanup(func() { live.Store(old) })
+}
+
+func mustNets(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+	nets, err := parseBans(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
+
+func udp(ip string) net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP(ip), Port: 4242}
+}
+
+func TestBanDuration(t *testing.T) {
+	cfg := &liveSettings{banMins: 10, maxBanMins: 40}
+	for strikes, want := range []time.Duration{10, 20, 40, 40, 40} {
+		if got := banDuration(cfg, strikes); got != want*time.Minute {
+			t.Errorf("strikes %d: %v, want %vm", strikes, got, int(want))
+		}
+	}
+	// A maximum below the base duration does not shorten bans
+	if got := banDuration(&liveSettings{banMins: 10, maxBanMins: 5}, 3); got != 10*time.Minute {
+		t.Errorf("maximum below base: %v, want 10m", got)
+	}
+}
+
+func TestRecordFailureEscalates(t *testing.T) {
+	useSettings(t, &liveSettings{maxAttempts: 3, windowMins: 5, banMins: 10, maxBanMins: 40})
+	rl := NewRateLimiter()
+	const ip = "203.0.113.7"
+
+	for i := 0; i < 2; i++ {
+		rl.RecordFailure(ip)
+	}
+	if rl.IsBanned(ip) {
+		t.Fatal("banned before reaching the limit")
+	}
+	rl.RecordFailure(ip)
+	if !rl.IsBanned(ip) || !rl.Refuses(udp(ip)) {
+		t.Fatal("not banned after 3 failures")
+	}
+	if left := time.Until(rl.banned[ip].Expires); left < 9*time.Minute || left > 10*time.Minute {
+		t.Fatalf("first ban lasts %v, want 10m", left)
+	}
+
+	// Let the ban run out: failures from before it ended do not count again
+	rl.banned[ip].Expires = time.Now()
+	rl.publish()
+	if rl.IsBanned(ip) || rl.Refuses(udp(ip)) {
+		t.Fatal("still banned after expiry")
+	}
+	rl.RecordFailure(ip)
+	if rl.IsBanned(ip) {
+		t.Fatal("failures from before the ban counted again")
+	}
+	rl.RecordFailure(ip)
+	rl.RecordFailure(ip)
+	if left := time.Until(rl.banned[ip].Expires); left < 19*time.Minute || left > 20*time.Minute {
+		t.Fatalf("second ban lasts %v, want 20m", left)
+	}
+	if s := rl.banned[ip].Strikes; s != 2 {
+		t.Fatalf("strikes = %d, want 2", s)
+	}
+
+	if !rl.Unban(ip) || rl.IsBanned(ip) || rl.Refuses(udp(ip)) {
+		t.Fatal("Unban did not lift the ban")
+	}
+	if _, ok := rl.banned[ip]; ok {
+		t.Fatal("Unban kept the strikes")
+	}
+}
+
+func TestStaticLists(t *testing.T) {
+	useSettings(t, &liveSettings{
+		maxAttempts: 1, windowMins: 5, banMins: 10,
+		bans:  mustNets(t, "198.51.100.0/24"),
+		allow: mustNets(t, "198.51.100.10", "192.0.2.1"),
+	})
+	rl := NewRateLimiter()
+
+	if !rl.IsBanned("198.51.100.20") || !rl.Refuses(udp("198.51.100.20")) {
+		t.Error("address on the deny list not refused")
+	}
+	// The allow list wins over the deny list and is never banned
+	if rl.IsBanned("198.51.100.10") || rl.Refuses(udp("198.51.100.10")) {
+		t.Error("allowed address in a denied network refused")
+	}
+	rl.RecordFailure("192.0.2.1")
+	if rl.IsBanned("192.0.2.1") || rl.Refuses(udp("192.0.2.1")) {
+		t.Error("allowed address banned for failures")
+	}
+	// IPv4-mapped addresses are the same address to the packet layer
+	rl.Ban("192.0.2.2", time.Hour)
+	if !rl.Refuses(udp("::ffff:192.0.2.2")) {
+		t.Error("mapped address of a banned IP not refused")
+	}
+	if n := len(rl.Bans()); n != 2 {
+		t.Errorf("Bans lists %d entries, want the static network and 192.0.2.2", n)
+	}
+}
+
+func TestBansPersist(t *testing.T) {
+	useSettings(t, &liveSettings{maxAttempts: 3, windowMins: 5, banMins: 10, maxBanMins: 40})
+	path := filepath.Join(t.TempDir(), "state", "bans.json")
+
+	rl := NewRateLimiter()
+	if err := rl.LoadBans(path); err != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+	rl.Ban("203.0.113.7", time.Hour)
+
+	restarted := NewRateLimiter()
+	if err := restarted.LoadBans(path); err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.IsBanned("203.0.113.7") || !restarted.Refuses(udp("203.0.113.7")) {
+		t.Fatal("ban lost across a restart")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	useSettings(t, &liveSettings{maxAttempts: 3, windowMins: 5, banMins: 10, maxBanMins: 40})
+	rl := NewRateLimiter()
+	now := time.Now()
+
+	rl.attempts["203.0.113.1"] = []time.Time{now.Add(-10 * time.Minute)}
+	rl.attempts["203.0.113.2"] = []time.Time{now.Add(-10 * time.Minute), now}
+	rl.banned["203.0.113.3"] = &banRecord{Expires: now.Add(-time.Hour), Strikes: 3}   // Forgotten
+	rl.banned["203.0.113.4"] = &banRecord{Expires: now.Add(-time.Minute), Strikes: 1} // Remembered for the next ban
+	rl.banned["203.0.113.5"] = &banRecord{Expires: now.Add(time.Minute)}              // Active
+	rl.sweep()
+
+	if _, ok := rl.attempts["203.0.113.1"]; ok {
+		t.Error("failures outside the window kept")
+	}
+	if n := len(rl.attempts["203.0.113.2"]); n != 1 {
+		t.Errorf("%d failures kept, want 1", n)
+	}
+	if _, ok := rl.banned["203.0.113.3"]; ok {
+		t.Error("long expired ban kept")
+	}
+	if _, ok := rl.banned["203.0.113.4"]; !ok {
+		t.Error("recently expired ban forgotten")
+	}
+	if rl.Refuses(udp("203.0.113.4")) || !rl.Refuses(udp("203.0.113.5")) {
+		t.Error("published bans out of date after sweep")
+	}
+}
+
+// packets is a PacketConn delivering one queued packet per source
+type packets struct {
+	net.PacketConn
+	from []string
+}
+
+func (q *packets) ReadFrom(p []byte) (int, net.Addr, error) {
+	if len(q.from) == 0 {
+		return 0, nil, errors.New("no more packets")
+	}
+	ip := q.from[0]
+	q.from = q.from[1:]
+	return copy(p, ip), udp(ip), nil
+}
+
+func TestRefusedBeforeHandshake(t *testing.T) {
+	useSettings(t, &liveSettings{banMins: 10, bans: mustNets(t, "198.51.100.0/24"), allow: mustNets(t, "203.0.113.9")})
+	rl := NewRateLimiter()
+	rl.Ban("203.0.113.7", time.Minute)
+	rl.Ban("203.0.113.9", time.Minute) // Allow-listed
+
+	conn := obfuscator.NewFilterConn(&packets{from: []string{
+		"203.0.113.7", "::ffff:203.0.113.7", "198.51.100.20", "192.0.2.1", "203.0.113.9", "203.0.113.7",
+	}}, rl.Refuses)
+	p := make([]byte, 64)
+	for _, want := range []string{"192.0.2.1", "203.0.113.9"} {
+		if n, _, err := conn.ReadFrom(p); err != nil || string(p[:n]) != want {
+			t.Fatalf("ReadFrom = %q, %v; want the packet from %s", p[:n], err, want)
+		}
+	}
+	if n, _, err := conn.ReadFrom(p); err == nil {
+		t.Fatalf("banned source passed: %q", p[:n])
+	}
+	if n := conn.Refused(); n != 4 {
+		t.Fatalf("%d refused, want 4", n)
+	}
+}
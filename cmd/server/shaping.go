@@ -0,0 +1,50 @@
+// Author: webdunesurfer <vkh@gmx.at>
+// Licensed under the GNU General Public License v3.0
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/webdunesurfer/SloPN/pkg/session"
+	"github.com/webdunesurfer/SloPN/pkg/shaper"
+	"github.com/webdunesurfer/SloPN/pkg/userdb"
+)
+
+// sendToClient delivers a tunnel packet to a session and counts it in sent.
+// Over its bandwidth limit the packet is dropped, or held back on a timer so
+// the shared TUN reader never blocks on one client's limit.
+func sendToClient(conn *quic.Conn, traffic *session.Traffic, shaping *shaper.Policy, data []byte, sent *atomic.Uint64) error {
+	wait, ok := shaping.Allow(&traffic.Limits, shaper.Down, len(data))
+	if !ok {
+		return nil
+	}
+	if wait > 0 {
+		held := append([]byte(nil), data...) // The caller reuses data
+		time.AfterFunc(wait, func() {
+			if err := conn.SendDatagram(held); err != nil {
+				counters.sendErrors.Add(1)
+				return
+			}
+			traffic.Sent(len(held))
+			sent.Add(1)
+		})
+		return nil
+	}
+	if err := conn.SendDatagram(data); err != nil {
+		counters.sendErrors.Add(1)
+		return err
+	}
+	traffic.Sent(len(data))
+	sent.Add(1)
+	return nil
+}
+
+// reshape re-applies the shaping policy to all sessions after a reload
+func reshape(sm *session.Manager, users *userdb.Store, shaping *shaper.Policy) {
+	for _, s := range sm.Sessions() {
+		shaping.Apply(&s.Traffic.Limits, s.User, groupsOf(users, s.User))
+	}
+}
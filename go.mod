@@ -2,11 +2,16 @@ module github.com/webdunesurfer/SloPN
 
 go 1.25.7
 
-require github.com/quic-go/quic-go v0.59.0
+require (
+	github.com/godbus/dbus/v5 v5.2.2
+	github.com/quic-go/quic-go v0.59.0
+	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
+	github.com/vishvananda/netlink v1.3.1
+	golang.org/x/crypto v0.41.0
+	golang.org/x/sys v0.35.0
+)
 
 require (
-	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8 // indirect
-	golang.org/x/crypto v0.41.0 // indirect
+	github.com/vishvananda/netns v0.0.5 // indirect
 	golang.org/x/net v0.43.0 // indirect
-	golang.org/x/sys v0.35.0 // indirect
 )
@@ -57,11 +57,12 @@ type UserSettings struct {
 	Server     string `json:"server"`
 	FullTunnel bool   `json:"full_tunnel"`
 	Obfuscate  bool   `json:"obfuscate"`
+	KillSwitch bool   `json:"kill_switch"`
 	SNI        string `json:"sni"`
 }
 
 // SaveConfig persists settings to disk and token to Keyring
-func (a *App) SaveConfig(server, token, sni string, full, obfs bool) {
+func (a *App) SaveConfig(server, token, sni string, full, obfs, killSwitch bool) {
 	server = strings.TrimSpace(server)
 	sni = strings.TrimSpace(sni)
 	// 1. Save sensitive token to system Keyring
@@ -82,10 +83,10 @@ func (a *App) SaveConfig(server, token, sni string, full, obfs bool) {
 	configDir := getConfigDir()
 	os.MkdirAll(configDir, 0755)
 	
-	settings := UserSettings{Server: server, FullTunnel: full, Obfuscate: obfs, SNI: sni}
+	settings := UserSettings{Server: server, FullTunnel: full, Obfuscate: obfs, KillSwitch: killSwitch, SNI: sni}
 	data, _ := json.Marshal(settings)
 	os.WriteFile(filepath.Join(configDir, "settings.json"), data, 0644)
-	fmt.Printf("[v%s] [GUI] Config (Server: %s, Full: %v, Obfs: %v, SNI: %s) saved to Library\n", GUIVersion, server, full, obfs, sni)
+	fmt.Printf("[v%s] [GUI] Config (Server: %s, Full: %v, Obfs: %v, Kill switch: %v, SNI: %s) saved to Library\n", GUIVersion, server, full, obfs, killSwitch, sni)
 }
 
 // GetSavedConfig retrieves settings and secure token
@@ -101,6 +102,7 @@ func (a *App) GetSavedConfig() map[string]interface{} {
 			res["server"] = settings.Server
 			res["full_tunnel"] = settings.FullTunnel
 			res["obfuscate"] = settings.Obfuscate
+			res["kill_switch"] = settings.KillSwitch
 			res["sni"] = settings.SNI
 		}
 	}
@@ -152,6 +154,10 @@ type InitialConfig struct {
 	Token     string `json:"token"`
 	Obfuscate interface{} `json:"obfuscate"` // Handle both bool and string
 	SNI       string `json:"sni"`
+	ServerFingerprint string `json:"server_fingerprint"` // Pinned server key printed by the server
+	ServerCA  string `json:"server_ca"`  // Path to a PEM CA bundle
+	ClientCert string `json:"client_cert"` // Path to a PEM device certificate (mutual TLS)
+	ClientKey  string `json:"client_key"`  // Path to its PEM private key
 }
 
 // GetInitialConfig reads the config file created by the installer
@@ -216,17 +222,46 @@ func (a *App) callHelper(req ipc.Request) (*ipc.Response, error) {
 }
 
 // Connect starts the VPN
-func (a *App) Connect(server, token, sni string, full, obfs bool) string {
+func (a *App) Connect(server, token, sni string, full, obfs, killSwitch bool) string {
 	server = strings.TrimSpace(server)
 	sni = strings.TrimSpace(sni)
 	fmt.Printf("[v%s] [GUI] Connect requested for %s (SNI: %s, Obfs: %v)\n", GUIVersion, server, sni, obfs)
+
+	// The installer's pin only applies to the server it was issued for
+	var fingerprint, ca, clientCert, clientKey string
+	if cfg := a.GetInitialConfig(); cfg.Server == server {
+		fingerprint = cfg.ServerFingerprint
+		files := []struct {
+			path, what string
+			dst        *string
+		}{
+			{cfg.ServerCA, "server CA", &ca},
+			{cfg.ClientCert, "client certificate", &clientCert},
+			{cfg.ClientKey, "client key", &clientKey},
+		}
+		for _, f := range files {
+			if f.path == "" {
+				continue
+			}
+			data, err := os.ReadFile(f.path)
+			if err != nil {
+				return fmt.Sprintf("failed to read %s: %v", f.what, err)
+			}
+			*f.dst = string(data)
+		}
+	}
 	_, err := a.callHelper(ipc.Request{
-		Command:    ipc.CmdConnect,
-		ServerAddr: server,
-		Token:      token,
-		SNI:        sni,
-		FullTunnel: full,
-		Obfuscate:  obfs,
+		Command:           ipc.CmdConnect,
+		ServerAddr:        server,
+		Token:             token,
+		SNI:               sni,
+		ServerFingerprint: fingerprint,
+		ServerCA:          ca,
+		ClientCert:        clientCert,
+		ClientKey:         clientKey,
+		FullTunnel:        full,
+		Obfuscate:         obfs,
+		KillSwitch:        killSwitch,
 	})
 	if err != nil {
 		fmt.Printf("[v%s] [GUI] Connect FAILED: %v\n", GUIVersion, err)
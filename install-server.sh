@@ -71,7 +71,15 @@ fi
 # B) Start VPN Server
 docker stop slopn-server &>/dev/null || true
 docker rm slopn-server &>/dev/null || true
-docker run -d --name slopn-server --restart unless-stopped --cap-add=NET_ADMIN --device=/dev/net/tun:/dev/net/tun -p 4242:4242/udp -e SLOPN_TOKEN="$TOKEN" -e SLOPN_NAT=true -e SLOPN_MAX_ATTEMPTS=5 -e SLOPN_WINDOW=5 -e SLOPN_BAN_DURATION=60 -e SLOPN_MIMIC="$USER_MIMIC" slopn-server -nat
+docker run -d --name slopn-server --restart unless-stopped --cap-add=NET_ADMIN --device=/dev/net/tun:/dev/net/tun -p 4242:4242/udp -v slopn-data:/var/lib/slopn -e SLOPN_TOKEN="$TOKEN" -e SLOPN_NAT=true -e SLOPN_MAX_ATTEMPTS=5 -e SLOPN_WINDOW=5 -e SLOPN_BAN_DURATION=60 -e SLOPN_MIMIC="$USER_MIMIC" slopn-server -nat
+
+# The certificate is generated on first start; wait for it to be reported
+FINGERPRINT=""
+for i in $(seq 1 10); do
+    FINGERPRINT=$(docker logs slopn-server 2>&1 | grep -o "sha256:[0-9a-f]*" | tail -n 1)
+    [ -n "$FINGERPRINT" ] && break
+    sleep 1
+done
 
 # C) Start CoreDNS
 docker stop slopn-dns &>/dev/null || true
@@ -90,8 +98,10 @@ echo -e "\n${BLUE}Client Configuration Details:${NC}"
 echo -e "  ${BLUE}Server Address:${NC} $PUBLIC_IP:4242"
 echo -e "  ${BLUE}Auth Token:    ${NC} $TOKEN"
 echo -e "  ${BLUE}SNI Value:     ${NC} $MIMIC_HOST"
+echo -e "  ${BLUE}Fingerprint:   ${NC} $FINGERPRINT"
 echo -e "\n${BLUE}Management Commands:${NC}"
 echo -e "  View Server Logs: ${GREEN}docker logs -f slopn-server${NC}"
 echo -e "  View DNS Logs:    ${GREEN}docker logs -f slopn-dns${NC}"
+echo -e "  List Sessions:    ${GREEN}docker exec slopn-server ./slopn-server ctl sessions${NC}"
 echo -e "  Stop All:         ${GREEN}docker stop slopn-server slopn-dns${NC}"
 echo -e "${BLUE}====================================================${NC}"
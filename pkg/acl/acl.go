@@ -0,0 +1,461 @@
+// Package acl filters the traffic clients send through the tunnel, both to
+// other clients (the fast path) and to the server's networks (the TUN path).
+// Rules are matched in order against the sending user and groups, the
+// destination (CIDR, or user and groups for another client), protocol and
+// port. Replies to flows that were allowed, or that arrived from the TUN
+// side, always pass, so a default-deny policy only limits who may start a flow.
+// Flows are tracked per session: the server drops packets whose source is not
+// the sender's VIP before they get here, and a client can only reply to flows
+// addressed to it.
+package acl
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/webdunesurfer/SloPN/pkg/iputil"
+)
+
+// Actions
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// Rule matches packets sent by a client. Empty fields match anything; a rule
+// with both to and to_users/to_groups matches either.
+type Rule struct {
+	Name     string   `json:"name,omitempty"` // Shown in the log when the rule drops a flow
+	Action   string   `json:"action"`
+	Users    []string `json:"users,omitempty"`     // Sending users
+	Groups   []string `json:"groups,omitempty"`    // Sending users' groups
+	To       []string `json:"to,omitempty"`        // Destination CIDRs
+	ToUsers  []string `json:"to_users,omitempty"`  // Destination clients by user
+	ToGroups []string `json:"to_groups,omitempty"` // Destination clients by group
+	Proto    string   `json:"proto,omitempty"`     // "tcp", "udp", "icmp" or a protocol number
+	Ports    []string `json:"ports,omitempty"`     // Destination ports or ranges ("22", "8000-8100"); TCP and UDP only
+}
+
+// File is the ACL file format
+type File struct {
+	Default string `json:"default,omitempty"` // Action when no rule matches: Allow (default) or Deny
+	Rules   []Rule `json:"rules,omitempty"`
+}
+
+// IsEmpty reports whether f filters nothing at all
+func (f File) IsEmpty() bool {
+	return (f.Default == "" || f.Default == Allow) && len(f.Rules) == 0
+}
+
+// Packet is what the rules see of a packet a client sends
+type Packet struct {
+	Session    string // Sending client's session, e.g. its VIP; flows are tracked per session
+	User       string
+	Groups     []string
+	DstSession string // Set when the destination is another client
+	DstUser    string
+	DstGroups  []string
+	Proto      int
+	Src, Dst   net.IP
+	SrcPort    int // Zero unless TCP or UDP
+	DstPort    int
+}
+
+// Parse fills in the addresses, protocol and ports from a raw IP packet
+func (p *Packet) Parse(packet []byte) bool {
+	p.Src, p.Dst = iputil.GetSourceIP(packet), iputil.GetDestinationIP(packet)
+	if p.Src == nil || p.Dst == nil {
+		return false
+	}
+	p.Proto = iputil.GetProtocol(packet)
+	p.SrcPort, p.DstPort, _ = iputil.GetPorts(packet)
+	return true
+}
+
+func (p *Packet) String() string {
+	proto := strconv.Itoa(p.Proto)
+	switch p.Proto {
+	case iputil.ProtoTCP:
+		proto = "tcp"
+	case iputil.ProtoUDP:
+		proto = "udp"
+	case iputil.ProtoICMP, iputil.ProtoICMPv6:
+		proto = "icmp"
+	}
+	if p.DstPort != 0 {
+		return fmt.Sprintf("%s %s -> %s", proto, net.JoinHostPort(p.Src.String(), strconv.Itoa(p.SrcPort)), net.JoinHostPort(p.Dst.String(), strconv.Itoa(p.DstPort)))
+	}
+	return fmt.Sprintf("%s %s -> %s", proto, p.Src, p.Dst)
+}
+
+// Verdict is the outcome of Check
+type Verdict struct {
+	Allow bool
+	Rule  string // Name of the deciding rule ("rule N" if unnamed), "default" or "reply"
+	Log   bool   // First drop of this flow in a while; later ones are not worth logging
+}
+
+const (
+	flowTimeout = 2 * time.Minute // Replies are accepted this long after the last packet
+	maxFlows    = 1 << 12         // Per session; flows beyond this are not tracked
+	logInterval = time.Minute     // Repeated drops of a flow are logged this often
+	sweepEvery  = 30 * time.Second
+)
+
+// rule is a Rule with its lists parsed
+type rule struct {
+	Rule
+	allow    bool
+	nets     []*net.IPNet
+	protos   []int // Empty matches any
+	ports    [][2]int
+	users    map[string]bool
+	groups   map[string]bool
+	toUsers  map[string]bool
+	toGroups map[string]bool
+}
+
+// flowKey identifies a flow in one direction
+type flowKey struct {
+	proto            int
+	src, dst         [16]byte
+	srcPort, dstPort int
+}
+
+func keyOf(p *Packet) flowKey {
+	k := flowKey{proto: p.Proto, srcPort: p.SrcPort, dstPort: p.DstPort}
+	copy(k.src[:], p.Src.To16())
+	copy(k.dst[:], p.Dst.To16())
+	return k
+}
+
+// reverse is the key of the replies to k
+func (k flowKey) reverse() flowKey {
+	return flowKey{proto: k.proto, src: k.dst, dst: k.src, srcPort: k.dstPort, dstPort: k.srcPort}
+}
+
+// flows is the flow state of one session
+type flows struct {
+	replies map[flowKey]time.Time // Key: reply the session may send -> expiry
+	dropped map[flowKey]time.Time // Key: dropped flow -> last logged
+}
+
+// Policy holds the server-wide ACL and the state of the flows it allowed
+type Policy struct {
+	mu          sync.RWMutex
+	path        string // Empty for a policy built by New
+	defaultDeny bool
+	rules       []rule
+
+	flowMu    sync.Mutex
+	sessions  map[string]*flows // Key: Packet.Session
+	nextSweep time.Time
+}
+
+// Load reads an ACL from a JSON file
+func Load(path string) (*Policy, error) {
+	p := &Policy{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// New builds a policy from an in-memory file, e.g. from the server config file
+func New(f File) (*Policy, error) {
+	p := &Policy{}
+	if err := p.Set(f); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload re-reads the backing file. On error the previous policy stays active.
+func (p *Policy) Reload() error {
+	if p.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("parse %s: %v", p.path, err)
+	}
+	return p.Set(f)
+}
+
+// Set validates and replaces the policy. On error the previous policy stays
+// active. Tracked flows survive, so established connections are not cut.
+func (p *Policy) Set(f File) error {
+	var defaultDeny bool
+	switch f.Default {
+	case "", Allow:
+	case Deny:
+		defaultDeny = true
+	default:
+		return fmt.Errorf("default: unknown action %q", f.Default)
+	}
+	rules := make([]rule, len(f.Rules))
+	for i, r := range f.Rules {
+		c, err := compile(r)
+		if err != nil {
+			return fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		rules[i] = c
+	}
+
+	p.mu.Lock()
+	p.defaultDeny = defaultDeny
+	p.rules = rules
+	p.mu.Unlock()
+	return nil
+}
+
+func compile(r Rule) (rule, error) {
+	c := rule{Rule: r, users: set(r.Users), groups: set(r.Groups), toUsers: set(r.ToUsers), toGroups: set(r.ToGroups)}
+	switch r.Action {
+	case Allow:
+		c.allow = true
+	case Deny:
+	default:
+		return c, fmt.Errorf("unknown action %q", r.Action)
+	}
+	for _, cidr := range r.To {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return c, err
+		}
+		c.nets = append(c.nets, n)
+	}
+	switch strings.ToLower(r.Proto) {
+	case "":
+	case "tcp":
+		c.protos = []int{iputil.ProtoTCP}
+	case "udp":
+		c.protos = []int{iputil.ProtoUDP}
+	case "icmp":
+		c.protos = []int{iputil.ProtoICMP, iputil.ProtoICMPv6}
+	default:
+		n, err := strconv.Atoi(r.Proto)
+		if err != nil || n < 0 || n > 255 {
+			return c, fmt.Errorf("unknown protocol %q", r.Proto)
+		}
+		c.protos = []int{n}
+	}
+	if len(r.Ports) > 0 {
+		for _, proto := range c.protos {
+			if proto != iputil.ProtoTCP && proto != iputil.ProtoUDP {
+				return c, fmt.Errorf("ports need proto tcp or udp")
+			}
+		}
+	}
+	for _, s := range r.Ports {
+		lo, hi, found := strings.Cut(s, "-")
+		if !found {
+			hi = lo
+		}
+		from, err1 := strconv.Atoi(lo)
+		to, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || from < 1 || to > 65535 || from > to {
+			return c, fmt.Errorf("invalid port range %q", s)
+		}
+		c.ports = append(c.ports, [2]int{from, to})
+	}
+	return c, nil
+}
+
+func set(list []string) map[string]bool {
+	if len(list) == 0 {
+		return nil
+	}
+	m := make(map[string]bool, len(list))
+	for _, s := range list {
+		m[s] = true
+	}
+	return m
+}
+
+func anyIn(m map[string]bool, list []string) bool {
+	for _, s := range list {
+		if m[s] {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matches(p *Packet) bool {
+	if (r.users != nil || r.groups != nil) && !r.users[p.User] && !anyIn(r.groups, p.Groups) {
+		return false
+	}
+	if r.nets != nil || r.toUsers != nil || r.toGroups != nil {
+		hit := p.DstUser != "" && (r.toUsers[p.DstUser] || anyIn(r.toGroups, p.DstGroups))
+		for _, n := range r.nets {
+			if hit {
+				break
+			}
+			hit = n.Contains(p.Dst)
+		}
+		if !hit {
+			return false
+		}
+	}
+	if len(r.protos) > 0 {
+		hit := false
+		for _, proto := range r.protos {
+			hit = hit || proto == p.Proto
+		}
+		if !hit {
+			return false
+		}
+	}
+	if len(r.ports) > 0 {
+		hit := false
+		for _, pr := range r.ports {
+			hit = hit || (p.DstPort >= pr[0] && p.DstPort <= pr[1])
+		}
+		if !hit {
+			return false
+		}
+	}
+	return true
+}
+
+// Check decides whether a client may send p
+func (p *Policy) Check(pkt *Packet) Verdict {
+	now := time.Now()
+	key := keyOf(pkt)
+
+	p.flowMu.Lock()
+	p.sweep(now)
+	if f, ok := p.sessions[pkt.Session]; ok && now.Before(f.replies[key]) {
+		p.track(pkt.DstSession, key.reverse(), now) // Keep the flow alive from both ends
+		p.flowMu.Unlock()
+		return Verdict{Allow: true, Rule: "reply"}
+	}
+	p.flowMu.Unlock()
+
+	v := Verdict{Rule: "default"}
+	p.mu.RLock()
+	v.Allow = !p.defaultDeny
+	for i := range p.rules {
+		if r := &p.rules[i]; r.matches(pkt) {
+			v.Allow, v.Rule = r.allow, r.Name
+			break
+		}
+	}
+	p.mu.RUnlock()
+
+	p.flowMu.Lock()
+	defer p.flowMu.Unlock()
+	if v.Allow {
+		p.track(pkt.DstSession, key.reverse(), now)
+		return v
+	}
+	f := p.session(pkt.Session)
+	if last, ok := f.dropped[key]; !ok || now.Sub(last) >= logInterval {
+		if ok || len(f.dropped) < maxFlows {
+			if f.dropped == nil {
+				f.dropped = make(map[flowKey]time.Time)
+			}
+			f.dropped[key] = now
+		}
+		v.Log = true
+	}
+	return v
+}
+
+// Seen records a packet from the TUN side to a client's session, so the
+// client's replies pass even if the rules would not let it start the flow
+func (p *Policy) Seen(session string, packet []byte) {
+	var pkt Packet
+	if !pkt.Parse(packet) {
+		return
+	}
+	now := time.Now()
+	p.flowMu.Lock()
+	defer p.flowMu.Unlock()
+	p.sweep(now)
+	p.track(session, keyOf(&pkt).reverse(), now)
+}
+
+// Forget drops the flows of a session that has ended, so a client that gets
+// its VIP next cannot reply to them
+func (p *Policy) Forget(session string) {
+	p.flowMu.Lock()
+	defer p.flowMu.Unlock()
+	delete(p.sessions, session)
+}
+
+// session returns the flow state of a session. Callers hold flowMu.
+func (p *Policy) session(name string) *flows {
+	f, ok := p.sessions[name]
+	if !ok {
+		if p.sessions == nil {
+			p.sessions = make(map[string]*flows)
+		}
+		f = &flows{}
+		p.sessions[name] = f
+	}
+	return f
+}
+
+// track lets session send replies on key. Replies to the TUN side are not
+// filtered, so nothing is tracked without a session. Callers hold flowMu.
+func (p *Policy) track(session string, key flowKey, now time.Time) {
+	if session == "" {
+		return
+	}
+	f := p.session(session)
+	if f.replies == nil {
+		f.replies = make(map[flowKey]time.Time)
+	}
+	if _, ok := f.replies[key]; ok || len(f.replies) < maxFlows {
+		f.replies[key] = now.Add(flowTimeout)
+	}
+}
+
+// sweep forgets expired flows now and then. Callers hold flowMu.
+func (p *Policy) sweep(now time.Time) {
+	if now.Before(p.nextSweep) {
+		return
+	}
+	p.nextSweep = now.Add(sweepEvery)
+	for name, f := range p.sessions {
+		for k, expiry := range f.replies {
+			if now.After(expiry) {
+				delete(f.replies, k)
+			}
+		}
+		for k, last := range f.dropped {
+			if now.Sub(last) >= logInterval {
+				delete(f.dropped, k)
+			}
+		}
+		if len(f.replies) == 0 && len(f.dropped) == 0 {
+			delete(p.sessions, name)
+		}
+	}
+}
+
+// Flows returns the number of flows whose replies are currently accepted
+func (p *Policy) Flows() int {
+	p.flowMu.Lock()
+	defer p.flowMu.Unlock()
+	n := 0
+	for _, f := range p.sessions {
+		n += len(f.replies)
+	}
+	return n
+}
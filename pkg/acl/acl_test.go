@@ -0,0 +1,169 @@
+package acl
+
+import (
+	"net"
+	"testing"
+
+	"github.com/webdunesurfer/SloPN/pkg/iputil"
+)
+
+// ipv4 builds a minimal IPv4 packet with a TCP or UDP port pair
+func ipv4(proto int, src string, srcPort int, dst string, dstPort int) []byte {
+	b := make([]byte, 24)
+	b[0] = 0x45
+	b[9] = byte(proto)
+	copy(b[12:16], net.ParseIP(src).To4())
+	copy(b[16:20], net.ParseIP(dst).To4())
+	b[20], b[21] = byte(srcPort>>8), byte(srcPort)
+	b[22], b[23] = byte(dstPort>>8), byte(dstPort)
+	return b
+}
+
+func packet(t *testing.T, session, user string, data []byte) *Packet {
+	t.Helper()
+	p := &Packet{Session: session, User: user}
+	if !p.Parse(data) {
+		t.Fatal("Parse failed")
+	}
+	return p
+}
+
+func mustPolicy(t *testing.T, f File) *Policy {
+	t.Helper()
+	p, err := New(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRules(t *testing.T) {
+	p := mustPolicy(t, File{Default: Deny, Rules: []Rule{
+		{Name: "no-db", Action: Deny, Groups: []string{"contractors"}, To: []string{"10.0.5.0/24"}},
+		{Name: "eng", Action: Allow, Groups: []string{"eng", "contractors"}, To: []string{"10.0.0.0/8"}},
+		{Name: "ssh", Action: Allow, ToGroups: []string{"servers"}, Proto: "tcp", Ports: []string{"22", "8000-8100"}},
+	}})
+	tests := []struct {
+		groups    []string
+		dstGroups []string
+		proto     int
+		dst       string
+		port      int
+		allow     bool
+		rule      string
+	}{
+		{[]string{"eng"}, nil, iputil.ProtoTCP, "10.0.5.1", 5432, true, "eng"},
+		{[]string{"contractors"}, nil, iputil.ProtoTCP, "10.0.5.1", 5432, false, "no-db"},
+		{[]string{"contractors"}, nil, iputil.ProtoTCP, "10.0.6.1", 5432, true, "eng"},
+		{nil, []string{"servers"}, iputil.ProtoTCP, "10.100.0.9", 22, true, "ssh"},
+		{nil, []string{"servers"}, iputil.ProtoTCP, "10.100.0.9", 8050, true, "ssh"},
+		{nil, []string{"servers"}, iputil.ProtoUDP, "10.100.0.9", 22, false, "default"},
+		{nil, []string{"servers"}, iputil.ProtoTCP, "10.100.0.9", 23, false, "default"},
+		{nil, nil, iputil.ProtoTCP, "192.168.1.1", 22, false, "default"},
+	}
+	for i, tt := range tests {
+		// A fresh source port per case, so no case is a reply to another
+		pkt := packet(t, "10.100.0.2", "alice", ipv4(tt.proto, "10.100.0.2", 40000+i, tt.dst, tt.port))
+		pkt.Groups, pkt.DstGroups = tt.groups, tt.dstGroups
+		if tt.dstGroups != nil {
+			pkt.DstSession, pkt.DstUser = tt.dst, "server"
+		}
+		if v := p.Check(pkt); v.Allow != tt.allow || v.Rule != tt.rule {
+			t.Errorf("case %d (%s): allow = %v by %q, want %v by %q", i+1, pkt, v.Allow, v.Rule, tt.allow, tt.rule)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, r := range []Rule{
+		{Action: "maybe"},
+		{Action: Allow, To: []string{"10.0.0.0"}},
+		{Action: Allow, Proto: "sctp"},
+		{Action: Allow, Proto: "icmp", Ports: []string{"22"}},
+		{Action: Allow, Proto: "tcp", Ports: []string{"100-10"}},
+		{Action: Allow, Proto: "tcp", Ports: []string{"0"}},
+	} {
+		if _, err := New(File{Rules: []Rule{r}}); err == nil {
+			t.Errorf("%+v accepted", r)
+		}
+	}
+	if _, err := New(File{Default: "maybe"}); err == nil {
+		t.Error("unknown default accepted")
+	}
+}
+
+func TestRepliesArePerSession(t *testing.T) {
+	const alice, bob, mallory = "10.100.0.2", "10.100.0.3", "10.100.0.4"
+	p := mustPolicy(t, File{Default: Deny, Rules: []Rule{
+		{Action: Allow, Users: []string{"alice"}, ToUsers: []string{"bob"}},
+	}})
+
+	out := packet(t, alice, "alice", ipv4(iputil.ProtoTCP, alice, 40000, bob, 22))
+	out.DstSession, out.DstUser = bob, "bob"
+	if v := p.Check(out); !v.Allow {
+		t.Fatalf("alice -> bob dropped by %q", v.Rule)
+	}
+
+	reply := ipv4(iputil.ProtoTCP, bob, 22, alice, 40000)
+	back := packet(t, bob, "bob", reply)
+	back.DstSession, back.DstUser = alice, "alice"
+	if v := p.Check(back); !v.Allow || v.Rule != "reply" {
+		t.Fatalf("bob's reply: allow = %v by %q, want reply", v.Allow, v.Rule)
+	}
+
+	// The same tuple sent by another session is not a reply
+	spoof := packet(t, mallory, "mallory", reply)
+	spoof.DstSession, spoof.DstUser = alice, "alice"
+	if v := p.Check(spoof); v.Allow {
+		t.Fatalf("mallory passed as %q with bob's reply tuple", v.Rule)
+	}
+
+	// Likewise for flows from the TUN side
+	p.Seen(alice, ipv4(iputil.ProtoUDP, "10.0.0.5", 53, alice, 50000))
+	tunReply := ipv4(iputil.ProtoUDP, alice, 50000, "10.0.0.5", 53)
+	if v := p.Check(packet(t, alice, "alice", tunReply)); !v.Allow {
+		t.Fatalf("alice's reply to the TUN side dropped by %q", v.Rule)
+	}
+	if v := p.Check(packet(t, bob, "bob", tunReply)); v.Allow {
+		t.Fatalf("bob passed as %q with alice's reply tuple", v.Rule)
+	}
+
+	// A session that ends takes its flows along
+	p.Forget(alice)
+	if v := p.Check(packet(t, alice, "alice", tunReply)); v.Allow {
+		t.Fatalf("reply passed as %q after Forget", v.Rule)
+	}
+}
+
+func TestFlowLimitPerSession(t *testing.T) {
+	const alice, bob = "10.100.0.2", "10.100.0.3"
+	p := mustPolicy(t, File{Default: Deny})
+
+	for port := 1; port <= maxFlows+100; port++ {
+		p.Seen(alice, ipv4(iputil.ProtoUDP, "10.0.0.5", port, alice, 50000))
+	}
+	if n := p.Flows(); n != maxFlows {
+		t.Fatalf("%d flows tracked, want %d", n, maxFlows)
+	}
+	over := ipv4(iputil.ProtoUDP, alice, 50000, "10.0.0.5", maxFlows+1)
+	if v := p.Check(packet(t, alice, "alice", over)); v.Allow {
+		t.Fatal("flow beyond the limit was tracked")
+	}
+
+	// A full table does not keep other sessions from tracking flows
+	p.Seen(bob, ipv4(iputil.ProtoUDP, "10.0.0.5", 53, bob, 50000))
+	if v := p.Check(packet(t, bob, "bob", ipv4(iputil.ProtoUDP, bob, 50000, "10.0.0.5", 53))); !v.Allow {
+		t.Fatalf("bob's reply dropped by %q", v.Rule)
+	}
+}
+
+func TestDropLogging(t *testing.T) {
+	p := mustPolicy(t, File{Default: Deny})
+	data := ipv4(iputil.ProtoTCP, "10.100.0.2", 40000, "10.0.0.5", 22)
+	if v := p.Check(packet(t, "10.100.0.2", "alice", data)); v.Allow || !v.Log {
+		t.Fatalf("first drop: allow = %v, log = %v", v.Allow, v.Log)
+	}
+	if v := p.Check(packet(t, "10.100.0.2", "alice", data)); v.Log {
+		t.Fatal("repeated drop logged again")
+	}
+}
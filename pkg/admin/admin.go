@@ -0,0 +1,101 @@
+// Author: webdunesurfer <vkh@gmx.at>
+// Licensed under the GNU General Public License v3.0
+
+// Package admin defines the server's local control API: one JSON request and
+// one JSON response per connection on a Unix socket, authenticated by a
+// shared secret like the helper's IPC.
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+type Command string
+
+const (
+	CmdSessions Command = "sessions"
+	CmdKick     Command = "kick"
+	CmdBans     Command = "bans"
+	CmdBan      Command = "ban"
+	CmdUnban    Command = "unban"
+	CmdPool     Command = "pool"
+)
+
+type Request struct {
+	Command Command `json:"command"`
+	Secret  string  `json:"secret"`
+	VIP     string  `json:"vip,omitempty"`     // CmdKick
+	Ban     bool    `json:"ban,omitempty"`     // CmdKick: also ban the client's address
+	IP      string  `json:"ip,omitempty"`      // CmdBan, CmdUnban
+	Minutes int     `json:"minutes,omitempty"` // CmdBan, CmdKick with Ban; 0 uses the server's ban duration
+}
+
+type Response struct {
+	Status  string          `json:"status"` // "success" or "error"
+	Message string          `json:"message,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+type SessionInfo struct {
+	VIP       string    `json:"vip"`
+	VIP6      string    `json:"vip6,omitempty"`
+	Remote    string    `json:"remote"`
+	User      string    `json:"user"`
+	Device    string    `json:"device,omitempty"`
+	Connected time.Time `json:"connected"`
+	LastRx    time.Time `json:"last_rx,omitempty"` // Last packet from the client
+	LastTx    time.Time `json:"last_tx,omitempty"` // Last packet to the client
+	RxPackets uint64    `json:"rx_packets"`
+	RxBytes   uint64    `json:"rx_bytes"`
+	TxPackets uint64    `json:"tx_packets"`
+	TxBytes   uint64    `json:"tx_bytes"`
+	Dropped   uint64    `json:"dropped,omitempty"` // Packets dropped by bandwidth limits
+	Delayed   uint64    `json:"delayed,omitempty"` // Packets held back by bandwidth limits
+}
+
+type BanInfo struct {
+	IP       string    `json:"ip"` // Address or CIDR
+	Expires  time.Time `json:"expires,omitempty"`
+	Failures int       `json:"failures,omitempty"` // Recent failed logins
+	Strikes  int       `json:"strikes,omitempty"`  // Automatic bans so far; each doubles the next
+	Static   bool      `json:"static,omitempty"`   // From the config file; cannot be lifted here
+}
+
+type PoolInfo struct {
+	Subnet   string `json:"subnet"`
+	ServerIP string `json:"server_ip"`
+	Used     int    `json:"used"`
+	Total    int    `json:"total"`
+	Sessions int    `json:"sessions"`
+}
+
+// Call sends req to the server listening on socketPath and decodes the
+// response data into out (which may be nil)
+func Call(socketPath string, req Request, out interface{}) (string, error) {
+	conn, err := net.DialTimeout("unix", socketPath, 2*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return "", fmt.Errorf("failed to send request: %v", err)
+	}
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return "", fmt.Errorf("failed to read response: %v", err)
+	}
+	if resp.Status != "success" {
+		return "", fmt.Errorf("%s", resp.Message)
+	}
+	if out != nil && len(resp.Data) > 0 {
+		if err := json.Unmarshal(resp.Data, out); err != nil {
+			return "", err
+		}
+	}
+	return resp.Message, nil
+}
@@ -0,0 +1,407 @@
+package certutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Files kept in a CA directory. Only ca.crt and ca.crl are needed by the
+// server; ca.key should stay on the machine that issues certificates.
+const (
+	CACertFile  = "ca.crt"
+	CAKeyFile   = "ca.key"
+	CRLFile     = "ca.crl"
+	IndexFile   = "index.json"
+	CertsDir    = "certs" // Issued certificates, <serial>.crt
+	crlValidity = 30 * 24 * time.Hour
+)
+
+var (
+	ErrNotFound  = errors.New("certificate not found")
+	ErrCAExists  = errors.New("CA already initialized")
+	ErrNoCA      = errors.New("CA not initialized")
+	ErrAmbiguous = errors.New("name matches several certificates; use the serial")
+)
+
+// Leaf certificate kinds
+const (
+	KindClient = "client"
+	KindServer = "server"
+)
+
+// Issued is an index entry for a certificate signed by the CA
+type Issued struct {
+	Serial    string     `json:"serial"` // Hex
+	Kind      string     `json:"kind"`   // KindClient or KindServer
+	Name      string     `json:"name"`   // Subject common name
+	SANs      []string   `json:"sans,omitempty"`
+	NotBefore time.Time  `json:"not_before"`
+	NotAfter  time.Time  `json:"not_after"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Status returns "revoked", "expired" or "valid"
+func (c *Issued) Status() string {
+	switch {
+	case c.RevokedAt != nil:
+		return "revoked"
+	case time.Now().After(c.NotAfter):
+		return "expired"
+	}
+	return "valid"
+}
+
+// IssueRequest describes a leaf certificate to sign
+type IssueRequest struct {
+	Kind     string        // KindClient (default) or KindServer
+	Name     string        // Subject CN; the user name for client certificates
+	SANs     []string      // DNS names, IP addresses, e-mail addresses or URIs
+	Validity time.Duration // Defaults to one year
+}
+
+type caIndex struct {
+	CRLNumber int64     `json:"crl_number"`
+	Certs     []*Issued `json:"certs"`
+}
+
+// CA is a file-backed certificate authority used offline to issue and revoke
+// server and device certificates. It is not safe for concurrent use by several processes.
+type CA struct {
+	Cert  *x509.Certificate
+	dir   string
+	key   *ecdsa.PrivateKey
+	index caIndex
+}
+
+// InitCA creates a new root CA in dir. It refuses to overwrite an existing one.
+func InitCA(dir, name string, validity time.Duration) (*CA, error) {
+	ca := &CA{dir: dir}
+	if _, err := os.Stat(ca.path(CACertFile)); err == nil {
+		return nil, ErrCAExists
+	}
+	if name == "" {
+		name = "SloPN Root CA"
+	}
+	if validity <= 0 {
+		validity = 10 * 365 * 24 * time.Hour
+	}
+	if err := ca.create(name, validity); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// OpenCA loads the CA previously created in dir by InitCA
+func OpenCA(dir string) (*CA, error) {
+	ca := &CA{dir: dir}
+	if _, err := os.Stat(ca.path(CACertFile)); os.IsNotExist(err) {
+		return nil, ErrNoCA
+	}
+	if err := ca.load(); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(ca.path(IndexFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &ca.index); err != nil {
+			return nil, fmt.Errorf("parse %s: %v", ca.path(IndexFile), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return ca, nil
+}
+
+func (ca *CA) path(name string) string {
+	return filepath.Join(ca.dir, name)
+}
+
+func (ca *CA) create(name string, validity time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"SloPN"}, CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(ca.path(CAKeyFile), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	if err := writeFile(ca.path(CACertFile), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	ca.Cert, _ = x509.ParseCertificate(der)
+	ca.key = key
+	// An empty CRL lets the server be pointed at ca.crl right away
+	return ca.writeCRL()
+}
+
+func (ca *CA) load() error {
+	certPEM, err := os.ReadFile(ca.path(CACertFile))
+	if err != nil {
+		return err
+	}
+	keyPEM, err := os.ReadFile(ca.path(CAKeyFile))
+	if err != nil {
+		return fmt.Errorf("CA key: %v", err)
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return fmt.Errorf("%s: no PEM certificate", ca.path(CACertFile))
+	}
+	if ca.Cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+		return err
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return fmt.Errorf("%s: no PEM key", ca.path(CAKeyFile))
+	}
+	ca.key, err = x509.ParseECPrivateKey(block.Bytes)
+	return err
+}
+
+// Issue signs a new leaf certificate and returns the PEM certificate and key.
+// The key is not kept; the certificate is stored for Bundle.
+func (ca *CA) Issue(req IssueRequest) (certPEM, keyPEM []byte, entry *Issued, err error) {
+	if req.Name == "" {
+		return nil, nil, nil, errors.New("certificate name is required")
+	}
+	if req.Kind == "" {
+		req.Kind = KindClient
+	}
+	if req.Validity <= 0 {
+		req.Validity = 365 * 24 * time.Hour
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"SloPN"}, CommonName: req.Name},
+		NotBefore:    now.Add(-time.Hour), // Tolerate clock skew
+		NotAfter:     now.Add(req.Validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if ca.Cert.NotAfter.Before(template.NotAfter) {
+		template.NotAfter = ca.Cert.NotAfter // A leaf cannot outlive its issuer
+	}
+	switch req.Kind {
+	case KindClient:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	case KindServer:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		if len(req.SANs) == 0 {
+			req.SANs = []string{req.Name}
+		}
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown certificate kind %q", req.Kind)
+	}
+	if err := addSANs(template, req.SANs); err != nil {
+		return nil, nil, nil, err
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	entry = &Issued{
+		Serial:    serial.Text(16),
+		Kind:      req.Kind,
+		Name:      req.Name,
+		SANs:      req.SANs,
+		NotBefore: template.NotBefore,
+		NotAfter:  template.NotAfter,
+	}
+	if err := writeFile(filepath.Join(ca.dir, CertsDir, entry.Serial+".crt"), certPEM, 0644); err != nil {
+		return nil, nil, nil, err
+	}
+	ca.index.Certs = append(ca.index.Certs, entry)
+	if err := ca.saveIndex(); err != nil {
+		return nil, nil, nil, err
+	}
+	return certPEM, keyPEM, entry, nil
+}
+
+// addSANs sorts each subject alternative name into the matching field
+func addSANs(c *x509.Certificate, sans []string) error {
+	for _, san := range sans {
+		san = strings.TrimSpace(san)
+		switch {
+		case san == "":
+		case net.ParseIP(san) != nil:
+			c.IPAddresses = append(c.IPAddresses, net.ParseIP(san))
+		case strings.Contains(san, "://"):
+			u, err := url.Parse(san)
+			if err != nil {
+				return fmt.Errorf("SAN %q: %v", san, err)
+			}
+			c.URIs = append(c.URIs, u)
+		case strings.Contains(san, "@"):
+			if _, err := mail.ParseAddress(san); err != nil {
+				return fmt.Errorf("SAN %q: %v", san, err)
+			}
+			c.EmailAddresses = append(c.EmailAddresses, san)
+		default:
+			c.DNSNames = append(c.DNSNames, san)
+		}
+	}
+	return nil
+}
+
+// List returns the index of issued certificates, oldest first
+func (ca *CA) List() []*Issued {
+	out := append([]*Issued(nil), ca.index.Certs...)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].NotBefore.Before(out[j].NotBefore) })
+	return out
+}
+
+// Find resolves a hex serial or a name. A name must match exactly one
+// unrevoked certificate.
+func (ca *CA) Find(target string) (*Issued, error) {
+	var found *Issued
+	for _, c := range ca.index.Certs {
+		if c.Serial == target {
+			return c, nil
+		}
+		if c.Name == target && c.RevokedAt == nil {
+			if found != nil {
+				return nil, ErrAmbiguous
+			}
+			found = c
+		}
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+// CertPEM returns the PEM encoded CA certificate, e.g. for server_ca or -client-ca
+func (ca *CA) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Cert.Raw})
+}
+
+// Bundle returns the PEM chain (leaf, then CA) of an issued certificate.
+// A server bundle can be used directly as -cert together with its key.
+func (ca *CA) Bundle(c *Issued) ([]byte, error) {
+	leaf, err := os.ReadFile(filepath.Join(ca.dir, CertsDir, c.Serial+".crt"))
+	if err != nil {
+		return nil, err
+	}
+	return append(leaf, ca.CertPEM()...), nil
+}
+
+// Revoke marks certificates as revoked and rewrites the CRL. target is either
+// a hex serial or a certificate name, which revokes all of that name's
+// unrevoked certificates.
+func (ca *CA) Revoke(target string) ([]*Issued, error) {
+	now := time.Now().UTC()
+	var revoked []*Issued
+	for _, c := range ca.index.Certs {
+		if c.RevokedAt == nil && (c.Serial == target || c.Name == target) {
+			c.RevokedAt = &now
+			revoked = append(revoked, c)
+		}
+	}
+	if len(revoked) == 0 {
+		return nil, ErrNotFound
+	}
+	if err := ca.saveIndex(); err != nil {
+		return nil, err
+	}
+	return revoked, ca.writeCRL()
+}
+
+// writeCRL signs the revoked entries of the index into ca.crl
+func (ca *CA) writeCRL() error {
+	var entries []x509.RevocationListEntry
+	for _, c := range ca.index.Certs {
+		if c.RevokedAt == nil {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(c.Serial, 16)
+		if !ok {
+			return fmt.Errorf("index: malformed serial %q", c.Serial)
+		}
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: *c.RevokedAt})
+	}
+
+	ca.index.CRLNumber++
+	now := time.Now()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(ca.index.CRLNumber),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(crlValidity),
+		RevokedCertificateEntries: entries,
+	}, ca.Cert, ca.key)
+	if err != nil {
+		return err
+	}
+	if err := ca.saveIndex(); err != nil {
+		return err
+	}
+	return writeFile(ca.path(CRLFile), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644)
+}
+
+func (ca *CA) saveIndex() error {
+	data, err := json.MarshalIndent(ca.index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(ca.path(IndexFile), data, 0600)
+}
+
+// newSerial returns a random 128-bit certificate serial number
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
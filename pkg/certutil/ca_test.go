@@ -0,0 +1,220 @@
+package certutil
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIssueSerialsAreUnique(t *testing.T) {
+	ca := newTestCA(t)
+	seen := map[string]bool{ca.Cert.SerialNumber.Text(16): true}
+	for i := 0; i < 50; i++ {
+		cert, entry := issue(t, ca, IssueRequest{Name: "alice"})
+		if got := leaf(t, cert).SerialNumber.Text(16); got != entry.Serial {
+			t.Fatalf("index serial %s, certificate serial %s", entry.Serial, got)
+		}
+		if seen[entry.Serial] {
+			t.Fatalf("serial %s issued twice", entry.Serial)
+		}
+		seen[entry.Serial] = true
+	}
+}
+
+func TestIssueKinds(t *testing.T) {
+	ca := newTestCA(t)
+
+	client, _ := issue(t, ca, IssueRequest{Name: "alice", SANs: []string{"alice@example.com"}})
+	c := leaf(t, client)
+	if len(c.ExtKeyUsage) != 1 || c.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+		t.Errorf("client ExtKeyUsage %v", c.ExtKeyUsage)
+	}
+	if c.Subject.CommonName != "alice" || len(c.DNSNames) != 0 || len(c.EmailAddresses) != 1 || c.EmailAddresses[0] != "alice@example.com" {
+		t.Errorf("client subject %s, DNS %v, e-mail %v", c.Subject.CommonName, c.DNSNames, c.EmailAddresses)
+	}
+	if c.IsCA {
+		t.Error("client certificate is a CA")
+	}
+
+	server, _ := issue(t, ca, IssueRequest{Kind: KindServer, Name: "vpn.example.com"})
+	s := leaf(t, server)
+	if len(s.ExtKeyUsage) != 1 || s.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Errorf("server ExtKeyUsage %v", s.ExtKeyUsage)
+	}
+	if len(s.DNSNames) != 1 || s.DNSNames[0] != "vpn.example.com" {
+		t.Errorf("server SANs default to %v, want the name", s.DNSNames)
+	}
+
+	sorted, _ := issue(t, ca, IssueRequest{Kind: KindServer, Name: "vpn", SANs: []string{"vpn.example.com", " 203.0.113.5", "2001:db8::1", "spiffe://example.com/vpn", ""}})
+	s = leaf(t, sorted)
+	if len(s.DNSNames) != 1 || len(s.IPAddresses) != 2 || len(s.URIs) != 1 || len(s.EmailAddresses) != 0 {
+		t.Errorf("SANs sorted into DNS %v, IP %v, URI %v, e-mail %v", s.DNSNames, s.IPAddresses, s.URIs, s.EmailAddresses)
+	}
+	if err := s.VerifyHostname("203.0.113.5"); err != nil {
+		t.Error(err)
+	}
+
+	for _, req := range []IssueRequest{
+		{Kind: "ca", Name: "x"},
+		{Name: ""},
+		{Name: "x", SANs: []string{"not an <address>@"}},
+	} {
+		if _, _, _, err := ca.Issue(req); err == nil {
+			t.Errorf("%+v issued", req)
+		}
+	}
+}
+
+func TestIssueValidity(t *testing.T) {
+	ca := newTestCA(t)
+	day := 24 * time.Hour
+
+	def, _ := issue(t, ca, IssueRequest{Name: "alice"})
+	if d := time.Until(leaf(t, def).NotAfter); d < 364*day || d > 365*day {
+		t.Errorf("default validity %v, want a year", d)
+	}
+	short, entry := issue(t, ca, IssueRequest{Name: "bob", Validity: 7 * day})
+	if got := leaf(t, short).NotAfter; !got.Equal(entry.NotAfter.Truncate(time.Second)) || time.Until(got) > 7*day {
+		t.Errorf("NotAfter %v, index %v; want 7 days", got, entry.NotAfter)
+	}
+
+	// A leaf cannot outlive its CA
+	brief, err := InitCA(t.TempDir(), "Brief CA", 30*day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capped, _ := issue(t, brief, IssueRequest{Name: "carol"})
+	if got := leaf(t, capped).NotAfter; got.After(brief.Cert.NotAfter) {
+		t.Errorf("leaf expires %v, after its CA %v", got, brief.Cert.NotAfter)
+	}
+}
+
+func TestRevokeWritesCRL(t *testing.T) {
+	ca := newTestCA(t)
+	_, alice := issue(t, ca, IssueRequest{Name: "alice"})
+	_, bob1 := issue(t, ca, IssueRequest{Name: "bob"})
+	_, bob2 := issue(t, ca, IssueRequest{Name: "bob"})
+
+	if _, err := ca.Find("bob"); !errors.Is(err, ErrAmbiguous) {
+		t.Fatalf("Find(bob) = %v, want %v", err, ErrAmbiguous)
+	}
+	if c, err := ca.Find(bob1.Serial); err != nil || c != bob1 {
+		t.Fatalf("Find by serial = %v, %v", c, err)
+	}
+	if _, err := ca.Find("mallory"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Find(mallory) = %v, want %v", err, ErrNotFound)
+	}
+
+	revoked, err := ca.Revoke("bob")
+	if err != nil || len(revoked) != 2 {
+		t.Fatalf("Revoke(bob) = %d certificates, %v; want both", len(revoked), err)
+	}
+	if bob1.Status() != "revoked" || alice.Status() != "valid" {
+		t.Fatalf("status bob %s, alice %s", bob1.Status(), alice.Status())
+	}
+	if _, err := ca.Revoke("bob"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("second Revoke(bob) = %v, want %v", err, ErrNotFound)
+	}
+
+	crl := readCRL(t, ca)
+	if err := crl.CheckSignatureFrom(ca.Cert); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, e := range crl.RevokedCertificateEntries {
+		got[e.SerialNumber.Text(16)] = true
+	}
+	if len(got) != 2 || !got[bob1.Serial] || !got[bob2.Serial] {
+		t.Fatalf("CRL lists %v, want %s and %s", got, bob1.Serial, bob2.Serial)
+	}
+	if crl.NextUpdate.Before(time.Now().Add(crlValidity - time.Hour)) {
+		t.Errorf("CRL valid until %v", crl.NextUpdate)
+	}
+
+	// Reopening keeps the index and numbers the next CRL after this one
+	reopened, err := OpenCA(ca.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Revoke(alice.Serial); err != nil {
+		t.Fatal(err)
+	}
+	next := readCRL(t, reopened)
+	if next.Number.Cmp(crl.Number) <= 0 || len(next.RevokedCertificateEntries) != 3 {
+		t.Fatalf("CRL %v with %d entries after CRL %v", next.Number, len(next.RevokedCertificateEntries), crl.Number)
+	}
+}
+
+func readCRL(t *testing.T, ca *CA) *x509.RevocationList {
+	t.Helper()
+	data, err := os.ReadFile(ca.path(CRLFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("CRL is not PEM")
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crl
+}
+
+func TestInitAndOpenCA(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := OpenCA(dir); !errors.Is(err, ErrNoCA) {
+		t.Fatalf("OpenCA of an empty directory = %v, want %v", err, ErrNoCA)
+	}
+	ca, err := InitCA(dir, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.Cert.IsCA || ca.Cert.Subject.CommonName != "SloPN Root CA" {
+		t.Fatalf("CA %q, IsCA %v", ca.Cert.Subject.CommonName, ca.Cert.IsCA)
+	}
+	if _, err := InitCA(dir, "", 0); !errors.Is(err, ErrCAExists) {
+		t.Fatalf("second InitCA = %v, want %v", err, ErrCAExists)
+	}
+	if info, err := os.Stat(ca.path(CAKeyFile)); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("CA key mode %v, %v; want 0600", info.Mode().Perm(), err)
+	}
+	if crl := readCRL(t, ca); len(crl.RevokedCertificateEntries) != 0 {
+		t.Fatal("new CA has revoked certificates")
+	}
+
+	_, entry := issue(t, ca, IssueRequest{Kind: KindServer, Name: "vpn.example.com"})
+	reopened, err := OpenCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := reopened.List(); len(list) != 1 || list[0].Serial != entry.Serial {
+		t.Fatalf("reopened index %v", list)
+	}
+
+	// The bundle is the leaf, then the CA, and verifies on its own
+	bundle, err := reopened.Bundle(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chain []*x509.Certificate
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, c)
+	}
+	if len(chain) != 2 || chain[0].SerialNumber.Text(16) != entry.Serial || !chain[1].Equal(ca.Cert) {
+		t.Fatalf("bundle has %d certificates", len(chain))
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(chain[1])
+	if _, err := chain[0].Verify(x509.VerifyOptions{Roots: roots, DNSName: "vpn.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,28 +4,187 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
-	"math/big"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
+// ErrUntrustedServer is wrapped by all server verification failures of ClientConfig
+var ErrUntrustedServer = errors.New("untrusted server certificate")
+
 // GenerateSelfSignedConfig generates a self-signed certificate and returns a tls.Config.
 func GenerateSelfSignedConfig() (*tls.Config, error) {
-	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certPEM, keyPEM, err := generateSelfSigned()
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
 	if err != nil {
 		return nil, err
 	}
 
+	return ServerConfig(cert), nil
+}
+
+// LoadOrCreate loads the server certificate and key from disk. On first start
+// it generates a self-signed pair and saves it, so the server keeps the same
+// identity (and fingerprint) across restarts.
+func LoadOrCreate(certPath, keyPath string) (tls.Certificate, error) {
+	if _, err := os.Stat(certPath); err == nil {
+		return tls.LoadX509KeyPair(certPath, keyPath)
+	}
+
+	certPEM, keyPEM, err := generateSelfSigned()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	// Key first: a cert without its key is useless, the reverse gets regenerated
+	if err := writeFile(keyPath, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := writeFile(certPath, certPEM, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// ServerConfig returns the server-side tls.Config for cert
+func ServerConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h3"},
+	}
+}
+
+// Fingerprint returns "sha256:<hex>" of the certificate's public key (SPKI).
+// It does not change when a certificate is re-issued for the same key.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// LeafFingerprint returns the Fingerprint of a loaded key pair's leaf certificate
+func LeafFingerprint(cert tls.Certificate) (string, error) {
+	if len(cert.Certificate) == 0 {
+		return "", errors.New("empty certificate chain")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "", err
+	}
+	return Fingerprint(leaf), nil
+}
+
+// ClientConfig returns a client tls.Config that sends sni on the wire (the
+// mimic target) but verifies the server by pinned fingerprint and/or CA
+// instead of by host name. With neither set, the server is not verified.
+func ClientConfig(sni, fingerprint string, caPEM []byte) (*tls.Config, error) {
+	pin := normalizeFingerprint(fingerprint)
+
+	var roots *x509.CertPool
+	if len(caPEM) > 0 {
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("no valid certificates in server CA")
+		}
+	}
+
+	conf := &tls.Config{
+		// The SNI is a mimic target, so the standard host name check cannot
+		// apply; VerifyPeerCertificate below does the real verification
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h3"},
+		ServerName:         sni,
+	}
+	if pin == "" && roots == nil {
+		return conf, nil
+	}
+
+	conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("%w: server sent no certificate", ErrUntrustedServer)
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			c, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = c
+		}
+
+		if pin != "" {
+			if got := Fingerprint(certs[0]); got != pin {
+				return fmt.Errorf("%w: fingerprint mismatch: expected %s, got %s (possible man-in-the-middle)", ErrUntrustedServer, pin, got)
+			}
+		}
+		if roots != nil {
+			inter := x509.NewCertPool()
+			for _, c := range certs[1:] {
+				inter.AddCert(c)
+			}
+			if _, err := certs[0].Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: inter,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			}); err != nil {
+				return fmt.Errorf("%w: not signed by the configured CA: %v", ErrUntrustedServer, err)
+			}
+		}
+		return nil
+	}
+	return conf, nil
+}
+
+// AddClientCert makes conf present the given PEM key pair to servers that
+// require client certificates
+func AddClientCert(conf *tls.Config, certPEM, keyPEM []byte) error {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("client certificate: %v", err)
+	}
+	conf.Certificates = []tls.Certificate{cert}
+	return nil
+}
+
+// normalizeFingerprint accepts "sha256:<hex>", bare hex and colon-separated
+// hex (as printed by openssl) in any case
+func normalizeFingerprint(fp string) string {
+	fp = strings.ToLower(strings.TrimSpace(fp))
+	if fp == "" {
+		return ""
+	}
+	fp = strings.TrimPrefix(fp, "sha256:")
+	return "sha256:" + strings.ReplaceAll(fp, ":", "")
+}
+
+func generateSelfSigned() (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
 	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
+		SerialNumber: serial,
 		Subject: pkix.Name{
 			Organization: []string{"SloPN"},
 		},
 		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(time.Hour * 24 * 365),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 365 * 10), // Pinned by fingerprint, not renewed
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
@@ -33,24 +192,26 @@ func GenerateSelfSignedConfig() (*tls.Config, error) {
 
 	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
 	keyBytes, err := x509.MarshalECPrivateKey(key)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+	return certPEM, keyPEM, nil
+}
 
-	cert, err := tls.X509KeyPair(certPEM, keyPEM)
-	if err != nil {
-		return nil, err
+// writeFile writes data atomically, creating the parent directory if needed
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
 	}
-
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-				NextProtos: []string{"h3"},
-			}, nil
-		
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
 }
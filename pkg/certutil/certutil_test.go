@@ -0,0 +1,146 @@
+package certutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestCA creates a CA in a temporary directory
+func newTestCA(t *testing.T) *CA {
+	t.Helper()
+	ca, err := InitCA(t.TempDir(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+// issue signs a leaf certificate and returns it as a key pair
+func issue(t *testing.T, ca *CA, req IssueRequest) (tls.Certificate, *Issued) {
+	t.Helper()
+	certPEM, keyPEM, entry, err := ca.Issue(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, entry
+}
+
+func leaf(t *testing.T, cert tls.Certificate) *x509.Certificate {
+	t.Helper()
+	c, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestLoadOrCreateReusesKey(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "tls", "server.crt"), filepath.Join(dir, "tls", "server.key")
+
+	first, err := LoadOrCreate(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadOrCreate(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp1, _ := LeafFingerprint(first)
+	fp2, _ := LeafFingerprint(second)
+	if fp1 != fp2 {
+		t.Fatalf("fingerprint changed across loads: %s, %s", fp1, fp2)
+	}
+	if info, err := os.Stat(keyPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("key file mode %v, %v; want 0600", info.Mode().Perm(), err)
+	}
+}
+
+func TestClientConfigVerify(t *testing.T) {
+	ca := newTestCA(t)
+	server, _ := issue(t, ca, IssueRequest{Kind: KindServer, Name: "vpn.example.com"})
+	device, _ := issue(t, ca, IssueRequest{Kind: KindClient, Name: "alice"})
+	self, err := GenerateSelfSignedConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfSigned := self.Certificates[0]
+
+	pin := Fingerprint(leaf(t, server))
+	hexPin := strings.TrimPrefix(pin, "sha256:")
+	var colons []string
+	for i := 0; i < len(hexPin); i += 2 {
+		colons = append(colons, strings.ToUpper(hexPin[i:i+2]))
+	}
+
+	tests := []struct {
+		name    string
+		pin     string
+		ca      []byte
+		cert    tls.Certificate
+		wantErr string // Empty if the server must be accepted
+	}{
+		{"pin", pin, nil, server, ""},
+		{"bare hex pin", hexPin, nil, server, ""},
+		{"openssl pin", strings.Join(colons, ":"), nil, server, ""},
+		{"pin mismatch", pin, nil, selfSigned, "fingerprint mismatch: expected " + pin},
+		{"CA", "", ca.CertPEM(), server, ""},
+		{"CA, self-signed server", "", ca.CertPEM(), selfSigned, "not signed by the configured CA"},
+		{"CA, client certificate", "", ca.CertPEM(), device, "not signed by the configured CA"},
+		{"pin and CA", pin, ca.CertPEM(), server, ""},
+		{"pin and CA, pin mismatch", Fingerprint(leaf(t, device)), ca.CertPEM(), server, "fingerprint mismatch"},
+	}
+	for _, tt := range tests {
+		conf, err := ClientConfig("www.example.com", tt.pin, tt.ca)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if conf.ServerName != "www.example.com" {
+			t.Errorf("%s: SNI %q", tt.name, conf.ServerName)
+		}
+		err = conf.VerifyPeerCertificate(tt.cert.Certificate, nil)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.wantErr != "" && (!errors.Is(err, ErrUntrustedServer) || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	if err := mustVerifier(t, pin).VerifyPeerCertificate(nil, nil); !errors.Is(err, ErrUntrustedServer) {
+		t.Errorf("no certificate: %v", err)
+	}
+}
+
+func mustVerifier(t *testing.T, pin string) *tls.Config {
+	t.Helper()
+	conf, err := ClientConfig("", pin, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+func TestClientConfigUnverified(t *testing.T) {
+	conf, err := ClientConfig("www.example.com", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.VerifyPeerCertificate != nil {
+		t.Error("server verified without a pin or CA")
+	}
+	junk := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("junk")})
+	if _, err := ClientConfig("", "", junk); err == nil {
+		t.Error("CA file without valid certificates accepted")
+	}
+}
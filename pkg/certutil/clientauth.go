@@ -0,0 +1,123 @@
+package certutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+)
+
+// ClientAuth verifies device certificates during the TLS handshake against a
+// CA and, optionally, its revocation list
+type ClientAuth struct {
+	mu      sync.RWMutex
+	ca      *x509.Certificate
+	roots   *x509.CertPool
+	crlPath string          // Empty disables revocation checks
+	revoked map[string]bool // Key: hex serial
+}
+
+// LoadClientAuth reads the client CA certificate and the CRL at crlPath
+func LoadClientAuth(caPath, crlPath string) (*ClientAuth, error) {
+	data, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+	a := &ClientAuth{roots: x509.NewCertPool(), crlPath: crlPath}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %v", caPath, err)
+		}
+		if a.ca == nil {
+			a.ca = c
+		}
+		a.roots.AddCert(c)
+	}
+	if a.ca == nil {
+		return nil, fmt.Errorf("%s: no PEM certificates", caPath)
+	}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload re-reads the CRL. On error the previous revocation list stays active.
+func (a *ClientAuth) Reload() error {
+	if a.crlPath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(a.crlPath)
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("parse %s: %v", a.crlPath, err)
+	}
+	// The first CA certificate signs the CRL
+	if err := crl.CheckSignatureFrom(a.ca); err != nil {
+		return fmt.Errorf("%s: %v", a.crlPath, err)
+	}
+
+	revoked := make(map[string]bool, len(crl.RevokedCertificateEntries))
+	for _, e := range crl.RevokedCertificateEntries {
+		revoked[e.SerialNumber.Text(16)] = true
+	}
+	a.mu.Lock()
+	a.revoked = revoked
+	a.mu.Unlock()
+	return nil
+}
+
+// Revoked reports whether serial is on the current revocation list
+func (a *ClientAuth) Revoked(serial *big.Int) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.revoked[serial.Text(16)]
+}
+
+// RevokedCount returns the number of entries on the current revocation list
+func (a *ClientAuth) RevokedCount() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.revoked)
+}
+
+// Apply makes conf require a client certificate that chains to the CA, is
+// not revoked and names its user in the subject CN
+func (a *ClientAuth) Apply(conf *tls.Config) {
+	conf.ClientAuth = tls.RequireAndVerifyClientCert
+	conf.ClientCAs = a.roots
+	conf.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("client certificate required")
+		}
+		leaf := cs.PeerCertificates[0]
+		if a.Revoked(leaf.SerialNumber) {
+			return fmt.Errorf("client certificate %s (%s) is revoked", leaf.SerialNumber.Text(16), leaf.Subject.CommonName)
+		}
+		if leaf.Subject.CommonName == "" {
+			return fmt.Errorf("client certificate %s has no common name", leaf.SerialNumber.Text(16))
+		}
+		return nil
+	}
+}
+
+// PeerIdentity returns the subject CN and hex serial of a verified client
+// certificate, or empty strings if the peer did not present one
+func PeerIdentity(cs tls.ConnectionState) (name, serial string) {
+	if len(cs.VerifiedChains) == 0 || len(cs.PeerCertificates) == 0 {
+		return "", ""
+	}
+	leaf := cs.PeerCertificates[0]
+	return leaf.Subject.CommonName, leaf.SerialNumber.Text(16)
+}
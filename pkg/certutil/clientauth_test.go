@@ -0,0 +1,143 @@
+package certutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// handshake runs a TLS handshake between a client presenting cert and a
+// server requiring certificates from auth
+func handshake(t *testing.T, auth *ClientAuth, server, cert tls.Certificate) (tls.ConnectionState, error) {
+	t.Helper()
+	serverConf := ServerConfig(server)
+	auth.Apply(serverConf)
+	clientConf, err := ClientConfig("", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConf.Certificates = []tls.Certificate{cert}
+
+	c, s := net.Pipe()
+	defer c.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client := tls.Client(c, clientConf)
+		client.Handshake()
+		client.Read(make([]byte, 1)) // Receives the server's verdict in TLS 1.3
+		c.Close()
+	}()
+	conn := tls.Server(s, serverConf)
+	err = conn.Handshake()
+	s.Close()
+	<-done
+	return conn.ConnectionState(), err
+}
+
+func TestClientAuthHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	server, _ := issue(t, ca, IssueRequest{Kind: KindServer, Name: "vpn.example.com"})
+	alice, aliceEntry := issue(t, ca, IssueRequest{Name: "alice"})
+	bob, _ := issue(t, ca, IssueRequest{Name: "bob"})
+	stranger, _ := issue(t, newTestCA(t), IssueRequest{Name: "alice"})
+
+	auth, err := LoadClientAuth(ca.path(CACertFile), ca.path(CRLFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := handshake(t, auth, server, alice)
+	if err != nil {
+		t.Fatalf("alice: %v", err)
+	}
+	if name, serial := PeerIdentity(cs); name != "alice" || serial != aliceEntry.Serial {
+		t.Fatalf("PeerIdentity = %s, %s; want alice, %s", name, serial, aliceEntry.Serial)
+	}
+	if _, err := handshake(t, auth, server, stranger); err == nil {
+		t.Fatal("certificate from another CA accepted")
+	}
+	if _, err := handshake(t, auth, server, server); err == nil {
+		t.Fatal("server certificate accepted as a client certificate")
+	}
+
+	// Revocation takes effect on reload
+	if _, err := ca.Revoke("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshake(t, auth, server, bob); err != nil {
+		t.Fatalf("bob before reload: %v", err)
+	}
+	if err := auth.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshake(t, auth, server, bob); err == nil {
+		t.Fatal("revoked certificate accepted")
+	}
+	if _, err := handshake(t, auth, server, alice); err != nil {
+		t.Fatalf("alice after reload: %v", err)
+	}
+	if n := auth.RevokedCount(); n != 1 {
+		t.Fatalf("%d revoked, want 1", n)
+	}
+}
+
+func TestClientAuthRejectsEmptyName(t *testing.T) {
+	ca := newTestCA(t)
+	server, _ := issue(t, ca, IssueRequest{Kind: KindServer, Name: "vpn.example.com"})
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := newSerial()
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"SloPN"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca.Cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := LoadClientAuth(ca.path(CACertFile), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshake(t, auth, server, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}); err == nil {
+		t.Fatal("certificate without a CN accepted")
+	}
+}
+
+func TestClientAuthReloadKeepsListOnError(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	_, entry := issue(t, ca, IssueRequest{Name: "alice"})
+	if _, err := ca.Revoke("alice"); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := LoadClientAuth(ca.path(CACertFile), ca.path(CRLFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A CRL signed by another CA is refused and the old list stays
+	_, otherEntry := issue(t, other, IssueRequest{Name: "bob"})
+	if _, err := other.Revoke(otherEntry.Serial); err != nil {
+		t.Fatal(err)
+	}
+	auth.crlPath = other.path(CRLFile)
+	if err := auth.Reload(); err == nil {
+		t.Fatal("CRL signed by another CA accepted")
+	}
+	serial, _ := new(big.Int).SetString(entry.Serial, 16)
+	if !auth.Revoked(serial) {
+		t.Fatal("revocation list lost after a failed reload")
+	}
+}
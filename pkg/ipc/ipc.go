@@ -14,13 +14,20 @@ const (
 )
 
 type Request struct {
-	Command    Command `json:"command"`
-	IPCSecret  string  `json:"ipc_secret,omitempty"`
-	ServerAddr string  `json:"server_addr,omitempty"`
-	Token      string  `json:"token,omitempty"`
-	SNI        string  `json:"sni,omitempty"`
-	FullTunnel bool    `json:"full_tunnel,omitempty"`
-	Obfuscate  bool    `json:"obfuscate,omitempty"`
+	Command           Command `json:"command"`
+	IPCSecret         string  `json:"ipc_secret,omitempty"`
+	ServerAddr        string  `json:"server_addr,omitempty"`
+	User              string  `json:"user,omitempty"`
+	Token             string  `json:"token,omitempty"`
+	ObfsSecret        string  `json:"obfs_secret,omitempty"` // Reality secret; defaults to Token
+	SNI               string  `json:"sni,omitempty"`
+	ServerFingerprint string  `json:"server_fingerprint,omitempty"` // Pinned server key, "sha256:<hex>"
+	ServerCA          string  `json:"server_ca,omitempty"`          // PEM CA bundle the server cert must chain to
+	ClientCert        string  `json:"client_cert,omitempty"`        // PEM device certificate for mutual TLS
+	ClientKey         string  `json:"client_key,omitempty"`         // PEM private key for ClientCert
+	FullTunnel        bool    `json:"full_tunnel,omitempty"`
+	Obfuscate         bool    `json:"obfuscate,omitempty"`
+	KillSwitch        bool    `json:"kill_switch,omitempty"` // Block non-tunnel traffic until explicit disconnect
 }
 
 type Response struct {
@@ -33,13 +40,26 @@ type Stats struct {
 	BytesSent uint64 `json:"bytes_sent"`
 	BytesRecv uint64 `json:"bytes_recv"`
 	Uptime    int64  `json:"uptime_seconds"`
+	Quota     *Quota `json:"quota,omitempty"` // Nil unless the server enforces a quota
+}
+
+type Quota struct {
+	Period         string `json:"period"` // "day" or "month"
+	LimitBytes     uint64 `json:"limit_bytes"`
+	UsedBytes      uint64 `json:"used_bytes"`
+	RemainingBytes uint64 `json:"remaining_bytes"`
+	Resets         int64  `json:"resets"` // Unix time
+	Exceeded       bool   `json:"exceeded,omitempty"`
+	Action         string `json:"action,omitempty"` // "disconnect" or "throttle"
 }
 
 type Status struct {
-	State         string `json:"state"` // "connected", "disconnected", "connecting"
+	State         string `json:"state"` // "connected", "disconnected", "connecting", "reconnecting"
 	AssignedVIP   string `json:"assigned_vip,omitempty"`
+	AssignedVIP6  string `json:"assigned_vip6,omitempty"`
 	ServerVIP     string `json:"server_vip,omitempty"`
 	ServerAddr    string `json:"server_addr,omitempty"`
 	HelperVersion string `json:"helper_version,omitempty"`
 	ServerVersion string `json:"server_version,omitempty"`
+	KillSwitch    bool   `json:"kill_switch,omitempty"` // Non-tunnel traffic is currently blocked
 }
@@ -8,13 +8,36 @@ import (
 
 // Protocol constants
 const (
-	ProtoICMP = 1
-	ProtoTCP  = 6
-	ProtoUDP  = 17
+	ProtoICMP   = 1
+	ProtoTCP    = 6
+	ProtoUDP    = 17
+	ProtoICMPv6 = 58
 )
 
-// detectOffset finds where the IPv4 header starts (0x45)
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+)
+
+// detectOffset finds where the IP header starts. Packets normally start at 0;
+// a 4-byte PI/AF header is recognised by the version nibble that follows it.
 func detectOffset(packet []byte) int {
+	for _, off := range []int{0, 4} {
+		if len(packet) <= off {
+			break
+		}
+		switch packet[off] >> 4 {
+		case 4:
+			if len(packet) >= off+ipv4HeaderLen && packet[off]&0x0f >= 5 {
+				return off
+			}
+		case 6:
+			if len(packet) >= off+ipv6HeaderLen {
+				return off
+			}
+		}
+	}
+	// Legacy fallback: scan for a plain IPv4 header (0x45)
 	for i := 0; i < len(packet)-20; i++ {
 		if packet[i] == 0x45 {
 			return i
@@ -23,31 +46,87 @@ func detectOffset(packet []byte) int {
 	return 0
 }
 
-// GetDestinationIP extracts the destination IPv4 address from a raw packet
+// Version returns the IP version (4 or 6) of a raw packet, or 0 if unknown
+func Version(packet []byte) int {
+	offset := detectOffset(packet)
+	if len(packet) <= offset {
+		return 0
+	}
+	switch v := int(packet[offset] >> 4); v {
+	case 4:
+		if len(packet) >= offset+ipv4HeaderLen {
+			return v
+		}
+	case 6:
+		if len(packet) >= offset+ipv6HeaderLen {
+			return v
+		}
+	}
+	return 0
+}
+
+// GetDestinationIP extracts the destination IPv4/IPv6 address from a raw packet
 func GetDestinationIP(packet []byte) net.IP {
 	offset := detectOffset(packet)
-	if len(packet) < 20+offset {
-		return nil
+	switch Version(packet) {
+	case 4:
+		return net.IP(packet[16+offset : 20+offset])
+	case 6:
+		return net.IP(packet[24+offset : 40+offset])
 	}
-	return net.IP(packet[16+offset : 20+offset])
+	return nil
 }
 
-// GetSourceIP extracts the source IPv4 address from a raw packet
+// GetSourceIP extracts the source IPv4/IPv6 address from a raw packet
 func GetSourceIP(packet []byte) net.IP {
 	offset := detectOffset(packet)
-	if len(packet) < 20+offset {
-		return nil
+	switch Version(packet) {
+	case 4:
+		return net.IP(packet[12+offset : 16+offset])
+	case 6:
+		return net.IP(packet[8+offset : 24+offset])
 	}
-	return net.IP(packet[12+offset : 16+offset])
+	return nil
 }
 
-// GetProtocol returns the protocol number from the IPv4 header
+// GetProtocol returns the protocol number from the IPv4 header, or the
+// Next Header field for IPv6 (extension headers are not followed)
 func GetProtocol(packet []byte) int {
 	offset := detectOffset(packet)
-	if len(packet) < 20+offset {
-		return -1
+	switch Version(packet) {
+	case 4:
+		return int(packet[9+offset])
+	case 6:
+		return int(packet[6+offset])
 	}
-	return int(packet[9+offset])
+	return -1
+}
+
+// GetPorts returns the TCP or UDP source and destination ports. ok is false
+// for other protocols, truncated packets and non-first IPv4 fragments.
+func GetPorts(packet []byte) (src, dst int, ok bool) {
+	offset := detectOffset(packet)
+	var l4 int
+	switch Version(packet) {
+	case 4:
+		if packet[6+offset]&0x1f != 0 || packet[7+offset] != 0 {
+			return 0, 0, false // Fragment offset set: no transport header
+		}
+		l4 = offset + int(packet[offset]&0x0f)*4
+	case 6:
+		l4 = offset + ipv6HeaderLen
+	default:
+		return 0, 0, false
+	}
+	if p := GetProtocol(packet); p != ProtoTCP && p != ProtoUDP {
+		return 0, 0, false
+	}
+	if len(packet) < l4+4 {
+		return 0, 0, false
+	}
+	src = int(packet[l4])<<8 | int(packet[l4+1])
+	dst = int(packet[l4+2])<<8 | int(packet[l4+3])
+	return src, dst, true
 }
 
 // FormatPacketSummary returns a one-line summary of the packet
@@ -65,6 +144,8 @@ func FormatPacketSummary(packet []byte) string {
 	switch proto {
 	case ProtoICMP:
 		summary += "ICMP"
+	case ProtoICMPv6:
+		summary += "ICMPv6"
 	case ProtoTCP:
 		summary += "TCP"
 	case ProtoUDP:
@@ -88,6 +169,9 @@ func StripHeader(packet []byte) []byte {
 func AddHeader(packet []byte, isLinux bool) []byte {
 	if isLinux {
 		header := []byte{0x00, 0x00, 0x08, 0x00}
+		if len(packet) > 0 && packet[0]>>4 == 6 {
+			header[2], header[3] = 0x86, 0xdd
+		}
 		res := make([]byte, len(header)+len(packet))
 		copy(res, header)
 		copy(res[len(header):], packet)
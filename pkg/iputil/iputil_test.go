@@ -0,0 +1,136 @@
+package iputil
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// v4Packet builds an IPv4 packet with a 20-byte header and a 4-byte port pair
+func v4Packet(proto int, src, dst string) []byte {
+	b := make([]byte, 24)
+	b[0] = 0x45
+	b[9] = byte(proto)
+	copy(b[12:16], net.ParseIP(src).To4())
+	copy(b[16:20], net.ParseIP(dst).To4())
+	copy(b[20:], []byte{0x1f, 0x90, 0x00, 0x35}) // 8080 -> 53
+	return b
+}
+
+// v6Packet builds an IPv6 packet with a 4-byte port pair
+func v6Packet(proto int, src, dst string) []byte {
+	b := make([]byte, 44)
+	b[0] = 0x60
+	b[6] = byte(proto)
+	copy(b[8:24], net.ParseIP(src))
+	copy(b[24:40], net.ParseIP(dst))
+	copy(b[40:], []byte{0x1f, 0x90, 0x00, 0x35})
+	return b
+}
+
+func withHeader(header, packet []byte) []byte {
+	return append(append([]byte(nil), header...), packet...)
+}
+
+var (
+	utun4 = []byte{0, 0, 0, 2}  // macOS utun, AF_INET
+	utun6 = []byte{0, 0, 0, 30} // macOS utun, AF_INET6
+	pi4   = []byte{0, 0, 0x08, 0x00}
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		packet   []byte
+		version  int
+		src, dst string
+		proto    int
+		ports    bool
+		offset   int
+	}{
+		{"v4 udp", v4Packet(ProtoUDP, "10.0.0.1", "10.0.0.2"), 4, "10.0.0.1", "10.0.0.2", ProtoUDP, true, 0},
+		{"v4 tcp behind utun", withHeader(utun4, v4Packet(ProtoTCP, "10.0.0.1", "10.0.0.2")), 4, "10.0.0.1", "10.0.0.2", ProtoTCP, true, 4},
+		{"v4 icmp behind PI", withHeader(pi4, v4Packet(ProtoICMP, "10.0.0.1", "10.0.0.2")), 4, "10.0.0.1", "10.0.0.2", ProtoICMP, false, 4},
+		{"v6 udp", v6Packet(ProtoUDP, "fd00::1", "fd00::2"), 6, "fd00::1", "fd00::2", ProtoUDP, true, 0},
+		{"v6 tcp behind utun", withHeader(utun6, v6Packet(ProtoTCP, "fd00::1", "2001:db8::2")), 6, "fd00::1", "2001:db8::2", ProtoTCP, true, 4},
+		{"v6 icmp", v6Packet(ProtoICMPv6, "fe80::1", "ff02::2"), 6, "fe80::1", "ff02::2", ProtoICMPv6, false, 0},
+		{"v4 behind junk", withHeader([]byte{1, 2, 3, 4, 5, 6}, v4Packet(ProtoUDP, "10.0.0.1", "10.0.0.2")), 4, "10.0.0.1", "10.0.0.2", ProtoUDP, true, 6},
+	}
+	for _, tt := range tests {
+		if v := Version(tt.packet); v != tt.version {
+			t.Errorf("%s: Version = %d, want %d", tt.name, v, tt.version)
+		}
+		if src := GetSourceIP(tt.packet); !src.Equal(net.ParseIP(tt.src)) {
+			t.Errorf("%s: source %v, want %s", tt.name, src, tt.src)
+		}
+		if dst := GetDestinationIP(tt.packet); !dst.Equal(net.ParseIP(tt.dst)) {
+			t.Errorf("%s: destination %v, want %s", tt.name, dst, tt.dst)
+		}
+		if p := GetProtocol(tt.packet); p != tt.proto {
+			t.Errorf("%s: protocol %d, want %d", tt.name, p, tt.proto)
+		}
+		src, dst, ok := GetPorts(tt.packet)
+		if ok != tt.ports || (ok && (src != 8080 || dst != 53)) {
+			t.Errorf("%s: ports %d -> %d, %v; want 8080 -> 53, %v", tt.name, src, dst, ok, tt.ports)
+		}
+		if off := len(tt.packet) - len(StripHeader(tt.packet)); off != tt.offset {
+			t.Errorf("%s: header of %d bytes stripped, want %d", tt.name, off, tt.offset)
+		}
+	}
+}
+
+func TestGetPortsFragment(t *testing.T) {
+	p := v4Packet(ProtoUDP, "10.0.0.1", "10.0.0.2")
+	p[7] = 1 // Fragment offset 8: no UDP header here
+	if _, _, ok := GetPorts(p); ok {
+		t.Error("ports read from a non-first fragment")
+	}
+	p = v4Packet(ProtoUDP, "10.0.0.1", "10.0.0.2")
+	p[0] = 0x46 // Options announced but not there
+	if _, _, ok := GetPorts(p); ok {
+		t.Error("ports read past the end of the packet")
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	for _, packet := range [][]byte{
+		v4Packet(ProtoTCP, "10.0.0.1", "10.0.0.2"),
+		v6Packet(ProtoTCP, "fd00::1", "fd00::2"),
+		withHeader(utun6, v6Packet(ProtoUDP, "fd00::1", "fd00::2")),
+		withHeader(pi4, v4Packet(ProtoUDP, "10.0.0.1", "10.0.0.2")),
+	} {
+		for n := 0; n < len(packet); n++ {
+			p := packet[:n]
+			// None of these may panic; whatever they return must be consistent
+			v := Version(p)
+			src, dst := GetSourceIP(p), GetDestinationIP(p)
+			GetProtocol(p)
+			GetPorts(p)
+			FormatPacketSummary(p)
+			StripHeader(p)
+			if (v == 0) != (src == nil) || (v == 0) != (dst == nil) {
+				t.Errorf("%d of %d bytes: version %d with addresses %v, %v", n, len(packet), v, src, dst)
+			}
+		}
+	}
+}
+
+func TestAddHeader(t *testing.T) {
+	v4 := v4Packet(ProtoUDP, "10.0.0.1", "10.0.0.2")
+	v6 := v6Packet(ProtoUDP, "fd00::1", "fd00::2")
+	tests := []struct {
+		packet []byte
+		linux  bool
+		want   []byte
+	}{
+		{v4, true, withHeader(pi4, v4)},
+		{v6, true, withHeader([]byte{0, 0, 0x86, 0xdd}, v6)},
+		{v4, false, v4},
+		{v6, false, v6},
+	}
+	for i, tt := range tests {
+		if got := AddHeader(tt.packet, tt.linux); !bytes.Equal(got, tt.want) {
+			t.Errorf("case %d: header % x, want % x", i+1, got[:4], tt.want[:4])
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package obfuscator
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// FilterConn drops packets from refused sources before the QUIC stack sees
+// them. It is the plain counterpart of RealityConn.SetRefuse for servers
+// running without obfuscation.
+type FilterConn struct {
+	net.PacketConn
+	refuse  func(addr net.Addr) bool
+	refused atomic.Uint64
+}
+
+func NewFilterConn(conn net.PacketConn, refuse func(addr net.Addr) bool) *FilterConn {
+	return &FilterConn{PacketConn: conn, refuse: refuse}
+}
+
+func (c *FilterConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(p)
+		if err != nil || !c.refuse(addr) {
+			return n, addr, err
+		}
+		c.refused.Add(1)
+	}
+}
+
+// Refused returns the number of packets dropped
+func (c *FilterConn) Refused() uint64 {
+	return c.refused.Load()
+}
+
+// Buffer optimizations for quic-go
+func (c *FilterConn) SetReadBuffer(bytes int) error {
+	if u, ok := c.PacketConn.(interface{ SetReadBuffer(int) error }); ok {
+		return u.SetReadBuffer(bytes)
+	}
+	return nil
+}
+
+func (c *FilterConn) SetWriteBuffer(bytes int) error {
+	if u, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error }); ok {
+		return u.SetWriteBuffer(bytes)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package obfuscator
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	banned  = &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4242}
+	allowed = &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4242}
+)
+
+func refuseBanned(addr net.Addr) bool {
+	return addr.(*net.UDPAddr).IP.Equal(banned.IP)
+}
+
+func TestFilterConnDropsRefused(t *testing.T) {
+	q := &queueConn{
+		in:    [][]byte{[]byte("probe"), []byte("first"), []byte("probe"), []byte("probe"), []byte("second")},
+		froms: []net.Addr{banned, allowed, banned, banned, allowed},
+	}
+	c := NewFilterConn(q, refuseBanned)
+	p := make([]byte, 64)
+	for _, want := range []string{"first", "second"} {
+		n, addr, err := c.ReadFrom(p)
+		if err != nil || string(p[:n]) != want || addr != allowed {
+			t.Fatalf("ReadFrom = %q from %v, %v; want %q from %v", p[:n], addr, err, want, allowed)
+		}
+	}
+	if _, _, err := c.ReadFrom(p); err == nil {
+		t.Fatal("ReadFrom passed on a refused packet")
+	}
+	if n := c.Refused(); n != 3 {
+		t.Fatalf("%d refused, want 3", n)
+	}
+}
+
+func TestRealityConnMirrorsRefused(t *testing.T) {
+	mimic, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mimic.Close()
+
+	q := &queueConn{}
+	server := NewRealityConn(q, "secret", mimic.LocalAddr().String())
+	server.SetRefuse(refuseBanned)
+	// Even a valid header does not get a refused source past the check
+	fromBanned := v2Packet(server, 31, time.Now(), []byte("banned"))
+	q.in = [][]byte{fromBanned, v2Packet(server, 32, time.Now(), []byte("hello"))}
+	q.froms = []net.Addr{banned, allowed}
+
+	p := make([]byte, 2048)
+	n, addr, err := server.ReadFrom(p)
+	if err != nil || string(p[:n]) != "hello" || addr != allowed {
+		t.Fatalf("ReadFrom = %q from %v, %v; want hello from %v", p[:n], addr, err, allowed)
+	}
+	if n := server.Refused(); n != 1 {
+		t.Fatalf("%d refused, want 1", n)
+	}
+	if server.peers[banned.String()] != nil {
+		t.Fatal("refused source tracked as a peer")
+	}
+
+	// The refused packet went to the mimic target unchanged
+	mimic.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err = mimic.ReadFrom(p)
+	if err != nil || string(p[:n]) != string(fromBanned) {
+		t.Fatalf("mimic got %d bytes, %v; want the refused packet", n, err)
+	}
+	if active, total := server.MirrorStats(); active != 1 || total != 1 {
+		t.Fatalf("mirror stats %d active, %d total; want 1, 1", active, total)
+	}
+}
@@ -1,15 +1,19 @@
 package obfuscator
 
 import (
+	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/hkdf"
 )
 
@@ -18,19 +22,48 @@ import (
 // to clean QUIC flows after authorization.
 type RealityConn struct {
 	net.PacketConn
-	key         []byte
-	authKey     []byte
-	mimicAddr   *net.UDPAddr
+	key         []byte       // v1: XOR mask
+	authKey     []byte       // v1: header HMAC
+	aead        cipher.AEAD  // v2: payload encryption
+	checkKey    []byte       // v2: header check HMAC
+	legacy      bool         // Accept v1 headers
+	mimicAddr   *net.UDPAddr // Guarded by proxyMu
 	pool        *sync.Pool
 	
 	// proxySessions tracks unauthorized probes for mirroring
 	proxySessions map[string]*proxySession
 	proxyMu       sync.RWMutex
+	mirrored      atomic.Uint64 // Probe sessions mirrored since start
 
-	// FPO (First-Packet-Obfuscation) state
-	authIPs     map[string]time.Time
+	// refuse, if set, rejects sources before any other processing
+	refuse  func(addr net.Addr) bool
+	refused atomic.Uint64
+
+	// FPO (First-Packet-Obfuscation) state, per remote address. The local
+	// side is fixed, so this is per 4-tuple.
+	peers       map[string]*peer
 	handshakeMu sync.RWMutex
-	sentCount   map[string]int
+	accepted    [3]atomic.Uint64 // FPO packets accepted, by version
+
+	// Salts of recently accepted FPO headers, in two generations of
+	// replayWindow each, so a recorded packet cannot be replayed
+	seenMu     sync.Mutex
+	seen, prev map[[16]byte]struct{}
+	seenSince  time.Time
+	stale      atomic.Uint64 // Headers rejected for their timestamp
+	replayed   atomic.Uint64 // Headers rejected as duplicates
+}
+
+// peer is the FPO state of one remote address
+type peer struct {
+	authorized bool         // Sent a valid FPO packet, so clean packets pass
+	legacy     bool         // Sent v1 headers, so gets v1 back
+	sent       int          // FPO packets sent, up to HandshakeLimit
+	lastActive atomic.Int64 // Unix time of the last packet either way
+}
+
+func (p *peer) touch() {
+	p.lastActive.Store(time.Now().Unix())
 }
 
 type proxySession struct {
@@ -38,11 +71,27 @@ type proxySession struct {
 	lastActive time.Time
 }
 
+// FPO header versions. Each derives its keys with its own HKDF info string
+// ("slopn-reality-v1", "slopn-reality-v2"), so a receiver can tell them apart.
+const (
+	FPOv1 = 1 // Repeating-key XOR; accepted during the rollout of v2
+	FPOv2 = 2 // ChaCha20-Poly1305
+)
+
 const (
-	// MagicHeaderLen is Salt (8b) + HMAC-SHA256 (24b)
+	// MagicHeaderLen is the v1 header: Salt (8b, random) + HMAC-SHA256 (24b)
 	MagicHeaderLen = 32
+	// HeaderLenV2 is Salt (16b: nonce 12b + Unix time 4b) + HMAC-SHA256 check (8b).
+	// The check lets clean QUIC packets be told apart cheaply; the payload
+	// after it is sealed with ChaCha20-Poly1305, using the header as
+	// additional data.
+	HeaderLenV2    = 24
+	maxPadding     = 31
+	MaxClockSkew   = 2 * time.Minute  // FPO headers older or newer than this are stale
+	replayWindow   = 2 * MaxClockSkew // A salt can be replayed for this long
+	maxSeenSalts   = 1 << 17          // Per generation; beyond this new headers count as replayed
 	ProxyTimeout   = 2 * time.Minute
-	AuthTimeout    = 1 * time.Hour
+	PeerTimeout    = 2 * time.Minute // FPO state of an idle address is dropped after this
 	HandshakeLimit = 20 // Number of packets to obfuscate before switching to clean mode
 )
 
@@ -55,6 +104,13 @@ func NewRealityConn(conn net.PacketConn, secret string, mimicTarget string) *Rea
 	io.ReadFull(kdf, key)
 	io.ReadFull(kdf, authKey)
 
+	kdf = hkdf.New(hash, []byte(secret), nil, []byte("slopn-reality-v2"))
+	aeadKey := make([]byte, chacha20poly1305.KeySize)
+	checkKey := make([]byte, 32)
+	io.ReadFull(kdf, aeadKey)
+	io.ReadFull(kdf, checkKey)
+	aead, _ := chacha20poly1305.New(aeadKey) // Only fails for a wrong key size
+
 	var mAddr *net.UDPAddr
 	if mimicTarget != "" {
 		mAddr, _ = net.ResolveUDPAddr("udp", mimicTarget)
@@ -64,10 +120,13 @@ func NewRealityConn(conn net.PacketConn, secret string, mimicTarget string) *Rea
 		PacketConn: conn,
 		key:        key,
 		authKey:    authKey,
+		aead:       aead,
+		checkKey:   checkKey,
 		mimicAddr:  mAddr,
 		proxySessions: make(map[string]*proxySession),
-		authIPs:       make(map[string]time.Time),
-		sentCount:     make(map[string]int),
+		peers:         make(map[string]*peer),
+		seen:          make(map[[16]byte]struct{}),
+		seenSince:     time.Now(),
 		pool: &sync.Pool{
 			New: func() interface{} {
 				return make([]byte, 2048)
@@ -79,6 +138,121 @@ func NewRealityConn(conn net.PacketConn, secret string, mimicTarget string) *Rea
 	return rc
 }
 
+// SetMimic changes the target unauthorized probes are mirrored to. Probes
+// already being mirrored keep their target until they go idle.
+func (c *RealityConn) SetMimic(target string) error {
+	var mAddr *net.UDPAddr
+	if target != "" {
+		var err error
+		if mAddr, err = net.ResolveUDPAddr("udp", target); err != nil {
+			return err
+		}
+	}
+	c.proxyMu.Lock()
+	c.mimicAddr = mAddr
+	c.proxyMu.Unlock()
+	return nil
+}
+
+// SetLegacy controls whether v1 headers are accepted (off by default). Peers
+// that send v1 get v1 replies; all others get v2. Call it before the conn is used.
+func (c *RealityConn) SetLegacy(accept bool) {
+	c.legacy = accept
+}
+
+// AcceptedHeaders reports the FPO packets accepted per version since start
+func (c *RealityConn) AcceptedHeaders() (v1, v2 uint64) {
+	return c.accepted[FPOv1].Load(), c.accepted[FPOv2].Load()
+}
+
+// SetRefuse installs a check run on every received packet before anything
+// else. Packets from refused sources (e.g. banned addresses) are treated like
+// unauthorized probes: mirrored to the mimic target, never passed to QUIC.
+// Call it before the conn is used.
+func (c *RealityConn) SetRefuse(refuse func(addr net.Addr) bool) {
+	c.refuse = refuse
+}
+
+// Refused returns the number of packets rejected by the refuse check
+func (c *RealityConn) Refused() uint64 {
+	return c.refused.Load()
+}
+
+// RejectedHeaders reports the FPO headers with a valid signature that were
+// refused as stale (outside MaxClockSkew) or replayed
+func (c *RealityConn) RejectedHeaders() (stale, replayed uint64) {
+	return c.stale.Load(), c.replayed.Load()
+}
+
+// timely checks the Unix time in the last 4 bytes of an authenticated v2 salt
+func (c *RealityConn) timely(salt []byte) bool {
+	sent := time.Unix(int64(binary.BigEndian.Uint32(salt[len(salt)-4:])), 0)
+	if d := time.Since(sent); d > MaxClockSkew || d < -MaxClockSkew {
+		c.stale.Add(1)
+		return false
+	}
+	return true
+}
+
+// remember records an authenticated salt, so that the same header is
+// accepted only once. It reports false for a replay.
+func (c *RealityConn) remember(salt []byte) bool {
+	now := time.Now()
+	var key [16]byte
+	copy(key[:], salt)
+	c.seenMu.Lock()
+	defer c.seenMu.Unlock()
+	if now.Sub(c.seenSince) >= replayWindow {
+		c.prev, c.seen, c.seenSince = c.seen, make(map[[16]byte]struct{}), now
+	}
+	_, dup := c.seen[key]
+	if !dup {
+		_, dup = c.prev[key]
+	}
+	if dup || len(c.seen) >= maxSeenSalts {
+		c.replayed.Add(1)
+		return false
+	}
+	c.seen[key] = struct{}{}
+	return true
+}
+
+// peer returns the state of addr, creating it. Callers hold handshakeMu.
+func (c *RealityConn) peer(addr string) *peer {
+	p := c.peers[addr]
+	if p == nil {
+		p = &peer{}
+		p.touch()
+		c.peers[addr] = p
+	}
+	return p
+}
+
+// Forget drops the FPO state of addr, e.g. when the QUIC connection on it
+// closes. Further clean packets from addr are mirrored; a new connection has
+// to pass FPO again.
+func (c *RealityConn) Forget(addr net.Addr) {
+	c.handshakeMu.Lock()
+	delete(c.peers, addr.String())
+	c.handshakeMu.Unlock()
+}
+
+// Peers returns the number of remote addresses with FPO state
+func (c *RealityConn) Peers() int {
+	c.handshakeMu.RLock()
+	defer c.handshakeMu.RUnlock()
+	return len(c.peers)
+}
+
+// MirrorStats reports the probe sessions currently mirrored to the mimic
+// target and the total since start
+func (c *RealityConn) MirrorStats() (active int, total uint64) {
+	c.proxyMu.RLock()
+	active = len(c.proxySessions)
+	c.proxyMu.RUnlock()
+	return active, c.mirrored.Load()
+}
+
 func (c *RealityConn) cleanupLoop() {
 	ticker := time.NewTicker(1 * time.Minute)
 	for range ticker.C {
@@ -91,11 +265,13 @@ func (c *RealityConn) cleanupLoop() {
 		}
 		c.proxyMu.Unlock()
 
+		// Peers are normally forgotten when their QUIC connection closes;
+		// this catches failed handshakes and paths that were only probed
+		idle := time.Now().Add(-PeerTimeout).Unix()
 		c.handshakeMu.Lock()
-		for addr, t := range c.authIPs {
-			if time.Since(t) > AuthTimeout {
-				delete(c.authIPs, addr)
-				delete(c.sentCount, addr)
+		for addr, p := range c.peers {
+			if p.lastActive.Load() < idle {
+				delete(c.peers, addr)
 			}
 		}
 		c.handshakeMu.Unlock()
@@ -124,43 +300,39 @@ func (c *RealityConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 			return 0, addr, err
 		}
 
+		if c.refuse != nil && c.refuse(addr) {
+			c.refused.Add(1)
+			c.handleMirror(buf[:n], addr)
+			continue
+		}
+
 		remoteKey := addr.String()
-		ip, _, _ := net.SplitHostPort(remoteKey)
 
 		// 1. Try to parse as FPO (First-Packet-Obfuscation)
-		// Even if whitelisted, we check for FPO first to handle the overlap period
-		if n >= MagicHeaderLen {
-			salt := buf[:8]
-			signature := buf[8:32]
-			mac := hmac.New(sha256.New, c.authKey)
-			mac.Write(salt)
-			expected := mac.Sum(nil)[:24]
-
-			if hmac.Equal(signature, expected) {
-				padLen := int(salt[0] & 31)
-				realPayloadLen := n - MagicHeaderLen - padLen
-				if realPayloadLen >= 0 {
-					// Promotion: Ensure IP is whitelisted
-					c.handshakeMu.Lock()
-					if _, exists := c.authIPs[ip]; !exists {
-						c.authIPs[ip] = time.Now()
-					}
-					c.handshakeMu.Unlock()
-
-					payload := buf[MagicHeaderLen : MagicHeaderLen+realPayloadLen]
-					c.xor(payload, salt)
-					copy(p, payload)
-					return realPayloadLen, addr, nil
-				}
-			}
+		// Even if whitelisted, we check for FPO first to handle the overlap period.
+		// A stale, replayed or forged header is handled like any other
+		// unauthenticated packet below.
+		if size, version := c.open(p, buf[:n]); version != 0 {
+			// Promotion: Whitelist this address (not the whole IP, which
+			// may be shared by other hosts behind a NAT)
+			c.handshakeMu.Lock()
+			pr := c.peer(remoteKey)
+			pr.authorized = true
+			pr.legacy = version == FPOv1
+			c.handshakeMu.Unlock()
+			pr.touch()
+			c.accepted[version].Add(1)
+			return size, addr, nil
 		}
 
 		// 2. Fallback Path: Clean QUIC (only if whitelisted)
 		c.handshakeMu.RLock()
-		_, whitelisted := c.authIPs[ip]
+		pr := c.peers[remoteKey]
+		whitelisted := pr != nil && pr.authorized
 		c.handshakeMu.RUnlock()
 
 		if whitelisted {
+			pr.touch()
 			copy(p, buf[:n])
 			return n, addr, nil
 		}
@@ -170,13 +342,61 @@ func (c *RealityConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	}
 }
 
-func (c *RealityConn) handleMirror(data []byte, addr net.Addr) {
-	if c.mimicAddr == nil {
-		return
+// open authenticates an FPO packet and unmasks its payload into p, leaving
+// data untouched. version is 0 unless data is a fresh FPO packet of an
+// accepted version.
+func (c *RealityConn) open(p, data []byte) (n int, version int) {
+	if len(data) >= HeaderLenV2+chacha20poly1305.Overhead {
+		salt, check := data[:16], data[16:HeaderLenV2]
+		mac := hmac.New(sha256.New, c.checkKey)
+		mac.Write(salt)
+		if hmac.Equal(check, mac.Sum(nil)[:8]) {
+			// The padding length comes from the salt, so it can exceed
+			// what a truncated packet has left
+			end := len(data) - int(salt[0]&maxPadding)
+			if end < HeaderLenV2+chacha20poly1305.Overhead {
+				return 0, 0
+			}
+			sealed := data[HeaderLenV2:end]
+			if len(p) < len(sealed)-chacha20poly1305.Overhead || !c.timely(salt) {
+				return 0, 0
+			}
+			payload, err := c.aead.Open(p[:0], salt[:12], sealed, data[:HeaderLenV2])
+			if err != nil || !c.remember(salt) {
+				return 0, 0
+			}
+			return len(payload), FPOv2
+		}
 	}
 
+	if !c.legacy || len(data) < MagicHeaderLen {
+		return 0, 0
+	}
+	salt := data[:8]
+	signature := data[8:32]
+	mac := hmac.New(sha256.New, c.authKey)
+	mac.Write(salt)
+	expected := mac.Sum(nil)[:24]
+	if !hmac.Equal(signature, expected) {
+		return 0, 0
+	}
+	n = len(data) - MagicHeaderLen - int(salt[0]&maxPadding)
+	// v1 salts carry no time, so only the replay cache applies
+	if n < 0 || len(p) < n || !c.remember(salt) {
+		return 0, 0
+	}
+	copy(p, data[MagicHeaderLen:MagicHeaderLen+n])
+	c.xor(p[:n], salt)
+	return n, FPOv1
+}
+
+func (c *RealityConn) handleMirror(data []byte, addr net.Addr) {
 	remoteKey := addr.String()
 	c.proxyMu.Lock()
+	if c.mimicAddr == nil {
+		c.proxyMu.Unlock()
+		return
+	}
 	sess, exists := c.proxySessions[remoteKey]
 	if !exists {
 		conn, err := net.DialUDP("udp", nil, c.mimicAddr)
@@ -186,6 +406,7 @@ func (c *RealityConn) handleMirror(data []byte, addr net.Addr) {
 		}
 		sess = &proxySession{conn: conn, lastActive: time.Now()}
 		c.proxySessions[remoteKey] = sess
+		c.mirrored.Add(1)
 		
 		go func(clientAddr net.Addr, proxyConn *net.UDPConn, key string) {
 			buf := make([]byte, 2048)
@@ -215,45 +436,88 @@ func (c *RealityConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 
 	// 1. Check if we should use Clean Mode
 	c.handshakeMu.Lock()
-	count := c.sentCount[remoteKey]
-	if count >= HandshakeLimit {
+	pr := c.peer(remoteKey)
+	pr.touch()
+	if pr.sent >= HandshakeLimit {
 		c.handshakeMu.Unlock()
 		return c.PacketConn.WriteTo(p, addr)
 	}
-	c.sentCount[remoteKey]++
+	pr.sent++
+	legacy := pr.legacy
 	c.handshakeMu.Unlock()
 
 	// 2. FPO Mode: Obfuscate packet
 	buf := c.pool.Get().([]byte)
 	defer c.pool.Put(buf)
 
+	var size int
+	if legacy {
+		size, err = c.sealV1(buf, p)
+	} else {
+		size, err = c.seal(buf, p)
+	}
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.PacketConn.WriteTo(buf[:size], addr)
+	return len(p), err
+}
+
+// seal writes p to buf as a v2 FPO packet and returns its length
+func (c *RealityConn) seal(buf, p []byte) (int, error) {
+	if HeaderLenV2+len(p)+chacha20poly1305.Overhead+maxPadding > len(buf) {
+		return 0, fmt.Errorf("packet too large for FPO: %d bytes", len(p))
+	}
+
+	// Salt(16): the nonce comes first, as it also picks the padding length
+	salt := buf[:16]
+	rand.Read(salt[:12])
+	binary.BigEndian.PutUint32(salt[12:], uint32(time.Now().Unix()))
+
+	mac := hmac.New(sha256.New, c.checkKey)
+	mac.Write(salt)
+	copy(buf[16:HeaderLenV2], mac.Sum(nil)[:8])
+
+	sealed := c.aead.Seal(buf[HeaderLenV2:HeaderLenV2], salt[:12], p, buf[:HeaderLenV2])
+	total := HeaderLenV2 + len(sealed)
+
+	// Add random padding (0-31 bytes) to break packet size signatures
+	padLen := int(salt[0] & maxPadding)
+	rand.Read(buf[total : total+padLen])
+	return total + padLen, nil
+}
+
+// sealV1 writes p to buf as a v1 FPO packet, for peers that have not
+// moved to v2 yet
+func (c *RealityConn) sealV1(buf, p []byte) (int, error) {
+	if MagicHeaderLen+len(p) > len(buf) {
+		return 0, fmt.Errorf("packet too large for FPO: %d bytes", len(p))
+	}
+
 	// Prepend Header: Salt(8) + HMAC(24)
 	salt := make([]byte, 8)
 	rand.Read(salt)
-	
+
 	mac := hmac.New(sha256.New, c.authKey)
 	mac.Write(salt)
 	signature := mac.Sum(nil)[:24]
 
 	copy(buf[0:8], salt)
 	copy(buf[8:32], signature)
-	
+
 	payload := buf[MagicHeaderLen : MagicHeaderLen+len(p)]
 	copy(payload, p)
 	c.xor(payload, salt)
 
 	// Add random padding (0-31 bytes) to break packet size signatures
-	padLen := int(salt[0] & 31)
+	padLen := int(salt[0] & maxPadding)
 	totalLen := MagicHeaderLen + len(p) + padLen
 	if totalLen > len(buf) {
-		padLen = 0 // Safety check
-		totalLen = MagicHeaderLen + len(p)
+		totalLen = MagicHeaderLen + len(p) // Safety check
 	} else {
 		rand.Read(buf[MagicHeaderLen+len(p) : totalLen])
 	}
-
-	_, err = c.PacketConn.WriteTo(buf[:totalLen], addr)
-	return len(p), err
+	return totalLen, nil
 }
 
 func (c *RealityConn) LocalAddr() net.Addr                { return c.PacketConn.LocalAddr() }
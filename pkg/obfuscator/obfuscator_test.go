@@ -0,0 +1,346 @@
+package obfuscator
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// saltAt returns a v2 salt with the given nonce byte, sent at t
+func saltAt(nonce byte, t time.Time) []byte {
+	salt := make([]byte, 16)
+	salt[0] = nonce
+	binary.BigEndian.PutUint32(salt[12:], uint32(t.Unix()))
+	return salt
+}
+
+func TestTimely(t *testing.T) {
+	c := NewRealityConn(nil, "secret", "")
+	now := time.Now()
+	tests := []struct {
+		name string
+		sent time.Time
+		want bool
+	}{
+		{"now", now, true},
+		{"a minute ago", now.Add(-time.Minute), true},
+		{"a minute ahead", now.Add(time.Minute), true},
+		{"too old", now.Add(-MaxClockSkew - 5*time.Second), false},
+		{"too far ahead", now.Add(MaxClockSkew + 5*time.Second), false},
+		{"epoch", time.Unix(0, 0), false},
+	}
+	var stale uint64
+	for _, tt := range tests {
+		if got := c.timely(saltAt(1, tt.sent)); got != tt.want {
+			t.Errorf("%s: timely = %v, want %v", tt.name, got, tt.want)
+		}
+		if !tt.want {
+			stale++
+		}
+	}
+	if got, _ := c.RejectedHeaders(); got != stale {
+		t.Errorf("%d stale headers counted, want %d", got, stale)
+	}
+}
+
+func TestRememberRejectsReplays(t *testing.T) {
+	c := NewRealityConn(nil, "secret", "")
+	a, b := saltAt(1, time.Now()), saltAt(2, time.Now())
+
+	if !c.remember(a) || !c.remember(b) {
+		t.Fatal("fresh salts rejected")
+	}
+	if c.remember(a) {
+		t.Fatal("replayed salt accepted")
+	}
+
+	// After one rollover the salt is still known from the previous generation
+	c.seenSince = c.seenSince.Add(-replayWindow)
+	if c.remember(b) {
+		t.Fatal("salt from the previous generation accepted")
+	}
+	// After two it is forgotten, by which time timely rejects it anyway
+	c.seenSince = c.seenSince.Add(-replayWindow)
+	if !c.remember(b) {
+		t.Fatal("salt older than two generations still rejected")
+	}
+
+	if _, replayed := c.RejectedHeaders(); replayed != 2 {
+		t.Errorf("%d replays counted, want 2", replayed)
+	}
+}
+
+func TestRememberFull(t *testing.T) {
+	c := NewRealityConn(nil, "secret", "")
+	for i := 0; i < maxSeenSalts; i++ {
+		var key [16]byte
+		binary.BigEndian.PutUint32(key[:], uint32(i))
+		c.seen[key] = struct{}{}
+	}
+	// A full cache refuses new headers rather than forgetting old ones
+	if c.remember(saltAt(0xff, time.Now())) {
+		t.Fatal("salt accepted with a full cache")
+	}
+	c.seenSince = c.seenSince.Add(-replayWindow)
+	if !c.remember(saltAt(0xff, time.Now())) {
+		t.Fatal("salt rejected after the full generation rolled over")
+	}
+}
+
+// v2Packet builds a v2 FPO packet whose salt starts with nonce, which also
+// sets the padding length
+func v2Packet(c *RealityConn, nonce byte, sent time.Time, payload []byte) []byte {
+	salt := saltAt(nonce, sent)
+	mac := hmac.New(sha256.New, c.checkKey)
+	mac.Write(salt)
+	header := append(salt, mac.Sum(nil)[:8]...)
+	packet := c.aead.Seal(header, salt[:12], payload, header)
+	return append(packet, make([]byte, nonce&maxPadding)...)
+}
+
+// v1Packet is v2Packet for a v1 header, whose salt is random but for nonce
+func v1Packet(c *RealityConn, nonce byte, payload []byte) []byte {
+	salt := make([]byte, 8)
+	rand.Read(salt[1:])
+	salt[0] = nonce
+	mac := hmac.New(sha256.New, c.authKey)
+	mac.Write(salt)
+	body := append([]byte(nil), payload...)
+	c.xor(body, salt)
+	packet := append(append(salt, mac.Sum(nil)[:24]...), body...)
+	return append(packet, make([]byte, nonce&maxPadding)...)
+}
+
+func TestOpen(t *testing.T) {
+	payload := []byte("quic initial packet")
+	now := time.Now()
+	tests := []struct {
+		name   string
+		legacy bool
+		packet func(c *RealityConn) []byte
+		want   int // Accepted version, 0 if rejected
+	}{
+		{"v2", false, func(c *RealityConn) []byte { return v2Packet(c, 0, now, payload) }, FPOv2},
+		{"v2 padded", false, func(c *RealityConn) []byte { return v2Packet(c, 31, now, payload) }, FPOv2},
+		{"v2 truncated below its padding", false, func(c *RealityConn) []byte {
+			return v2Packet(c, 31, now, payload)[:HeaderLenV2+16]
+		}, 0},
+		{"v2 truncated into the tag", false, func(c *RealityConn) []byte {
+			p := v2Packet(c, 31, now, payload)
+			return p[:len(p)-31-1]
+		}, 0},
+		{"v2 header only", false, func(c *RealityConn) []byte { return v2Packet(c, 31, now, payload)[:HeaderLenV2] }, 0},
+		{"v2 tampered", false, func(c *RealityConn) []byte {
+			p := v2Packet(c, 0, now, payload)
+			p[HeaderLenV2] ^= 1
+			return p
+		}, 0},
+		{"v2 stale", false, func(c *RealityConn) []byte { return v2Packet(c, 0, now.Add(-2*MaxClockSkew), payload) }, 0},
+		{"v1", true, func(c *RealityConn) []byte { return v1Packet(c, 0, payload) }, FPOv1},
+		{"v1 padded", true, func(c *RealityConn) []byte { return v1Packet(c, 31, payload) }, FPOv1},
+		{"v1 truncated below its padding", true, func(c *RealityConn) []byte {
+			return v1Packet(c, 31, payload)[:MagicHeaderLen+8]
+		}, 0},
+		{"v1 header only", true, func(c *RealityConn) []byte { return v1Packet(c, 31, payload)[:MagicHeaderLen] }, 0},
+		{"v1 not accepted", false, func(c *RealityConn) []byte { return v1Packet(c, 0, payload) }, 0},
+		{"garbage", true, func(c *RealityConn) []byte { return bytes.Repeat([]byte{0xff}, 100) }, 0},
+	}
+	for _, tt := range tests {
+		c := NewRealityConn(nil, "secret", "")
+		c.SetLegacy(tt.legacy)
+		data := tt.packet(c)
+		p := make([]byte, 2048)
+		n, version := c.open(p, data)
+		if version != tt.want {
+			t.Errorf("%s: version %d, want %d", tt.name, version, tt.want)
+			continue
+		}
+		if version == 0 {
+			continue
+		}
+		if !bytes.Equal(p[:n], payload) {
+			t.Errorf("%s: payload %q, want %q", tt.name, p[:n], payload)
+		}
+		// The same packet again is a replay
+		if _, version := c.open(p, data); version != 0 {
+			t.Errorf("%s: replay accepted", tt.name)
+		}
+	}
+}
+
+func TestOpenShortBuffer(t *testing.T) {
+	c := NewRealityConn(nil, "secret", "")
+	payload := make([]byte, 100)
+	for _, data := range [][]byte{v2Packet(c, 7, time.Now(), payload), v1Packet(c, 7, payload)} {
+		if _, version := c.open(make([]byte, 50), data); version != 0 {
+			t.Errorf("v%d packet opened into a short buffer", version)
+		}
+	}
+}
+
+func TestSeal(t *testing.T) {
+	c := NewRealityConn(nil, "secret", "")
+	buf := make([]byte, 2048)
+	p := make([]byte, 1200)
+	for i := 0; i < 50; i++ {
+		n, err := c.seal(buf, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pad := int(buf[0] & maxPadding); n != HeaderLenV2+len(p)+16+pad {
+			t.Fatalf("sealed %d bytes with %d padding", n, pad)
+		}
+		out := make([]byte, 2048)
+		if m, version := c.open(out, buf[:n]); version != FPOv2 || m != len(p) {
+			t.Fatalf("open = %d, v%d", m, version)
+		}
+	}
+	// An empty payload is just the header and the tag
+	n, _ := c.seal(buf, nil)
+	if m, version := c.open(make([]byte, 2048), buf[:n]); version != FPOv2 || m != 0 {
+		t.Fatalf("open of an empty payload = %d, v%d", m, version)
+	}
+	if _, err := c.seal(buf, make([]byte, len(buf))); err == nil {
+		t.Fatal("oversized packet sealed")
+	}
+	if _, err := c.sealV1(buf, make([]byte, len(buf))); err == nil {
+		t.Fatal("oversized v1 packet sealed")
+	}
+}
+
+// queueConn is a PacketConn that delivers queued packets and records writes
+type queueConn struct {
+	net.PacketConn
+	in    [][]byte
+	from  net.Addr
+	froms []net.Addr // Per queued packet, overriding from
+	out   [][]byte
+}
+
+func (q *queueConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if len(q.in) == 0 {
+		return 0, nil, errors.New("no more packets")
+	}
+	n := copy(p, q.in[0])
+	q.in = q.in[1:]
+	from := q.from
+	if len(q.froms) > 0 {
+		from, q.froms = q.froms[0], q.froms[1:]
+	}
+	return n, from, nil
+}
+
+func (q *queueConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	q.out = append(q.out, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func TestReadFromRejectsMalformed(t *testing.T) {
+	client := NewRealityConn(&queueConn{}, "secret", "")
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4242}
+	client.WriteTo([]byte("hello"), addr)
+	valid := client.PacketConn.(*queueConn).out[0]
+
+	q := &queueConn{from: addr}
+	server := NewRealityConn(q, "secret", "")
+	q.in = [][]byte{
+		v2Packet(server, 31, time.Now(), []byte("hello"))[:HeaderLenV2+16],
+		v1Packet(server, 31, []byte("hello"))[:MagicHeaderLen],
+		[]byte("clean packet from an unknown address"),
+		valid,
+		valid, // Replayed: clean from a whitelisted address, so passed on as is
+	}
+	p := make([]byte, 2048)
+	n, _, err := server.ReadFrom(p)
+	if err != nil || string(p[:n]) != "hello" {
+		t.Fatalf("ReadFrom = %q, %v; want hello", p[:n], err)
+	}
+	if n, _, err := server.ReadFrom(p); err != nil || !bytes.Equal(p[:n], valid) {
+		t.Fatalf("second ReadFrom = %d bytes, %v; want the packet unchanged", n, err)
+	}
+	if _, replayed := server.RejectedHeaders(); replayed != 1 {
+		t.Fatalf("%d replays counted, want 1", replayed)
+	}
+}
+
+// baselineV1 seals p as clients from before v2 and replay protection did: a
+// salt of 8 random bytes and random padding
+func baselineV1(c *RealityConn, p []byte) []byte {
+	buf := make([]byte, 2048)
+	salt := make([]byte, 8)
+	rand.Read(salt)
+	mac := hmac.New(sha256.New, c.authKey)
+	mac.Write(salt)
+	copy(buf[0:8], salt)
+	copy(buf[8:32], mac.Sum(nil)[:24])
+	payload := buf[MagicHeaderLen : MagicHeaderLen+len(p)]
+	copy(payload, p)
+	c.xor(payload, salt)
+	total := MagicHeaderLen + len(p) + int(salt[0]&31)
+	rand.Read(buf[MagicHeaderLen+len(p) : total])
+	return buf[:total]
+}
+
+// baselineOpen is how those clients read a v1 packet
+func baselineOpen(c *RealityConn, data []byte) ([]byte, bool) {
+	if len(data) < MagicHeaderLen {
+		return nil, false
+	}
+	salt := data[:8]
+	mac := hmac.New(sha256.New, c.authKey)
+	mac.Write(salt)
+	n := len(data) - MagicHeaderLen - int(salt[0]&31)
+	if !hmac.Equal(data[8:32], mac.Sum(nil)[:24]) || n < 0 {
+		return nil, false
+	}
+	payload := append([]byte(nil), data[MagicHeaderLen:MagicHeaderLen+n]...)
+	c.xor(payload, salt)
+	return payload, true
+}
+
+func TestBaselineV1Client(t *testing.T) {
+	old := NewRealityConn(nil, "secret", "") // Same secret, same keys
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4242}
+	other := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 4242}
+	q := &queueConn{}
+	server := NewRealityConn(q, "secret", "")
+	server.SetLegacy(true)
+
+	// Random salts carry no time, so none is refused as stale
+	for i := 0; i < 50; i++ {
+		if _, version := server.open(make([]byte, 2048), baselineV1(old, []byte("probe"))); version != FPOv1 {
+			t.Fatalf("baseline packet %d refused", i)
+		}
+	}
+
+	initial := baselineV1(old, []byte("client hello"))
+	q.in = [][]byte{initial, initial}
+	q.froms = []net.Addr{addr, other}
+	p := make([]byte, 2048)
+	n, from, err := server.ReadFrom(p)
+	if err != nil || string(p[:n]) != "client hello" || from != addr {
+		t.Fatalf("ReadFrom = %q from %v, %v; want client hello from %v", p[:n], from, err, addr)
+	}
+	// The replay cache still keeps the recorded packet from whitelisting another address
+	if n, _, err := server.ReadFrom(p); err == nil {
+		t.Fatalf("replayed baseline packet passed: %q", p[:n])
+	}
+	if stale, replayed := server.RejectedHeaders(); stale != 0 || replayed != 1 {
+		t.Fatalf("rejected %d stale, %d replayed; want 0, 1", stale, replayed)
+	}
+
+	// The answer is v1, readable by the old client
+	server.WriteTo([]byte("server hello"), addr)
+	if len(q.out) != 1 {
+		t.Fatalf("%d packets written, want 1", len(q.out))
+	}
+	if payload, ok := baselineOpen(old, q.out[0]); !ok || string(payload) != "server hello" {
+		t.Fatalf("old client read %q, %v; want server hello", payload, ok)
+	}
+}
@@ -5,11 +5,22 @@ type MessageType string
 const (
 	MessageTypeLoginRequest  MessageType = "login_request"
 	MessageTypeLoginResponse MessageType = "login_response"
+	MessageTypeQuota         MessageType = "quota"
 )
 
+// Control messages arrive after login, one per unidirectional stream opened by
+// the server. Clients ignore types they do not know.
+type ControlMessage struct {
+	Type MessageType `json:"type"`
+}
+
 type LoginRequest struct {
 	Type          MessageType `json:"type"`
+	User          string      `json:"user,omitempty"` // Optional; required for bcrypt-hashed accounts
 	Token         string      `json:"token"`
+	DeviceID      string      `json:"device_id,omitempty"`     // Stable per-install ID for VIP reservations
+	PreviousVIP   string      `json:"previous_vip,omitempty"`  // VIP held before a reconnect; reused if possible
+	ResumeTicket  string      `json:"resume_ticket,omitempty"` // From a previous LoginResponse; skips token auth if valid
 	ClientVersion string      `json:"client_version"`
 	OS            string      `json:"os"`
 }
@@ -20,6 +31,33 @@ type LoginResponse struct {
 	AssignedVIP   string      `json:"assigned_vip,omitempty"`
 	SubnetMask    string      `json:"subnet_mask,omitempty"`
 	ServerVIP     string      `json:"server_vip,omitempty"`
+	AssignedVIP6  string      `json:"assigned_vip6,omitempty"`
+	ServerVIP6    string      `json:"server_vip6,omitempty"`
+	Prefix6Len    int         `json:"prefix6_len,omitempty"`
+	Routes        []string    `json:"routes,omitempty"`         // CIDRs to route via the VPN; 0.0.0.0/0 means full tunnel
+	ExcludeRoutes []string    `json:"exclude_routes,omitempty"` // CIDRs to keep on the physical network
+	DNSServers    []string    `json:"dns_servers,omitempty"`
+	DNSSearch     []string    `json:"dns_search,omitempty"`
+	DNSDomains    []string    `json:"dns_domains,omitempty"`   // If set, only these domains use the VPN DNS (split-DNS)
+	ResumeTicket  string      `json:"resume_ticket,omitempty"` // Present on the next login to resume this session
 	ServerVersion string      `json:"server_version,omitempty"`
 	Message       string      `json:"message,omitempty"`
+	Reason        string      `json:"reason,omitempty"` // Why an "error" login failed, e.g. LoginDenied
+}
+
+// LoginDenied means the credentials or account were rejected; retrying the
+// same login will not help. Other failures (e.g. no free VIP) are transient.
+const LoginDenied = "denied"
+
+// Quota reports the user's data quota: the period closest to its limit.
+// Streams may arrive out of order; clients keep the highest Seq.
+type Quota struct {
+	Type       MessageType `json:"type"`
+	Seq        uint64      `json:"seq"`
+	Period     string      `json:"period"` // "day" or "month"
+	LimitBytes uint64      `json:"limit_bytes"`
+	UsedBytes  uint64      `json:"used_bytes"`
+	Resets     int64       `json:"resets"` // Unix time the period ends
+	Exceeded   bool        `json:"exceeded,omitempty"`
+	Action     string      `json:"action,omitempty"` // What happens once exceeded: "disconnect" or "throttle"
 }
@@ -0,0 +1,162 @@
+// Package quota keeps per-user traffic totals for the current day and month,
+// persisted across server restarts, and checks them against userdb quotas.
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/webdunesurfer/SloPN/pkg/userdb"
+)
+
+// Quota periods
+const (
+	Day   = "day"
+	Month = "month"
+)
+
+// Usage is a user's traffic in the current periods
+type Usage struct {
+	Day        string `json:"day"` // "2006-01-02"
+	DayBytes   uint64 `json:"day_bytes"`
+	Month      string `json:"month"` // "2006-01"
+	MonthBytes uint64 `json:"month_bytes"`
+}
+
+// roll starts new periods if now is past the recorded ones
+func (u *Usage) roll(now time.Time) {
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.DayBytes = day, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthBytes = month, 0
+	}
+}
+
+// Status is a user's standing against the tighter of their quotas
+type Status struct {
+	Period   string // Day or Month
+	Limit    uint64 // Bytes
+	Used     uint64
+	Resets   time.Time
+	Exceeded bool
+}
+
+// Remaining returns the bytes left in the period
+func (s Status) Remaining() uint64 {
+	if s.Used >= s.Limit {
+		return 0
+	}
+	return s.Limit - s.Used
+}
+
+// Store is the usage ledger. With an empty path it is kept in memory only.
+type Store struct {
+	mu    sync.Mutex
+	path  string
+	usage map[string]*Usage // Key: user name
+	dirty bool
+}
+
+// Load reads the ledger at path; a missing file starts empty
+func Load(path string) (*Store, error) {
+	s := &Store{path: path, usage: make(map[string]*Usage)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.usage); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Add charges n bytes to user and returns the updated usage
+func (s *Store) Add(user string, n uint64, now time.Time) Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.usage[user]
+	if u == nil {
+		u = &Usage{}
+		s.usage[user] = u
+	}
+	u.roll(now)
+	if n > 0 {
+		u.DayBytes += n
+		u.MonthBytes += n
+		s.dirty = true
+	}
+	return *u
+}
+
+// Get returns user's usage in the current periods
+func (s *Store) Get(user string, now time.Time) Usage {
+	return s.Add(user, 0, now)
+}
+
+// Status checks user against q, reporting the period closest to its limit.
+// ok is false if q sets no limit.
+func (s *Store) Status(user string, q *userdb.Quota, now time.Time) (st Status, ok bool) {
+	if q == nil {
+		return Status{}, false
+	}
+	u := s.Get(user, now)
+	y, m, d := now.Date()
+	periods := []Status{
+		{Period: Day, Limit: uint64(q.DailyMB) * 1e6, Used: u.DayBytes, Resets: time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())},
+		{Period: Month, Limit: uint64(q.MonthlyMB) * 1e6, Used: u.MonthBytes, Resets: time.Date(y, m+1, 1, 0, 0, 0, 0, now.Location())},
+	}
+	for _, p := range periods {
+		if p.Limit == 0 {
+			continue
+		}
+		p.Exceeded = p.Used >= p.Limit
+		// An exceeded period wins; among the rest, the one with less left
+		if !ok || (p.Exceeded && !st.Exceeded) || (p.Exceeded == st.Exceeded && p.Remaining() < st.Remaining()) {
+			st, ok = p, true
+		}
+	}
+	return st, ok
+}
+
+// Save writes the ledger atomically if it changed, dropping users idle since
+// before the current month
+func (s *Store) Save(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" || !s.dirty {
+		return nil
+	}
+	month := now.Format("2006-01")
+	for user, u := range s.usage {
+		if u.Month != month {
+			delete(s.usage, user)
+		}
+	}
+	data, err := json.MarshalIndent(s.usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
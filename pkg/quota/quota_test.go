@@ -0,0 +1,128 @@
+package quota
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/webdunesurfer/SloPN/pkg/userdb"
+)
+
+func at(s string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestRollover(t *testing.T) {
+	s, _ := Load("")
+	s.Add("alice", 100, at("2026-01-30 12:00"))
+	s.Add("alice", 50, at("2026-01-30 23:59"))
+	if u := s.Get("alice", at("2026-01-30 23:59")); u.DayBytes != 150 || u.MonthBytes != 150 {
+		t.Fatalf("same day: %+v", u)
+	}
+
+	// A new day keeps the month
+	u := s.Add("alice", 10, at("2026-01-31 00:00"))
+	if u.Day != "2026-01-31" || u.DayBytes != 10 || u.MonthBytes != 160 {
+		t.Fatalf("next day: %+v", u)
+	}
+	// A new month resets both
+	if u := s.Get("alice", at("2026-02-01 00:00")); u.Month != "2026-02" || u.DayBytes != 0 || u.MonthBytes != 0 {
+		t.Fatalf("next month: %+v", u)
+	}
+	// Users are counted apart
+	if u := s.Get("bob", at("2026-02-01 00:00")); u.MonthBytes != 0 {
+		t.Fatalf("bob: %+v", u)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	s, _ := Load("")
+	now := at("2026-12-15 10:00")
+	if _, ok := s.Status("alice", nil, now); ok {
+		t.Fatal("status without a quota")
+	}
+	if _, ok := s.Status("alice", &userdb.Quota{Action: userdb.QuotaThrottle}, now); ok {
+		t.Fatal("status for a quota without limits")
+	}
+
+	q := &userdb.Quota{DailyMB: 1, MonthlyMB: 10}
+	s.Add("alice", 400e3, now)
+	st, ok := s.Status("alice", q, now)
+	if !ok || st.Period != Day || st.Used != 400e3 || st.Remaining() != 600e3 || st.Exceeded {
+		t.Fatalf("daily usage: %+v", st)
+	}
+	if !st.Resets.Equal(at("2026-12-16 00:00")) {
+		t.Fatalf("day resets %v", st.Resets)
+	}
+
+	s.Add("alice", 600e3, now)
+	if st, _ := s.Status("alice", q, now); st.Period != Day || !st.Exceeded || st.Remaining() != 0 {
+		t.Fatalf("daily limit reached: %+v", st)
+	}
+
+	// The next day the period with less left is the month, which resets across the year
+	tomorrow := at("2026-12-16 10:00")
+	wide := &userdb.Quota{DailyMB: 100, MonthlyMB: 10}
+	s.Add("alice", 8.5e6, tomorrow)
+	st, _ = s.Status("alice", wide, tomorrow)
+	if st.Period != Month || st.Used != 9.5e6 || st.Exceeded {
+		t.Fatalf("monthly usage: %+v", st)
+	}
+	if !st.Resets.Equal(at("2027-01-01 00:00")) {
+		t.Fatalf("month resets %v", st.Resets)
+	}
+
+	// An exceeded month wins over a day with room left
+	s.Add("alice", 1e6, tomorrow)
+	if st, _ := s.Status("alice", wide, tomorrow); st.Period != Month || !st.Exceeded {
+		t.Fatalf("monthly limit reached: %+v", st)
+	}
+	if st, _ := s.Status("alice", q, at("2027-01-01 00:00")); st.Used != 0 || st.Exceeded {
+		t.Fatalf("new year: %+v", st)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "quota.json")
+	s, err := Load(path)
+	if err != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+	now := at("2026-03-10 12:00")
+	s.Add("alice", 1234, now)
+	s.Add("bob", 99, at("2026-02-27 12:00"))
+	if err := s.Save(now); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := loaded.Get("alice", now); u.DayBytes != 1234 || u.MonthBytes != 1234 {
+		t.Fatalf("alice after reload: %+v", u)
+	}
+	// Users idle since before the current month are not kept
+	if _, ok := loaded.usage["bob"]; ok {
+		t.Fatal("last month's user saved")
+	}
+
+	// Nothing new, nothing written
+	os.Remove(path)
+	if err := s.Save(now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("unchanged ledger written")
+	}
+
+	os.WriteFile(path, []byte("{"), 0644)
+	if _, err := Load(path); err == nil {
+		t.Fatal("corrupt ledger loaded")
+	}
+}
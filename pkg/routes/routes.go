@@ -0,0 +1,154 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// Policy is a set of CIDRs routed through the VPN and CIDRs kept off it.
+// A route of 0.0.0.0/0 (or ::/0) turns on full tunnel for the client.
+type Policy struct {
+	Routes  []string `json:"routes,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// File is the route policy file format: a default policy for everyone plus
+// additions for members of each group
+type File struct {
+	Default Policy            `json:"default"`
+	Groups  map[string]Policy `json:"groups,omitempty"`
+}
+
+// IsEmpty reports whether f defines no routes at all
+func (f File) IsEmpty() bool {
+	return len(f.Default.Routes) == 0 && len(f.Default.Exclude) == 0 && len(f.Groups) == 0
+}
+
+// Table holds the server-wide route policy plus per-group additions
+type Table struct {
+	mu     sync.RWMutex
+	path   string // Empty for a table built by New
+	def    Policy
+	groups map[string]Policy
+}
+
+// Load reads a route table from a JSON file
+func Load(path string) (*Table, error) {
+	t := &Table{path: path}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// New builds a table from an in-memory policy, e.g. from the server config file
+func New(f File) (*Table, error) {
+	t := &Table{}
+	if err := t.Set(f); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload re-reads the backing file. On error the previous table stays active.
+func (t *Table) Reload() error {
+	if t.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("parse %s: %v", t.path, err)
+	}
+	return t.Set(f)
+}
+
+// Set validates and replaces the policy. On error the previous table stays active.
+func (t *Table) Set(f File) error {
+	if err := f.Default.Validate(); err != nil {
+		return fmt.Errorf("default: %v", err)
+	}
+	for name, p := range f.Groups {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("group %q: %v", name, err)
+		}
+	}
+
+	t.mu.Lock()
+	t.def = f.Default
+	t.groups = f.Groups
+	t.mu.Unlock()
+	return nil
+}
+
+// For returns the default policy merged with the policies of the given groups
+func (t *Table) For(groups []string) Policy {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var out Policy
+	seenRoute := make(map[string]bool)
+	seenExclude := make(map[string]bool)
+	add := func(p Policy) {
+		for _, r := range p.Routes {
+			if !seenRoute[r] {
+				seenRoute[r] = true
+				out.Routes = append(out.Routes, r)
+			}
+		}
+		for _, r := range p.Exclude {
+			if !seenExclude[r] {
+				seenExclude[r] = true
+				out.Exclude = append(out.Exclude, r)
+			}
+		}
+	}
+	add(t.def)
+	for _, g := range groups {
+		if p, ok := t.groups[g]; ok {
+			add(p)
+		}
+	}
+	return out
+}
+
+// Validate checks that every entry is a valid CIDR
+func (p Policy) Validate() error {
+	for _, list := range [][]string{p.Routes, p.Exclude} {
+		for _, cidr := range list {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// IsDefault reports whether cidr covers the whole IPv4 or IPv6 address space
+func IsDefault(cidr string) bool {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	ones, _ := n.Mask.Size()
+	return ones == 0
+}
+
+// Split separates default routes from the rest. full is true if any route
+// in the list is a default route.
+func Split(list []string) (full bool, specific []string) {
+	for _, r := range list {
+		if IsDefault(r) {
+			full = true
+			continue
+		}
+		specific = append(specific, r)
+	}
+	return full, specific
+}
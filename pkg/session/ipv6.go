@@ -0,0 +1,79 @@
+package session
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// EnableIPv6 configures an IPv6 (ULA) prefix served alongside the IPv4 subnet.
+// A client's IPv6 VIP is derived from its IPv4 VIP by copying the host bits
+// into the prefix, so no second pool has to be managed.
+func (m *Manager) EnableIPv6(prefix string) error {
+	ip, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return err
+	}
+	if ip.To4() != nil {
+		return fmt.Errorf("%s is not an IPv6 prefix", prefix)
+	}
+	ones6, _ := ipNet.Mask.Size()
+	ones4, bits4 := m.subnet.Mask.Size()
+	if 128-ones6 < bits4-ones4 {
+		return fmt.Errorf("IPv6 prefix %s is too small for IPv4 subnet %s", prefix, m.subnet)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subnet6 = ipNet
+	m.serverIP6 = m.mapIPv6(m.serverIP)
+	return nil
+}
+
+// MapIPv6 returns the IPv6 VIP paired with an IPv4 VIP, or nil if IPv6 is disabled
+func (m *Manager) MapIPv6(vip net.IP) net.IP {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.mapIPv6(vip)
+}
+
+// mapIPv6 is MapIPv6 without locking. Caller must hold m.mu.
+func (m *Manager) mapIPv6(vip net.IP) net.IP {
+	v4 := vip.To4()
+	if m.subnet6 == nil || v4 == nil {
+		return nil
+	}
+	host := binary.BigEndian.Uint32(v4) &^ binary.BigEndian.Uint32(net.IP(m.subnet.Mask).To4())
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, m.subnet6.IP.To16())
+	binary.BigEndian.PutUint32(ip[12:], binary.BigEndian.Uint32(ip[12:])|host)
+	return ip
+}
+
+// GetServerIP6 returns the server's IPv6 VIP, or nil if IPv6 is disabled
+func (m *Manager) GetServerIP6() net.IP {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.serverIP6
+}
+
+// Prefix6Len returns the IPv6 prefix length, or 0 if IPv6 is disabled
+func (m *Manager) Prefix6Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.subnet6 == nil {
+		return 0
+	}
+	ones, _ := m.subnet6.Mask.Size()
+	return ones
+}
+
+// IsServerIP reports whether ip is one of the server's own VIPs
+func (m *Manager) IsServerIP(ip net.IP) bool {
+	if ip.Equal(m.serverIP) {
+		return true
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.serverIP6 != nil && ip.Equal(m.serverIP6)
+}
@@ -0,0 +1,150 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LeaseTTL is how long a sticky lease is remembered after its last use
+const LeaseTTL = 30 * 24 * time.Hour
+
+// Lease records the last VIP handed to a client
+type Lease struct {
+	VIP      string    `json:"vip"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// ClientKey returns the reservation/lease key for a client.
+// A device ID is preferred since several devices may share one user. Device
+// keys include the user, since any client can claim any device ID.
+func ClientKey(user, device string) string {
+	if device != "" {
+		return "device:" + user + "/" + device
+	}
+	return "user:" + user
+}
+
+// validKey reports whether key is a well-formed reservation key
+func validKey(key string) bool {
+	if name, ok := strings.CutPrefix(key, "user:"); ok {
+		return name != ""
+	}
+	if dev, ok := strings.CutPrefix(key, "device:"); ok {
+		user, id, ok := strings.Cut(dev, "/")
+		return ok && user != "" && id != ""
+	}
+	return false
+}
+
+// LoadReservations reads static VIP reservations from a JSON file of the form
+// {"user:alice": "10.100.0.10", "device:alice/<id>": "10.100.0.11"}.
+// Reserved addresses are removed from the dynamic pool.
+func (m *Manager) LoadReservations(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("parse %s: %v", path, err)
+	}
+
+	res := make(map[string]string)
+	byIP := make(map[string]string)
+	for key, addr := range raw {
+		if !validKey(key) {
+			return fmt.Errorf("reservation %q: key must be user:<name> or device:<name>/<id>", key)
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil || !m.subnet.Contains(ip) {
+			return fmt.Errorf("reservation %q: %s is not in %s", key, addr, m.subnet)
+		}
+		ip = ip.To4()
+		if ip.Equal(m.serverIP) || m.isNetworkOrBroadcast(ip) {
+			return fmt.Errorf("reservation %q: %s is not assignable", key, addr)
+		}
+		if other, dup := byIP[ip.String()]; dup {
+			return fmt.Errorf("reservation %q: %s already reserved for %q", key, addr, other)
+		}
+		res[key] = ip.String()
+		byIP[ip.String()] = key
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reservations = res
+	m.reservedIPs = byIP
+
+	// Remove reserved addresses from the dynamic pool
+	for vip := range byIP {
+		if off, ok := m.pool.offset(net.ParseIP(vip)); ok {
+			m.pool.take(off)
+		}
+	}
+	return nil
+}
+
+// EnableLeases turns on sticky leases persisted at path, loading any existing state
+func (m *Manager) EnableLeases(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.leasePath = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var leases map[string]Lease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return fmt.Errorf("parse %s: %v", path, err)
+	}
+	for key, l := range leases {
+		// Device keys from before they named the user are dropped
+		if time.Since(l.LastSeen) > LeaseTTL || !validKey(key) {
+			continue
+		}
+		m.leases[key] = l
+	}
+	return nil
+}
+
+// recordLease remembers the VIP for a client and persists the lease table.
+// Caller must hold m.mu.
+func (m *Manager) recordLease(key string, ip net.IP) {
+	if m.leasePath == "" {
+		return
+	}
+	m.leases[key] = Lease{VIP: ip.String(), LastSeen: time.Now()}
+	if err := m.saveLeases(); err != nil {
+		fmt.Printf("Warning: failed to persist leases: %v\n", err)
+	}
+}
+
+// saveLeases writes the lease table atomically. Caller must hold m.mu.
+func (m *Manager) saveLeases() error {
+	for key, l := range m.leases {
+		if time.Since(l.LastSeen) > LeaseTTL {
+			delete(m.leases, key)
+		}
+	}
+	data, err := json.MarshalIndent(m.leases, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.leasePath), 0755); err != nil {
+		return err
+	}
+	tmp := m.leasePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.leasePath)
+}
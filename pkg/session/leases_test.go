@@ -0,0 +1,69 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newReservedManager(t *testing.T, reservations string) *Manager {
+	t.Helper()
+	m, err := NewManager("10.100.0.0/24", "10.100.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "reservations.json")
+	if err := os.WriteFile(path, []byte(reservations), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.LoadReservations(path); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestDeviceReservationBelongsToUser(t *testing.T) {
+	m := newReservedManager(t, `{"device:alice/laptop": "10.100.0.10"}`)
+
+	ip, err := m.AllocateIP("mallory", "laptop", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() == "10.100.0.10" {
+		t.Fatal("another user's device ID was given the reserved address")
+	}
+
+	ip, err = m.AllocateIP("alice", "laptop", "")
+	if err != nil || ip.String() != "10.100.0.10" {
+		t.Fatalf("AllocateIP(alice) = %v, %v; want 10.100.0.10", ip, err)
+	}
+}
+
+func TestReservationClaimedOnAllocate(t *testing.T) {
+	m := newReservedManager(t, `{"user:alice": "10.100.0.10"}`)
+
+	ip, err := m.AllocateIP("alice", "", "")
+	if err != nil || ip.String() != "10.100.0.10" {
+		t.Fatalf("AllocateIP = %v, %v; want 10.100.0.10", ip, err)
+	}
+	// A second login before AddSession must not get the same address
+	if ip, err := m.AllocateIP("alice", "", ""); err == nil {
+		t.Fatalf("second AllocateIP = %v, want error", ip)
+	}
+
+	m.ReleaseIP(ip)
+	if ip, err := m.AllocateIP("alice", "", ""); err != nil || ip.String() != "10.100.0.10" {
+		t.Fatalf("AllocateIP after release = %v, %v; want 10.100.0.10", ip, err)
+	}
+}
+
+func TestLoadReservationsKeys(t *testing.T) {
+	for _, key := range []string{"device:laptop", "device:/laptop", "device:alice/", "user:", "alice"} {
+		m, _ := NewManager("10.100.0.0/24", "10.100.0.1")
+		path := filepath.Join(t.TempDir(), "reservations.json")
+		os.WriteFile(path, []byte(`{"`+key+`": "10.100.0.10"}`), 0644)
+		if err := m.LoadReservations(path); err == nil {
+			t.Errorf("key %q accepted", key)
+		}
+	}
+}
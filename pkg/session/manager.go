@@ -12,17 +12,36 @@ import (
 
 // Session represents an active client connection
 type Session struct {
-	Conn *quic.Conn
-	VIP  net.IP
+	Conn      *quic.Conn
+	VIP       net.IP
+	VIP6      net.IP    // Nil unless IPv6 is enabled
+	User      string    // Authenticated user name
+	Device    string    // Client device ID, may be empty
+	Ticket    string    // Current resumption ticket
+	Connected time.Time // Login time; kept when the session is resumed in place
+	Traffic   *Traffic  // Shared by snapshots, so counters stay live
 }
 
 // Manager handles all active client sessions and IP allocation
 type Manager struct {
 	mu       sync.RWMutex
 	sessions map[string]*Session // Key: VIP string (e.g., "10.100.0.2")
-	ipPool   []net.IP            // Slice of available IPs for random selection
+	pool     *ipPool             // Bitmap of assigned addresses
 	serverIP net.IP
+	subnet   *net.IPNet
 	rng      *rand.Rand
+
+	sessions6 map[string]*Session // Key: IPv6 VIP string
+	subnet6   *net.IPNet
+	serverIP6 net.IP
+
+	reservations map[string]string // Key: ClientKey -> reserved VIP
+	reservedIPs  map[string]string // Key: reserved VIP -> ClientKey
+	claimed      map[string]bool   // Key: reserved VIP handed out and not yet released
+	leases       map[string]Lease  // Key: ClientKey -> last assigned VIP
+	leasePath    string            // Empty disables sticky leases
+
+	tickets map[string]*ticketEntry // Key: resumption ticket
 }
 
 // NewManager creates a new session manager with a pool of available IPs
@@ -37,45 +56,97 @@ func NewManager(subnet string, serverIP string) (*Manager, error) {
 		return nil, err
 	}
 
-	var pool []net.IP
-	
-	// Populate pool, skipping network, broadcast, and server IP
-	for ip := ipNet.IP.Mask(ipNet.Mask); ipNet.Contains(ip); inc(ip) {
-		currentIP := make(net.IP, len(ip))
-		copy(currentIP, ip)
-		
-		// Skip .0 (network) and .255 (broadcast) - simple check for /24
-		if currentIP[3] == 0 || currentIP[3] == 255 || currentIP.Equal(sIP) {
-			continue
-		}
-		pool = append(pool, currentIP)
+	pool, err := newIPPool(ipNet)
+	if err != nil {
+		return nil, err
+	}
+	if off, ok := pool.offset(sIP); ok {
+		pool.take(off)
 	}
 
 	return &Manager{
-		sessions: make(map[string]*Session),
-		ipPool:   pool,
-		serverIP: sIP,
-		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		sessions:     make(map[string]*Session),
+		sessions6:    make(map[string]*Session),
+		pool:         pool,
+		serverIP:     sIP,
+		subnet:       ipNet,
+		rng:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		reservations: make(map[string]string),
+		reservedIPs:  make(map[string]string),
+		claimed:      make(map[string]bool),
+		leases:       make(map[string]Lease),
+		tickets:      make(map[string]*ticketEntry),
 	}, nil
 }
 
-// AllocateIP gets a random available IP from the pool
-func (m *Manager) AllocateIP() (net.IP, error) {
+// AllocateIP picks a VIP for a client. A static reservation for the device or
+// user wins, then the address the client asks for (after a reconnect), then
+// its previous (sticky) address, then a random free one.
+func (m *Manager) AllocateIP(user, device, requested string) (net.IP, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if len(m.ipPool) == 0 {
-		return nil, fmt.Errorf("IP pool exhausted")
+	// 1. Static reservations. The address is claimed here, not in
+	// AddSession, so two logins cannot both be given it.
+	key := ClientKey(user, device)
+	for _, k := range []string{key, "user:" + user} {
+		if vip, ok := m.reservations[k]; ok {
+			if m.claimed[vip] {
+				return nil, fmt.Errorf("reserved address %s is in use", vip)
+			}
+			m.claimed[vip] = true
+			return net.ParseIP(vip).To4(), nil
+		}
+	}
+
+	leasedTo := func(off uint32) string {
+		for k, l := range m.leases {
+			if o, ok := m.pool.offset(net.ParseIP(l.VIP)); ok && o == off {
+				return k
+			}
+		}
+		return ""
 	}
 
-	// Pick a random index
-	idx := m.rng.Intn(len(m.ipPool))
-	ip := m.ipPool[idx]
+	// 2. Requested address, unless it is another client's sticky address
+	if req := net.ParseIP(requested); req != nil {
+		if off, ok := m.pool.offset(req); ok && m.pool.isFree(off) {
+			if k := leasedTo(off); k == "" || k == key {
+				m.pool.take(off)
+				ip := m.pool.ip(off)
+				m.recordLease(key, ip)
+				return ip, nil
+			}
+		}
+	}
 
-	// Remove from pool by swapping with last element
-	m.ipPool[idx] = m.ipPool[len(m.ipPool)-1]
-	m.ipPool = m.ipPool[:len(m.ipPool)-1]
+	// 3. Sticky lease
+	if l, ok := m.leases[key]; ok {
+		if off, ok := m.pool.offset(net.ParseIP(l.VIP)); ok && m.pool.take(off) {
+			ip := m.pool.ip(off)
+			m.recordLease(key, ip)
+			return ip, nil
+		}
+	}
 
+	// 4. Random address, avoiding other clients' sticky addresses when possible
+	leased := make(map[uint32]bool)
+	for k, l := range m.leases {
+		if off, ok := m.pool.offset(net.ParseIP(l.VIP)); ok && k != key {
+			leased[off] = true
+		}
+	}
+	start := uint32(m.rng.Int63n(int64(m.pool.size)))
+	off, ok := m.pool.next(start, func(off uint32) bool { return !leased[off] })
+	if !ok {
+		off, ok = m.pool.next(start, func(uint32) bool { return true })
+	}
+	if !ok {
+		return nil, fmt.Errorf("IP pool exhausted")
+	}
+	m.pool.take(off)
+	ip := m.pool.ip(off)
+	m.recordLease(key, ip)
 	return ip, nil
 }
 
@@ -83,50 +154,162 @@ func (m *Manager) AllocateIP() (net.IP, error) {
 func (m *Manager) ReleaseIP(ip net.IP) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.ipPool = append(m.ipPool, ip)
+	m.release(ip.String())
+}
+
+// release puts a dynamic address back into the pool, or frees a reserved one
+// for its owner's next login. Caller must hold m.mu.
+func (m *Manager) release(vip string) {
+	if _, reserved := m.reservedIPs[vip]; reserved {
+		delete(m.claimed, vip)
+		return
+	}
+	if off, ok := m.pool.offset(net.ParseIP(vip)); ok {
+		m.pool.release(off)
+	}
+}
+
+// isNetworkOrBroadcast reports whether ip is the subnet's network or broadcast address
+func (m *Manager) isNetworkOrBroadcast(ip net.IP) bool {
+	off, ok := m.pool.offset(ip)
+	return ok && (off == 0 || off == m.pool.size-1)
+}
+
+// PoolStats returns the number of assignable addresses and how many are in use
+// (including reservations and the server VIP)
+func (m *Manager) PoolStats() (used, total int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	total = int(m.pool.size) - 2
+	return total - m.pool.free, total
+}
+
+// Subnet returns the IPv4 VPN subnet
+func (m *Manager) Subnet() *net.IPNet {
+	return m.subnet
 }
 
-// AddSession registers a new client
-func (m *Manager) AddSession(vip net.IP, conn *quic.Conn) {
+// AddSession registers a new client and issues its first resumption ticket
+func (m *Manager) AddSession(vip net.IP, conn *quic.Conn, user, device string) *Session {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.sessions[vip.String()] = &Session{
-		Conn: conn,
-		VIP:  vip,
+	s := &Session{
+		Conn:   conn,
+		VIP:    vip,
+		VIP6:   m.mapIPv6(vip),
+		User:   user,
+		Device: device,
 	}
+	m.add(s)
+	return s
 }
 
-// RemoveSession unregisters a client and releases its IP
-func (m *Manager) RemoveSession(vip string) {
+// add registers s in both maps with a fresh ticket. Caller must hold m.mu.
+func (m *Manager) add(s *Session) {
+	s.Connected = time.Now()
+	s.Traffic = &Traffic{}
+	m.sessions[s.VIP.String()] = s
+	if s.VIP6 != nil {
+		m.sessions6[s.VIP6.String()] = s
+	}
+	m.newTicket(s)
+}
+
+// RemoveSession unregisters a client and releases its IP. Nothing happens if
+// the VIP has since been taken over by another connection.
+func (m *Manager) RemoveSession(vip string, conn *quic.Conn) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if _, ok := m.sessions[vip]; ok {
-		m.ipPool = append(m.ipPool, net.ParseIP(vip))
-		delete(m.sessions, vip)
+	if s, ok := m.sessions[vip]; ok && s.Conn == conn {
+		m.remove(s)
 	}
 }
 
-// GetSession returns the connection for a given VIP
+// TakeOver removes the session holding vip if it belongs to the same user and
+// device, so a reconnecting client can get its address back before the old
+// connection times out. It returns the old connection for the caller to close.
+// Without a device ID nothing tells clients of a shared account apart, so
+// they can only take over a session with its resumption ticket (see Resume).
+func (m *Manager) TakeOver(vip, user, device string) (*quic.Conn, bool) {
+	if device == "" {
+		return nil, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[vip]
+	if !ok || s.User != user || s.Device != device {
+		return nil, false
+	}
+	m.remove(s)
+	return s.Conn, true
+}
+
+// Kick removes the session holding an IPv4 or IPv6 VIP and invalidates its
+// resumption ticket, so the client has to log in again with its credentials.
+// It returns the connection for the caller to close.
+func (m *Manager) Kick(vip string) (conn *quic.Conn, user string, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[vip]
+	if !ok {
+		s, ok = m.sessions6[vip]
+	}
+	if !ok {
+		return nil, "", false
+	}
+	m.remove(s)
+	delete(m.tickets, s.Ticket)
+	return s.Conn, s.User, true
+}
+
+// remove drops a session from both maps and releases its IP. Caller must hold m.mu.
+func (m *Manager) remove(s *Session) {
+	vip := s.VIP.String()
+	m.release(vip)
+	delete(m.sessions, vip)
+	if s.VIP6 != nil {
+		delete(m.sessions6, s.VIP6.String())
+	}
+	m.expireTicket(s)
+}
+
+// GetSession returns the connection for a given IPv4 or IPv6 VIP
 func (m *Manager) GetSession(vip string) (*quic.Conn, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	s, ok := m.sessions[vip]
+	if !ok {
+		s, ok = m.sessions6[vip]
+	}
 	if !ok {
 		return nil, false
 	}
-	return s.Conn, true
+	return s.Conn, true // Read under the lock: Resume swaps Conn in place
 }
 
-// GetServerIP returns the server's virtual IP
-func (m *Manager) GetServerIP() net.IP {
-	return m.serverIP
+// Lookup returns the full session for a given IPv4 or IPv6 VIP
+func (m *Manager) Lookup(vip string) (*Session, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.sessions[vip]
+	if !ok {
+		s, ok = m.sessions6[vip]
+	}
+	return s, ok
 }
 
-func inc(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		ip[j]++
-		if ip[j] > 0 {
-			break
-		}
+// Sessions returns a snapshot of all registered sessions
+func (m *Manager) Sessions() []Session {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		out = append(out, *s)
 	}
+	return out
+}
+
+// GetServerIP returns the server's virtual IP
+func (m *Manager) GetServerIP() net.IP {
+	return m.serverIP
 }
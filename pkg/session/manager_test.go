@@ -0,0 +1,67 @@
+package session
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTakeOver(t *testing.T) {
+	m, err := NewManager("10.100.0.0/24", "10.100.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := m.AddSession(net.ParseIP("10.100.0.10").To4(), nil, "default", "")
+	laptop := m.AddSession(net.ParseIP("10.100.0.11").To4(), nil, "alice", "laptop")
+
+	tests := []struct {
+		name, vip, user, device string
+		want                    bool
+	}{
+		{"shared account without device ID", shared.VIP.String(), "default", "", false},
+		{"other user", laptop.VIP.String(), "bob", "laptop", false},
+		{"other device", laptop.VIP.String(), "alice", "phone", false},
+		{"same user without device ID", laptop.VIP.String(), "alice", "", false},
+		{"unknown VIP", "10.100.0.99", "alice", "laptop", false},
+		{"same user and device", laptop.VIP.String(), "alice", "laptop", true},
+	}
+	for _, tt := range tests {
+		if _, ok := m.TakeOver(tt.vip, tt.user, tt.device); ok != tt.want {
+			t.Errorf("%s: TakeOver = %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+	if _, ok := m.Lookup(laptop.VIP.String()); ok {
+		t.Error("session still registered after TakeOver")
+	}
+	if _, ok := m.Lookup(shared.VIP.String()); !ok {
+		t.Error("shared session was evicted")
+	}
+}
+
+func TestKick(t *testing.T) {
+	m, err := NewManager("10.100.0.0/24", "10.100.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vip, err := m.AllocateIP("alice", "laptop", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := m.AddSession(vip, nil, "alice", "laptop")
+	ticket := s.Ticket
+
+	if _, user, ok := m.Kick(vip.String()); !ok || user != "alice" {
+		t.Fatalf("Kick = %q, %v; want alice, true", user, ok)
+	}
+	if _, ok := m.Lookup(vip.String()); ok {
+		t.Fatal("session still registered after Kick")
+	}
+	if _, _, err := m.Resume(ticket, "", nil); err != ErrInvalidTicket {
+		t.Fatalf("Resume after Kick = %v, want ErrInvalidTicket", err)
+	}
+	if used, _ := m.PoolStats(); used != 1 { // The server VIP
+		t.Fatalf("%d addresses in use after Kick, want 1", used)
+	}
+	if _, _, ok := m.Kick(vip.String()); ok {
+		t.Fatal("second Kick succeeded")
+	}
+}
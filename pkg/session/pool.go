@@ -0,0 +1,91 @@
+package session
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// ipPool tracks address usage in an IPv4 subnet with one bit per address,
+// so a /16 costs 8 KiB instead of a slice of 65k net.IPs
+type ipPool struct {
+	base uint32   // Network address
+	size uint32   // Number of addresses in the subnet
+	used []uint64 // Bit set per host offset
+	free int
+}
+
+func newIPPool(n *net.IPNet) (*ipPool, error) {
+	v4 := n.IP.To4()
+	ones, bits := n.Mask.Size()
+	if v4 == nil || bits != 32 {
+		return nil, fmt.Errorf("subnet %s is not IPv4", n)
+	}
+	if ones > 30 {
+		return nil, fmt.Errorf("subnet %s is too small (need /30 or larger)", n)
+	}
+	size := uint32(1) << uint(32-ones)
+	p := &ipPool{
+		base: binary.BigEndian.Uint32(v4) & binary.BigEndian.Uint32(net.IP(n.Mask).To4()),
+		size: size,
+		used: make([]uint64, (size+63)/64),
+		free: int(size),
+	}
+	// Network and broadcast addresses are never assignable
+	p.take(0)
+	p.take(size - 1)
+	return p, nil
+}
+
+// offset returns the host offset of ip within the pool
+func (p *ipPool) offset(ip net.IP) (uint32, bool) {
+	v4 := ip.To4()
+	if v4 == nil {
+		return 0, false
+	}
+	off := binary.BigEndian.Uint32(v4) - p.base
+	return off, off < p.size
+}
+
+func (p *ipPool) ip(off uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, p.base+off)
+	return ip
+}
+
+func (p *ipPool) isFree(off uint32) bool {
+	return p.used[off/64]&(1<<(off%64)) == 0
+}
+
+// take marks off as used and reports whether it was free
+func (p *ipPool) take(off uint32) bool {
+	if !p.isFree(off) {
+		return false
+	}
+	p.used[off/64] |= 1 << (off % 64)
+	p.free--
+	return true
+}
+
+func (p *ipPool) release(off uint32) {
+	if p.isFree(off) {
+		return
+	}
+	p.used[off/64] &^= 1 << (off % 64)
+	p.free++
+}
+
+// next returns the first free offset at or after start (wrapping) that
+// satisfies accept, or false if none exists
+func (p *ipPool) next(start uint32, accept func(off uint32) bool) (uint32, bool) {
+	if p.free == 0 {
+		return 0, false
+	}
+	for i := uint32(0); i < p.size; i++ {
+		off := (start + i) % p.size
+		if p.isFree(off) && accept(off) {
+			return off, true
+		}
+	}
+	return 0, false
+}
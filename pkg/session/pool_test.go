@@ -0,0 +1,92 @@
+package session
+
+import (
+	"net"
+	"testing"
+)
+
+func mustPool(t *testing.T, cidr string) *ipPool {
+	t.Helper()
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newIPPool(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPoolSizes(t *testing.T) {
+	tests := []struct {
+		cidr string
+		free int
+	}{
+		{"10.0.0.0/30", 2},
+		{"10.0.0.0/24", 254},
+		{"10.0.0.0/22", 1022},
+		{"10.0.0.0/16", 65534},
+	}
+	for _, tt := range tests {
+		if p := mustPool(t, tt.cidr); p.free != tt.free {
+			t.Errorf("%s: %d free addresses, want %d", tt.cidr, p.free, tt.free)
+		}
+	}
+
+	for _, cidr := range []string{"10.0.0.0/31", "10.0.0.0/32", "fd00::/64"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		if _, err := newIPPool(n); err == nil {
+			t.Errorf("%s: accepted", cidr)
+		}
+	}
+}
+
+func TestPoolExhaustion(t *testing.T) {
+	p := mustPool(t, "10.0.0.0/22")
+	seen := make(map[uint32]bool)
+	for {
+		off, ok := p.next(0, func(uint32) bool { return true })
+		if !ok {
+			break
+		}
+		if seen[off] || off == 0 || off == p.size-1 {
+			t.Fatalf("offset %d handed out twice or is network/broadcast", off)
+		}
+		seen[off] = true
+		if !p.take(off) {
+			t.Fatalf("take(%d) of a free offset failed", off)
+		}
+	}
+	if len(seen) != 1022 || p.free != 0 {
+		t.Fatalf("allocated %d addresses, %d left; want 1022, 0", len(seen), p.free)
+	}
+
+	p.release(700)
+	p.release(700) // Double release must not inflate the count
+	if p.free != 1 {
+		t.Fatalf("free = %d after release, want 1", p.free)
+	}
+	if off, ok := p.next(5, func(uint32) bool { return true }); !ok || off != 700 {
+		t.Fatalf("next = %d, %v; want 700", off, ok)
+	}
+}
+
+func TestPoolOffsets(t *testing.T) {
+	p := mustPool(t, "10.0.4.0/22")
+	if off, ok := p.offset(net.ParseIP("10.0.5.1")); !ok || off != 257 {
+		t.Fatalf("offset(10.0.5.1) = %d, %v; want 257", off, ok)
+	}
+	if got := p.ip(257).String(); got != "10.0.5.1" {
+		t.Fatalf("ip(257) = %s", got)
+	}
+	for _, ip := range []string{"10.0.3.255", "10.0.8.0", "fd00::1"} {
+		if _, ok := p.offset(net.ParseIP(ip)); ok {
+			t.Errorf("offset(%s) is in the pool", ip)
+		}
+	}
+	// next wraps around and honours accept
+	if off, ok := p.next(p.size-1, func(off uint32) bool { return off%2 == 0 }); !ok || off != 2 {
+		t.Fatalf("next = %d, %v; want 2", off, ok)
+	}
+}
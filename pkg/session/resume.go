@@ -0,0 +1,95 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ResumeTTL is how long a ticket stays valid after its session has ended.
+// Tickets of live sessions do not expire.
+const ResumeTTL = 10 * time.Minute
+
+var ErrInvalidTicket = errors.New("invalid or expired resumption ticket")
+
+type ticketEntry struct {
+	user    string
+	device  string
+	vip     string
+	expires time.Time // Zero while the session is registered
+}
+
+// newTicket issues a ticket for s, replacing its previous one. Caller must hold m.mu.
+func (m *Manager) newTicket(s *Session) {
+	if s.Ticket != "" {
+		delete(m.tickets, s.Ticket)
+	}
+	b := make([]byte, 32)
+	rand.Read(b)
+	s.Ticket = hex.EncodeToString(b)
+	m.tickets[s.Ticket] = &ticketEntry{user: s.User, device: s.Device, vip: s.VIP.String()}
+}
+
+// expireTicket starts the ResumeTTL countdown for a removed session's ticket
+// and drops tickets that have run out. Caller must hold m.mu.
+func (m *Manager) expireTicket(s *Session) {
+	now := time.Now()
+	if e, ok := m.tickets[s.Ticket]; ok {
+		e.expires = now.Add(ResumeTTL)
+	}
+	for t, e := range m.tickets {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			delete(m.tickets, t)
+		}
+	}
+}
+
+// Resume redeems a resumption ticket for a new connection. If the ticket's
+// session is still registered it is re-bound to conn in place and the previous
+// connection is returned for the caller to close. Otherwise the session is
+// recreated on the same VIP, provided that address is still free.
+// The ticket is consumed either way; the session carries a fresh one.
+// A non-empty user (e.g. from a client certificate) must match the ticket's.
+func (m *Manager) Resume(ticket, user string, conn *quic.Conn) (s *Session, old *quic.Conn, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.tickets[ticket]
+	if !ok || (!e.expires.IsZero() && time.Now().After(e.expires)) || (user != "" && user != e.user) {
+		delete(m.tickets, ticket)
+		return nil, nil, ErrInvalidTicket
+	}
+	delete(m.tickets, ticket)
+
+	if s, ok := m.sessions[e.vip]; ok {
+		if s.Ticket != ticket {
+			return nil, nil, ErrInvalidTicket // The VIP has moved on to another session
+		}
+		old = s.Conn
+		s.Conn = conn
+		m.newTicket(s)
+		return s, old, nil
+	}
+
+	ip := net.ParseIP(e.vip).To4()
+	if k, reserved := m.reservedIPs[e.vip]; reserved {
+		if (k != ClientKey(e.user, e.device) && k != "user:"+e.user) || m.claimed[e.vip] {
+			return nil, nil, ErrInvalidTicket
+		}
+		m.claimed[e.vip] = true
+	} else {
+		off, ok := m.pool.offset(ip)
+		if !ok || !m.pool.take(off) {
+			return nil, nil, ErrInvalidTicket
+		}
+		m.recordLease(ClientKey(e.user, e.device), ip)
+	}
+
+	s = &Session{Conn: conn, VIP: ip, VIP6: m.mapIPv6(ip), User: e.user, Device: e.device}
+	m.add(s)
+	return s, nil, nil
+}
@@ -0,0 +1,86 @@
+package session
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/webdunesurfer/SloPN/pkg/shaper"
+)
+
+// Traffic counts a session's data-path packets. Rx is what the server accepted
+// from the client (packets dropped as spoofed, by the ACL or by shaping are not
+// counted), Tx what it sent to the client (including spoke-to-spoke traffic
+// forwarded on the fast path). All fields are updated atomically.
+// Limits holds the session's bandwidth buckets, unlimited until set.
+type Traffic struct {
+	Limits    shaper.Limiter
+	RxPackets atomic.Uint64
+	RxBytes   atomic.Uint64
+	TxPackets atomic.Uint64
+	TxBytes   atomic.Uint64
+	lastRx    atomic.Int64 // Unix nanoseconds, 0 if never
+	lastTx    atomic.Int64
+}
+
+// Received records a packet of n bytes accepted from the client
+func (t *Traffic) Received(n int) {
+	t.RxPackets.Add(1)
+	t.RxBytes.Add(uint64(n))
+	t.lastRx.Store(time.Now().UnixNano())
+}
+
+// Sent records a packet of n bytes delivered to the client
+func (t *Traffic) Sent(n int) {
+	t.TxPackets.Add(1)
+	t.TxBytes.Add(uint64(n))
+	t.lastTx.Store(time.Now().UnixNano())
+}
+
+// LastRx returns when the client last sent a packet (zero if never)
+func (t *Traffic) LastRx() time.Time {
+	return unixTime(t.lastRx.Load())
+}
+
+// LastTx returns when a packet was last sent to the client (zero if never)
+func (t *Traffic) LastTx() time.Time {
+	return unixTime(t.lastTx.Load())
+}
+
+// LastActivity returns the later of LastRx and LastTx
+func (t *Traffic) LastActivity() time.Time {
+	rx, tx := t.lastRx.Load(), t.lastTx.Load()
+	if tx > rx {
+		rx = tx
+	}
+	return unixTime(rx)
+}
+
+// String summarises the counters for log lines
+func (t *Traffic) String() string {
+	return fmt.Sprintf("Rx: %d pkts/%d bytes; Tx: %d pkts/%d bytes",
+		t.RxPackets.Load(), t.RxBytes.Load(), t.TxPackets.Load(), t.TxBytes.Load())
+}
+
+func unixTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// Target is the data-path lookup: it returns the connection for a given IPv4
+// or IPv6 VIP together with the session's counters
+func (m *Manager) Target(vip string) (*quic.Conn, *Traffic, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.sessions[vip]
+	if !ok {
+		s, ok = m.sessions6[vip]
+	}
+	if !ok {
+		return nil, nil, false
+	}
+	return s.Conn, s.Traffic, true
+}
@@ -0,0 +1,290 @@
+// Package shaper implements the server's bandwidth limits: token buckets per
+// session and direction, resolved from a per-user/per-group policy, plus a
+// global cap shared by all sessions.
+package shaper
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limit is a rate in each direction, seen from the client: Up is traffic the
+// client sends, Down traffic it receives. Zero means unlimited.
+type Limit struct {
+	UpKbps   int `json:"up_kbps,omitempty"`
+	DownKbps int `json:"down_kbps,omitempty"`
+	BurstKB  int `json:"burst_kb,omitempty"` // Bucket size; default 100ms at the rate, at least MinBurst
+}
+
+// IsZero reports whether l limits nothing
+func (l Limit) IsZero() bool {
+	return l.UpKbps == 0 && l.DownKbps == 0
+}
+
+func (l Limit) validate() error {
+	if l.UpKbps < 0 || l.DownKbps < 0 || l.BurstKB < 0 {
+		return fmt.Errorf("negative limit")
+	}
+	return nil
+}
+
+// File is the shaping policy file format. A session gets the limit of its
+// user, else of the first of its groups that has one, else the default.
+type File struct {
+	Global     Limit            `json:"global"` // Cap on all sessions together
+	Default    Limit            `json:"default"`
+	Users      map[string]Limit `json:"users,omitempty"`
+	Groups     map[string]Limit `json:"groups,omitempty"`
+	MaxDelayMs int              `json:"max_delay_ms,omitempty"` // Queue packets up to this long before dropping
+}
+
+// IsEmpty reports whether f limits nothing at all
+func (f File) IsEmpty() bool {
+	return f.Global.IsZero() && f.Default.IsZero() && len(f.Users) == 0 && len(f.Groups) == 0
+}
+
+// Direction selects a bucket of a Limiter
+type Direction int
+
+const (
+	Up   Direction = iota // Client to server
+	Down                  // Server to client
+)
+
+// MinBurst is the smallest bucket: a few full-size packets
+const MinBurst = 16 * 1024
+
+// Bucket is a token bucket counting bytes. The zero value is unlimited.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second; 0 = unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// SetRate changes the bucket's rate. A bucket that was unlimited starts full.
+func (b *Bucket) SetRate(kbps, burstKB int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rate := float64(kbps) * 1000 / 8
+	burst := float64(burstKB) * 1024
+	if burst == 0 {
+		burst = rate / 10
+	}
+	if burst < MinBurst {
+		burst = MinBurst
+	}
+	now := time.Now()
+	if b.rate == 0 {
+		b.tokens = burst
+	} else {
+		// Credit the time since the last packet at the old rate
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.rate, b.burst, b.last = rate, burst, now
+}
+
+// Reserve takes n bytes from the bucket. If it is short, the packet may go
+// into debt as long as the debt is repaid within maxWait; the returned wait
+// is how long to hold it back. Otherwise ok is false and nothing is taken.
+func (b *Bucket) Reserve(n int, maxWait time.Duration) (wait time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		return 0, true
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	need := float64(n)
+	if b.tokens >= need {
+		b.tokens -= need
+		return 0, true
+	}
+	wait = time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+	if wait > maxWait {
+		return 0, false
+	}
+	b.tokens -= need
+	return wait, true
+}
+
+// refund returns n bytes taken by Reserve
+func (b *Bucket) refund(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate != 0 {
+		b.tokens += float64(n)
+	}
+}
+
+// Limiter holds a session's buckets. The zero value is unlimited.
+type Limiter struct {
+	buckets [2]Bucket
+	Dropped atomic.Uint64 // Packets dropped in either direction
+	Delayed atomic.Uint64
+}
+
+// Policy is the server-wide shaping policy plus the global buckets
+type Policy struct {
+	mu       sync.RWMutex
+	path     string // Empty for a policy built by New
+	file     File
+	maxDelay time.Duration
+	global   [2]Bucket
+
+	dropped [2]atomic.Uint64
+	delayed [2]atomic.Uint64
+}
+
+// Load reads a shaping policy from a JSON file
+func Load(path string) (*Policy, error) {
+	p := &Policy{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// New builds a policy from an in-memory file, e.g. from the server config file
+func New(f File) (*Policy, error) {
+	p := &Policy{}
+	if err := p.Set(f); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload re-reads the backing file. On error the previous policy stays active.
+// Sessions keep their limits until Apply is called for them.
+func (p *Policy) Reload() error {
+	if p.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("parse %s: %v", p.path, err)
+	}
+	return p.Set(f)
+}
+
+// Set validates and replaces the policy. On error the previous policy stays active.
+func (p *Policy) Set(f File) error {
+	if err := f.Global.validate(); err != nil {
+		return fmt.Errorf("global: %v", err)
+	}
+	if err := f.Default.validate(); err != nil {
+		return fmt.Errorf("default: %v", err)
+	}
+	for name, l := range f.Users {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("user %q: %v", name, err)
+		}
+	}
+	for name, l := range f.Groups {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("group %q: %v", name, err)
+		}
+	}
+	if f.MaxDelayMs < 0 {
+		return fmt.Errorf("max_delay_ms: negative")
+	}
+
+	p.mu.Lock()
+	p.file = f
+	p.maxDelay = time.Duration(f.MaxDelayMs) * time.Millisecond
+	p.mu.Unlock()
+	p.global[Up].SetRate(f.Global.UpKbps, f.Global.BurstKB)
+	p.global[Down].SetRate(f.Global.DownKbps, f.Global.BurstKB)
+	return nil
+}
+
+// For returns the limit for a user with the given groups
+func (p *Policy) For(user string, groups []string) Limit {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if l, ok := p.file.Users[user]; ok {
+		return l
+	}
+	for _, g := range groups {
+		if l, ok := p.file.Groups[g]; ok {
+			return l
+		}
+	}
+	return p.file.Default
+}
+
+// Set changes the limiter's rates, e.g. to throttle a session
+func (l *Limiter) Set(lim Limit) {
+	l.buckets[Up].SetRate(lim.UpKbps, lim.BurstKB)
+	l.buckets[Down].SetRate(lim.DownKbps, lim.BurstKB)
+}
+
+// Apply sets a session's buckets from the policy
+func (p *Policy) Apply(l *Limiter, user string, groups []string) Limit {
+	lim := p.For(user, groups)
+	l.Set(lim)
+	return lim
+}
+
+// Allow charges an n-byte packet to the session and the global cap. It
+// returns how long to hold the packet back, or ok=false to drop it. Without
+// a Limiter only the global cap applies.
+func (p *Policy) Allow(l *Limiter, dir Direction, n int) (wait time.Duration, ok bool) {
+	p.mu.RLock()
+	maxDelay := p.maxDelay
+	p.mu.RUnlock()
+
+	var own time.Duration
+	if l != nil {
+		if own, ok = l.buckets[dir].Reserve(n, maxDelay); !ok {
+			p.drop(l, dir)
+			return 0, false
+		}
+	}
+	if wait, ok = p.global[dir].Reserve(n, maxDelay); !ok {
+		if l != nil {
+			l.buckets[dir].refund(n)
+		}
+		p.drop(l, dir)
+		return 0, false
+	}
+	if own > wait {
+		wait = own
+	}
+	if wait > 0 {
+		p.delayed[dir].Add(1)
+		if l != nil {
+			l.Delayed.Add(1)
+		}
+	}
+	return wait, true
+}
+
+func (p *Policy) drop(l *Limiter, dir Direction) {
+	p.dropped[dir].Add(1)
+	if l != nil {
+		l.Dropped.Add(1)
+	}
+}
+
+// Stats returns the packets dropped and delayed in a direction since start
+func (p *Policy) Stats(dir Direction) (dropped, delayed uint64) {
+	return p.dropped[dir].Load(), p.delayed[dir].Load()
+}
@@ -0,0 +1,137 @@
+package shaper
+
+import (
+	"testing"
+	"time"
+)
+
+// 8 kbps is 1000 bytes per second, so a 1000-byte debt takes a second to repay
+
+func mustPolicy(t *testing.T, f File) *Policy {
+	t.Helper()
+	p, err := New(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// about checks that wait is want, less the little the bucket refilled meanwhile
+func about(t *testing.T, what string, wait, want time.Duration) {
+	t.Helper()
+	if wait > want || wait < want-100*time.Millisecond {
+		t.Fatalf("%s: wait = %v, want about %v", what, wait, want)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	var b Bucket
+	if wait, ok := b.Reserve(1<<30, 0); !ok || wait != 0 {
+		t.Fatalf("zero bucket: wait = %v, ok = %v", wait, ok)
+	}
+
+	b.SetRate(8, 0)
+	if wait, ok := b.Reserve(MinBurst, 0); !ok || wait != 0 {
+		t.Fatalf("full bucket: wait = %v, ok = %v", wait, ok)
+	}
+	if _, ok := b.Reserve(1000, 0); ok {
+		t.Fatal("empty bucket passed a packet without a delay")
+	}
+	wait, ok := b.Reserve(1000, 2*time.Second)
+	if !ok {
+		t.Fatal("packet dropped within the delay")
+	}
+	about(t, "first debt", wait, time.Second)
+
+	// A refused packet takes nothing, so the next one waits behind the first only
+	if _, ok := b.Reserve(1000, 1500*time.Millisecond); ok {
+		t.Fatal("packet passed beyond the delay")
+	}
+	b.refund(1000)
+	wait, _ = b.Reserve(1000, 2*time.Second)
+	about(t, "after refund", wait, time.Second)
+	wait, _ = b.Reserve(1000, 3*time.Second)
+	about(t, "second debt", wait, 2*time.Second)
+}
+
+func TestSetRate(t *testing.T) {
+	var b Bucket
+	b.SetRate(8, 32)
+	if _, ok := b.Reserve(32*1024, 0); !ok {
+		t.Fatal("burst_kb not applied")
+	}
+
+	// A live bucket keeps its tokens: still empty, now refilling ten times faster
+	b.SetRate(80, 0)
+	wait, ok := b.Reserve(1000, time.Second)
+	if !ok {
+		t.Fatal("packet dropped after raising the rate")
+	}
+	about(t, "raised rate", wait, 100*time.Millisecond)
+
+	b.SetRate(0, 0)
+	if wait, ok := b.Reserve(1<<30, 0); !ok || wait != 0 {
+		t.Fatalf("unlimited bucket: wait = %v, ok = %v", wait, ok)
+	}
+	// Limited again, it starts full
+	b.SetRate(8, 0)
+	if _, ok := b.Reserve(MinBurst, 0); !ok {
+		t.Fatal("bucket did not start full")
+	}
+}
+
+func TestAllowGlobalCap(t *testing.T) {
+	p := mustPolicy(t, File{Global: Limit{UpKbps: 8}})
+	var alice, bob, carol Limiter
+
+	if _, ok := p.Allow(&alice, Up, MinBurst); !ok {
+		t.Fatal("first packet dropped")
+	}
+	// Sessions without a limit of their own still share the cap
+	if _, ok := p.Allow(&bob, Up, 1000); ok {
+		t.Fatal("global cap not shared")
+	}
+	if _, ok := p.Allow(nil, Up, 1000); ok {
+		t.Fatal("global cap not applied without a limiter")
+	}
+	if _, ok := p.Allow(&bob, Down, 1<<20); !ok {
+		t.Fatal("cap applied to the other direction")
+	}
+	if n := bob.Dropped.Load(); n != 1 {
+		t.Fatalf("bob dropped %d, want 1", n)
+	}
+
+	// A session's own bucket is refunded when the global cap drops the packet
+	carol.Set(Limit{UpKbps: 8})
+	if _, ok := p.Allow(&carol, Up, 1000); ok {
+		t.Fatal("global cap not applied to a limited session")
+	}
+	if _, ok := carol.buckets[Up].Reserve(MinBurst, 0); !ok {
+		t.Fatal("carol's bucket charged for a dropped packet")
+	}
+	if dropped, delayed := p.Stats(Up); dropped != 3 || delayed != 0 {
+		t.Fatalf("stats: dropped = %d, delayed = %d, want 3, 0", dropped, delayed)
+	}
+}
+
+func TestAllowDelay(t *testing.T) {
+	p := mustPolicy(t, File{Global: Limit{DownKbps: 8}, MaxDelayMs: 2000})
+	var l Limiter
+	l.Set(Limit{DownKbps: 80})
+
+	if wait, ok := p.Allow(&l, Down, MinBurst); !ok || wait != 0 {
+		t.Fatalf("first packet: wait = %v, ok = %v", wait, ok)
+	}
+	// The longer of the two waits applies: the global bucket's second
+	wait, ok := p.Allow(&l, Down, 1000)
+	if !ok {
+		t.Fatal("packet dropped within max_delay_ms")
+	}
+	about(t, "global debt", wait, time.Second)
+	if n := l.Delayed.Load(); n != 1 {
+		t.Fatalf("delayed %d, want 1", n)
+	}
+	if _, delayed := p.Stats(Down); delayed != 1 {
+		t.Fatalf("policy delayed %d, want 1", delayed)
+	}
+}
@@ -1,11 +1,45 @@
 package tunutil
 
+import (
+	"fmt"
+	"net"
+)
+
 type Config struct {
 	Name            string
 	Addr            string
 	Peer            string
 	Mask            string
 	MTU             int
+	Addr6           string // Optional IPv6 address
+	Prefix6         int    // IPv6 prefix length for Addr6
 	SkipSubnetRoute bool
 	NoRoute         bool // If true, do not touch the routing table at all
 }
+
+// DefaultMask is used when the server does not announce a subnet mask
+const DefaultMask = "255.255.255.0"
+
+// PrefixLen converts a dotted netmask (e.g. "255.255.240.0") to a prefix length.
+// Invalid or empty masks fall back to /24.
+func PrefixLen(mask string) int {
+	ip := net.ParseIP(mask).To4()
+	if ip == nil {
+		return 24
+	}
+	ones, bits := net.IPMask(ip).Size()
+	if bits == 0 {
+		return 24
+	}
+	return ones
+}
+
+// Network returns the CIDR of the subnet containing addr (e.g. "10.100.0.0/24")
+func Network(addr, mask string) string {
+	prefix := PrefixLen(mask)
+	ip := net.ParseIP(addr).To4()
+	if ip == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/%d", ip.Mask(net.CIDRMask(prefix, 32)), prefix)
+}
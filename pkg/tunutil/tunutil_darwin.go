@@ -26,6 +26,13 @@ func CreateInterface(cfg Config) (*water.Interface, error) {
 		return nil, fmt.Errorf("ifconfig failed: %v (output: %s)", err, string(output))
 	}
 
+	if cfg.Addr6 != "" {
+		addr6Cmd := exec.Command("ifconfig", ifce.Name(), "inet6", "add", cfg.Addr6, "prefixlen", fmt.Sprintf("%d", cfg.Prefix6))
+		if output, err := addr6Cmd.CombinedOutput(); err != nil {
+			fmt.Printf("Warning: failed to add IPv6 address %s: %v (output: %s)\n", cfg.Addr6, err, string(output))
+		}
+	}
+
 	if cfg.NoRoute {
 		fmt.Printf("macOS Interface %s ready (Skipped routing table modification)\n", ifce.Name())
 		return ifce, nil
@@ -37,8 +44,9 @@ func CreateInterface(cfg Config) (*water.Interface, error) {
 		routeCmd.Run()
 		fmt.Printf("macOS Interface %s ready (Host route to %s)\n", ifce.Name(), cfg.Peer)
 	} else {
-		exec.Command("route", "delete", "-net", "10.100.0.0/24").Run()
-		routeCmd := exec.Command("route", "add", "-net", "10.100.0.0/24", "-interface", ifce.Name())
+		subnet := Network(cfg.Addr, cfg.Mask)
+		exec.Command("route", "delete", "-net", subnet).Run()
+		routeCmd := exec.Command("route", "add", "-net", subnet, "-interface", ifce.Name())
 		routeCmd.Run()
 		fmt.Printf("macOS Interface %s ready (Subnet route)\n", ifce.Name())
 	}
@@ -27,15 +27,27 @@ func CreateInterface(cfg Config) (*water.Interface, error) {
 
 	fmt.Printf("Created TUN interface: %s\n", ifce.Name())
 
-	addrCmd := exec.Command("ip", "addr", "add", cfg.Addr+"/24", "dev", ifce.Name())
+	prefix := PrefixLen(cfg.Mask)
+	addrCmd := exec.Command("ip", "addr", "add", fmt.Sprintf("%s/%d", cfg.Addr, prefix), "dev", ifce.Name())
 	addrCmd.Run()
 
+	if cfg.Addr6 != "" {
+		exec.Command("sysctl", "-w", fmt.Sprintf("net.ipv6.conf.%s.disable_ipv6=0", ifce.Name())).Run()
+		addr6Cmd := exec.Command("ip", "-6", "addr", "add", fmt.Sprintf("%s/%d", cfg.Addr6, cfg.Prefix6), "dev", ifce.Name())
+		if output, err := addr6Cmd.CombinedOutput(); err != nil {
+			fmt.Printf("Warning: failed to add IPv6 address %s: %v (output: %s)\n", cfg.Addr6, err, string(output))
+		}
+	}
+
 	exec.Command("ip", "link", "set", "dev", ifce.Name(), "mtu", fmt.Sprintf("%d", cfg.MTU)).Run()
 	upCmd := exec.Command("ip", "link", "set", "dev", ifce.Name(), "up")
 	if output, err := upCmd.CombinedOutput(); err != nil {
 		return nil, fmt.Errorf("ip link up failed: %v (output: %s)", err, string(output))
 	}
 
-	fmt.Printf("Linux Interface %s ready: IP=%s/24\n", ifce.Name(), cfg.Addr)
+	fmt.Printf("Linux Interface %s ready: IP=%s/%d\n", ifce.Name(), cfg.Addr, prefix)
+	if cfg.Addr6 != "" {
+		fmt.Printf("Linux Interface %s IPv6: %s/%d\n", ifce.Name(), cfg.Addr6, cfg.Prefix6)
+	}
 	return ifce, nil
 }
\ No newline at end of file
@@ -23,7 +23,7 @@ func CreateInterface(cfg Config) (*water.Interface, error) {
 	waterCfg.PlatformSpecificParams = water.PlatformSpecificParams{
 		ComponentID:   "tap0901",
 		InterfaceName: targetName, 
-		Network:       fmt.Sprintf("%s/%s", cfg.Addr, "24"),
+		Network:       fmt.Sprintf("%s/%d", cfg.Addr, PrefixLen(cfg.Mask)),
 	}
 
 	ifce, err := water.New(waterCfg)
@@ -81,6 +81,13 @@ func configureIP(ifce *water.Interface, ifceName string, cfg Config) (*water.Int
 		}
 	}
 
+	if cfg.Addr6 != "" {
+		addr6Cmd := exec.Command("netsh", "interface", "ipv6", "add", "address", ifceName, fmt.Sprintf("%s/%d", cfg.Addr6, cfg.Prefix6), "store=active")
+		if output, err := addr6Cmd.CombinedOutput(); err != nil {
+			fmt.Printf("Warning: failed to add IPv6 address %s: %v (output: %s)\n", cfg.Addr6, err, string(output))
+		}
+	}
+
 	fmt.Printf("Windows Interface %s ready: IP=%s MTU=%d\n", ifceName, cfg.Addr, cfg.MTU)
 	return ifce, nil
 }
\ No newline at end of file
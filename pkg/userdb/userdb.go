@@ -0,0 +1,215 @@
+package userdb
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrDisabled           = errors.New("account disabled")
+	ErrExpired            = errors.New("account expired")
+)
+
+// User is a single account in the user database.
+// TokenHash is either "sha256:<hex>" or a bcrypt hash ("$2a$...").
+// Bcrypt hashes can only be matched when the client sends its user name.
+type User struct {
+	Name      string     `json:"name"`
+	TokenHash string     `json:"token_hash"`
+	Enabled   bool       `json:"enabled"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	Groups    []string   `json:"groups,omitempty"`
+	Quota     *Quota     `json:"quota,omitempty"`
+}
+
+// Quota actions once a user has used up a quota
+const (
+	QuotaDisconnect = "disconnect"
+	QuotaThrottle   = "throttle"
+)
+
+// Quota caps a user's tunnel traffic (both directions, all devices) per
+// calendar day and/or month in server local time. 1 MB is 10^6 bytes.
+type Quota struct {
+	DailyMB      int64  `json:"daily_mb,omitempty"`
+	MonthlyMB    int64  `json:"monthly_mb,omitempty"`
+	Action       string `json:"action,omitempty"`        // QuotaDisconnect (default) or QuotaThrottle
+	ThrottleKbps int    `json:"throttle_kbps,omitempty"` // Rate in each direction when throttled (default 256)
+}
+
+func (q *Quota) validate() error {
+	if q.DailyMB < 0 || q.MonthlyMB < 0 || q.ThrottleKbps < 0 {
+		return fmt.Errorf("negative quota")
+	}
+	switch q.Action {
+	case "", QuotaDisconnect, QuotaThrottle:
+	default:
+		return fmt.Errorf("unknown quota action %q", q.Action)
+	}
+	return nil
+}
+
+type fileFormat struct {
+	Users []*User `json:"users"`
+}
+
+// Store is a file-backed user database that can be reloaded at runtime
+type Store struct {
+	mu     sync.RWMutex
+	path   string           // Empty for a store built by New
+	users  map[string]*User // Key: user name
+	byHash map[string]*User // Key: hex SHA-256 of the token
+}
+
+// HashToken returns the "sha256:<hex>" form of a token for use in the users file
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Load reads the user database from a JSON file
+func Load(path string) (*Store, error) {
+	s := &Store{path: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// New builds a store from an in-memory user list, e.g. from the server config file
+func New(list []*User) (*Store, error) {
+	s := &Store{}
+	if err := s.Set(list); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads the backing file. On error the previous user set stays active.
+func (s *Store) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	var f fileFormat
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("parse %s: %v", s.path, err)
+	}
+	return s.Set(f.Users)
+}
+
+// Set validates and replaces the user set. On error the previous set stays active.
+func (s *Store) Set(list []*User) error {
+	users := make(map[string]*User)
+	byHash := make(map[string]*User)
+	for i, u := range list {
+		if u.Name == "" {
+			return fmt.Errorf("user #%d: missing name", i+1)
+		}
+		if _, dup := users[u.Name]; dup {
+			return fmt.Errorf("user %q: duplicate entry", u.Name)
+		}
+		switch {
+		case strings.HasPrefix(u.TokenHash, "sha256:"):
+			h := strings.ToLower(strings.TrimPrefix(u.TokenHash, "sha256:"))
+			if len(h) != sha256.Size*2 {
+				return fmt.Errorf("user %q: malformed sha256 token hash", u.Name)
+			}
+			// A login without a name would resolve to either account
+			if other, dup := byHash[h]; dup {
+				return fmt.Errorf("user %q: same token as user %q", u.Name, other.Name)
+			}
+			byHash[h] = u
+		case strings.HasPrefix(u.TokenHash, "$2"):
+			// bcrypt: matched by name only
+		default:
+			return fmt.Errorf("user %q: unsupported token hash format", u.Name)
+		}
+		if u.Quota != nil {
+			if err := u.Quota.validate(); err != nil {
+				return fmt.Errorf("user %q: %v", u.Name, err)
+			}
+		}
+		users[u.Name] = u
+	}
+
+	s.mu.Lock()
+	s.users = users
+	s.byHash = byHash
+	s.mu.Unlock()
+	return nil
+}
+
+// Authenticate verifies a token and returns the matching user.
+// If name is empty, the token is looked up among sha256-hashed entries.
+func (s *Store) Authenticate(name, token string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var u *User
+	if name != "" {
+		u = s.users[name]
+		if u == nil || !matchToken(u.TokenHash, token) {
+			return nil, ErrInvalidCredentials
+		}
+	} else {
+		sum := sha256.Sum256([]byte(token))
+		u = s.byHash[hex.EncodeToString(sum[:])]
+		if u == nil {
+			return nil, ErrInvalidCredentials
+		}
+	}
+
+	return check(u)
+}
+
+// Lookup returns an account by name without checking a token, e.g. when a
+// session is resumed. Disabled and expired accounts are rejected as usual.
+func (s *Store) Lookup(name string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u := s.users[name]
+	if u == nil {
+		return nil, ErrInvalidCredentials
+	}
+	return check(u)
+}
+
+// Count returns the number of users currently loaded
+func (s *Store) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.users)
+}
+
+func check(u *User) (*User, error) {
+	if !u.Enabled {
+		return nil, ErrDisabled
+	}
+	if u.Expires != nil && time.Now().After(*u.Expires) {
+		return nil, ErrExpired
+	}
+	return u, nil
+}
+
+func matchToken(hash, token string) bool {
+	if strings.HasPrefix(hash, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(token)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.ToLower(hash)), []byte(HashToken(token))) == 1
+}
@@ -0,0 +1,54 @@
+package userdb
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSetRejectsDuplicateTokenHash(t *testing.T) {
+	list := []*User{
+		{Name: "alice", TokenHash: HashToken("shared"), Enabled: true},
+		{Name: "bob", TokenHash: strings.ToUpper(HashToken("shared")), Enabled: true},
+	}
+	if _, err := New(list); err == nil {
+		t.Fatal("New accepted two users with the same token")
+	}
+
+	s, err := New(list[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(list); err == nil {
+		t.Fatal("Set accepted two users with the same token")
+	}
+	// The previous set stays active
+	if u, err := s.Authenticate("", "shared"); err != nil || u.Name != "alice" {
+		t.Fatalf("Authenticate = %v, %v; want alice", u, err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	s, err := New([]*User{
+		{Name: "alice", TokenHash: HashToken("a"), Enabled: true},
+		{Name: "bob", TokenHash: HashToken("b")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, token string
+		want        error
+	}{
+		{"alice", "a", nil},
+		{"", "a", nil},
+		{"alice", "b", ErrInvalidCredentials},
+		{"", "c", ErrInvalidCredentials},
+		{"bob", "b", ErrDisabled},
+	}
+	for _, tt := range tests {
+		if _, err := s.Authenticate(tt.name, tt.token); !errors.Is(err, tt.want) {
+			t.Errorf("Authenticate(%q, %q) = %v, want %v", tt.name, tt.token, err, tt.want)
+		}
+	}
+}